@@ -0,0 +1,209 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Database operations for server administrators.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"github.com/dcrodman/archon/util"
+	"strings"
+	"time"
+)
+
+// Controls the behavior of WipeAllCharacters.
+type WipeOptions struct {
+	// Only count the characters that would be wiped; nothing is deleted.
+	DryRun bool
+	// Also delete accounts (along with their options and guildcards).
+	// Banned accounts are always kept so that bans survive the wipe.
+	DeleteAccounts bool
+}
+
+// Delete every character on the server, e.g. for a seasonal reset, and
+// return the number of characters wiped. Everything happens in a single
+// transaction so a failure leaves the database untouched.
+func WipeAllCharacters(db *sql.DB, opts WipeOptions) (int, error) {
+	if opts.DryRun {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM characters").Scan(&count)
+		return count, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM characters")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	wiped, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if opts.DeleteAccounts {
+		stmts := []string{
+			"DELETE FROM guildcard_entries WHERE guildcard IN " +
+				"(SELECT guildcard FROM account_data WHERE is_banned = false) OR friend_gc IN " +
+				"(SELECT guildcard FROM account_data WHERE is_banned = false)",
+			"DELETE FROM player_options WHERE guildcard IN " +
+				"(SELECT guildcard FROM account_data WHERE is_banned = false)",
+			"DELETE FROM account_data WHERE is_banned = false",
+		}
+		for _, stmt := range stmts {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(wiped), nil
+}
+
+// Returns the guildcards of the accounts that last logged in from the
+// machine with the hardware ID hwid (as returned by LoginPkt.HardwareID).
+func AccountsWithHardwareID(db *sql.DB, hwid string) ([]uint32, error) {
+	hwinfo, err := hex.DecodeString(hwid)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT guildcard FROM account_data WHERE lasthwinfo = ?", hwinfo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var guildcards []uint32
+	for rows.Next() {
+		var gc uint32
+		if err = rows.Scan(&gc); err != nil {
+			return nil, err
+		}
+		guildcards = append(guildcards, gc)
+	}
+	return guildcards, rows.Err()
+}
+
+// Returns the address the account first logged in from, or an empty string
+// if it hasn't logged in since addresses started being recorded.
+func AccountFirstIP(db *sql.DB, guildcard uint32) (string, error) {
+	var ip sql.NullString
+	err := db.QueryRow("SELECT first_ip FROM account_data WHERE guildcard = ?", guildcard).Scan(&ip)
+	return ip.String, err
+}
+
+// Show text in a message box to every logged in player and return the
+// number of players it was sent to. Players that can't be sent to (e.g.
+// because they disconnected partway through) are skipped.
+func BroadcastAnnouncement(text string) int {
+	sent := 0
+	for _, c := range sessions.Clients() {
+		if c.SendClientMessage(text) == 0 {
+			sent++
+		}
+	}
+	log.Infof("Sent announcement to %d players: %s", sent, text)
+	return sent
+}
+
+// Returns the total time played across all of the account's characters.
+func AccountTotalPlaytime(db *sql.DB, guildcard uint32) (time.Duration, error) {
+	var seconds int64
+	err := db.QueryRow("SELECT COALESCE(SUM(playtime), 0) FROM characters "+
+		"WHERE guildcard = ?", guildcard).Scan(&seconds)
+	return time.Duration(seconds) * time.Second, err
+}
+
+// Account details shown in the account roster.
+type AccountSummary struct {
+	Username  string
+	Guildcard uint32
+	IsBanned  bool
+	// Zero if the account hasn't logged in since logins started being
+	// recorded.
+	LastLogin      time.Time
+	CharacterCount int
+}
+
+// Returns up to limit accounts ordered by guildcard, skipping the first
+// offset, along with the number of characters each one has.
+func ListAccounts(db *sql.DB, offset, limit int) ([]AccountSummary, error) {
+	rows, err := db.Query("SELECT a.username, a.guildcard, a.is_banned, "+
+		"UNIX_TIMESTAMP(a.last_login), COUNT(c.guildcard) FROM account_data a "+
+		"LEFT JOIN characters c ON c.guildcard = a.guildcard "+
+		"GROUP BY a.guildcard ORDER BY a.guildcard LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts []AccountSummary
+	for rows.Next() {
+		var acct AccountSummary
+		var lastLogin sql.NullInt64
+		err = rows.Scan(&acct.Username, &acct.Guildcard, &acct.IsBanned,
+			&lastLogin, &acct.CharacterCount)
+		if err != nil {
+			return nil, err
+		}
+		if lastLogin.Valid {
+			acct.LastLogin = time.Unix(lastLogin.Int64, 0)
+		}
+		accounts = append(accounts, acct)
+	}
+	return accounts, rows.Err()
+}
+
+// Account and slot holding a character.
+type CharacterLocation struct {
+	Guildcard uint32
+	Slot      uint32
+}
+
+// Returns every character on the server, across all accounts, named name.
+// Names are compared as the player would see them and ignoring case, so
+// that impersonators can't slip past by changing the language prefix or
+// capitalization.
+func FindCharactersByName(db *sql.DB, name string) ([]CharacterLocation, error) {
+	// Names are stored as UTF-16 with an optional language prefix, so the
+	// comparison has to be done after decoding rather than in the query.
+	rows, err := db.Query("SELECT guildcard, slot_num, name FROM characters")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []CharacterLocation
+	for rows.Next() {
+		var loc CharacterLocation
+		var charName []uint8
+		if err = rows.Scan(&loc.Guildcard, &loc.Slot, &charName); err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(displayName(util.CompressUtf16(charName)), name) {
+			matches = append(matches, loc)
+		}
+	}
+	return matches, rows.Err()
+}
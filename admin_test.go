@@ -0,0 +1,230 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWipeAllCharactersDryRun(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("SELECT COUNT(*) FROM characters").
+		WillReturnRows([]string{"count"}, []driver.Value{int64(17)})
+	wiped, err := WipeAllCharacters(db, WipeOptions{DryRun: true, DeleteAccounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wiped != 17 {
+		t.Errorf("Dry run counted %d characters; expected 17", wiped)
+	}
+	// Anything else would have been reported as unexpected.
+	if log := fake.Log(); len(log) != 1 {
+		t.Errorf("Dry run ran %v", log)
+	}
+}
+
+func TestWipeAllCharacters(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("DELETE FROM characters").WillAffect(17)
+	wiped, err := WipeAllCharacters(db, WipeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wiped != 17 {
+		t.Errorf("Wiped %d characters; expected 17", wiped)
+	}
+	expected := []string{"BEGIN", "DELETE FROM characters", "COMMIT"}
+	if log := fake.Log(); !reflect.DeepEqual(log, expected) {
+		t.Errorf("Wipe ran %v; expected %v", log, expected)
+	}
+}
+
+func TestWipeAllCharactersAndAccounts(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("DELETE FROM characters").WillAffect(3)
+	fake.Expect("DELETE FROM guildcard_entries").WillAffect(5)
+	fake.Expect("DELETE FROM player_options").WillAffect(2)
+	fake.Expect("DELETE FROM account_data WHERE is_banned = false").WillAffect(2)
+	if wiped, err := WipeAllCharacters(db, WipeOptions{DeleteAccounts: true}); err != nil || wiped != 3 {
+		t.Errorf("Wiped %d characters (err %v); expected 3", wiped, err)
+	}
+}
+
+func TestWipeAllCharactersRollsBack(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("DELETE FROM characters").WillAffect(3)
+	fake.Expect("DELETE FROM guildcard_entries").WillFail(errors.New("Lock wait timeout"))
+	if _, err := WipeAllCharacters(db, WipeOptions{DeleteAccounts: true}); err == nil {
+		t.Error("Wipe succeeded despite a failed statement")
+	}
+	if log := fake.Log(); log[len(log)-1] != "ROLLBACK" {
+		t.Errorf("Failed wipe wasn't rolled back: %v", log)
+	}
+}
+
+func TestAccountsWithHardwareID(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("SELECT guildcard FROM account_data WHERE lasthwinfo = ?").
+		WithArgs([]byte{0x00, 0x1F, 0xC6, 0x9A, 0x20, 0x00, 0xFE, 0x81}).
+		WillReturnRows([]string{"guildcard"}, []driver.Value{int64(42000001)}, []driver.Value{int64(42000007)})
+	guildcards, err := AccountsWithHardwareID(db, "001fc69a2000fe81")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint32{42000001, 42000007}; !reflect.DeepEqual(guildcards, expected) {
+		t.Errorf("Found accounts %v; expected %v", guildcards, expected)
+	}
+	if _, err := AccountsWithHardwareID(db, "not hex"); err == nil {
+		t.Error("Looked up an invalid hardware ID")
+	}
+}
+
+func TestAccountFirstIP(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("SELECT first_ip FROM account_data").WithArgs(int64(42000001)).
+		WillReturnRows([]string{"first_ip"}, []driver.Value{"10.0.0.5"})
+	fake.Expect("SELECT first_ip FROM account_data").WithArgs(int64(42000002)).
+		WillReturnRows([]string{"first_ip"}, []driver.Value{nil})
+
+	if ip, err := AccountFirstIP(db, 42000001); err != nil || ip != "10.0.0.5" {
+		t.Errorf("First IP is %q (err %v); expected 10.0.0.5", ip, err)
+	}
+	// Accounts that haven't logged in since addresses were recorded.
+	if ip, err := AccountFirstIP(db, 42000002); err != nil || ip != "" {
+		t.Errorf("First IP is %q (err %v); expected none", ip, err)
+	}
+}
+
+func TestBroadcastAnnouncement(t *testing.T) {
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+
+	var peers []*Client
+	for i := 0; i < 3; i++ {
+		c, peer := newTestClientPair(t)
+		c.guildcard = uint32(42000001 + i)
+		if err := sessions.Add(c, false); err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+	// Disconnected partway through; sending to it fails.
+	gone, _ := newTestClientPair(t)
+	gone.guildcard = 42000010
+	sessions.Add(gone, false)
+	gone.Close()
+
+	if sent := BroadcastAnnouncement("Restarting in 5 minutes"); sent != len(peers) {
+		t.Errorf("Announcement was sent to %d players; expected %d", sent, len(peers))
+	}
+	for _, peer := range peers {
+		if msg := expectClientMessage(t, peer); !strings.Contains(msg, "Restarting in 5 minutes") {
+			t.Errorf("Player was sent %q", msg)
+		}
+	}
+}
+
+func TestAccountTotalPlaytime(t *testing.T) {
+	db, fake := newFakeDB(t)
+	// Two characters with 1h30m and 2h15m10s played.
+	fake.Expect("SELECT COALESCE(SUM(playtime), 0) FROM characters").
+		WithArgs(int64(42000001)).
+		WillReturnRows([]string{"total"}, []driver.Value{int64(5400 + 8110)})
+	total, err := AccountTotalPlaytime(db, 42000001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 3*time.Hour + 45*time.Minute + 10*time.Second; total != expected {
+		t.Errorf("Total playtime is %v; expected %v", total, expected)
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	db, fake := newFakeDB(t)
+	columns := []string{"username", "guildcard", "is_banned", "last_login", "count"}
+	query := fake.Expect("LEFT JOIN characters c ON c.guildcard = a.guildcard").
+		WillReturnRows(columns,
+			[]driver.Value{"alice", int64(42000003), int64(0), int64(1400000000), int64(4)},
+			[]driver.Value{"mallory", int64(42000004), int64(1), nil, int64(0)})
+	accounts, err := ListAccounts(db, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limit comes before the offset in the query.
+	if args := query.Args(); !reflect.DeepEqual(args, []driver.Value{int64(10), int64(2)}) {
+		t.Errorf("Queried with %v; expected a limit of 10 and offset of 2", args)
+	}
+	expected := []AccountSummary{
+		{Username: "alice", Guildcard: 42000003, LastLogin: time.Unix(1400000000, 0), CharacterCount: 4},
+		{Username: "mallory", Guildcard: 42000004, IsBanned: true},
+	}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Errorf("Listed accounts %+v; expected %+v", accounts, expected)
+	}
+}
+
+func TestListAccountsError(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("FROM account_data a").WillFail(errors.New("connection lost"))
+	if accounts, err := ListAccounts(db, 0, 10); err == nil || accounts != nil {
+		t.Errorf("Listed %v with err %v; expected the query error", accounts, err)
+	}
+}
+
+func TestFindCharactersByName(t *testing.T) {
+	db, fake := newFakeDB(t)
+	columns := []string{"guildcard", "slot_num", "name"}
+	fake.Expect("SELECT guildcard, slot_num, name FROM characters").
+		WillReturnRows(columns,
+			[]driver.Value{int64(42000001), int64(0), storedName("\tESodaboy")},
+			[]driver.Value{int64(42000001), int64(1), storedName("\tEOther")})
+	matches, err := FindCharactersByName(db, "Sodaboy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []CharacterLocation{{42000001, 0}}; !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Found %v; expected %v", matches, expected)
+	}
+}
+
+func TestFindCharactersByNameAcrossAccounts(t *testing.T) {
+	db, fake := newFakeDB(t)
+	columns := []string{"guildcard", "slot_num", "name"}
+	// Impersonators changing the language prefix or capitalization are
+	// still caught.
+	fake.Expect("SELECT guildcard, slot_num, name FROM characters").
+		WillReturnRows(columns,
+			[]driver.Value{int64(42000001), int64(0), storedName("\tESodaboy")},
+			[]driver.Value{int64(42000002), int64(0), storedName("\tEOther")},
+			[]driver.Value{int64(42000002), int64(3), storedName("\tJSODABOY")},
+			[]driver.Value{int64(42000003), int64(2), storedName("sodaboy")})
+	matches, err := FindCharactersByName(db, "Sodaboy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CharacterLocation{{42000001, 0}, {42000002, 3}, {42000003, 2}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Found %v; expected %v", matches, expected)
+	}
+}
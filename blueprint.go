@@ -0,0 +1,132 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Character blueprints; a compact text form of a character's build that
+* players can share. Only the class, level, stats, and equipped items are
+* included so that a blueprint can't be used to import a whole inventory.
+* Blueprints aren't signed; anyone can write one, so imported characters
+* are trusted only as far as they pass validation.
+ */
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/dcrodman/archon/util"
+	"hash/crc32"
+)
+
+const (
+	blueprintVersion = 1
+	// Weapon, frame, barrier, mag, and up to four units.
+	blueprintMaxEquipped = 8
+)
+
+type blueprint struct {
+	Version   uint8
+	Class     uint8
+	SectionId uint8
+	Padding   uint8
+	Level     uint32
+	Stats     CharacterStats
+	Equipped  [blueprintMaxEquipped]Item
+	// CRC32 of the preceding fields. This only catches blueprints that were
+	// damaged while being copied around; it's trivial to recompute after
+	// editing one, so it's no protection against tampering.
+	Checksum uint32
+}
+
+// Returns the character's blueprint as a base64 string.
+func (fc *FullCharacter) ExportBlueprint() (string, error) {
+	bp := &blueprint{
+		Version:   blueprintVersion,
+		Class:     fc.Character.Class,
+		SectionId: fc.Character.SectionId,
+		Level:     fc.Character.Level,
+		Stats:     fc.Character.Stats,
+	}
+	numItems := int(fc.Inventory.NumItems)
+	if numItems > len(fc.Inventory.Items) {
+		numItems = len(fc.Inventory.Items)
+	}
+	numEquipped := 0
+	for _, invItem := range fc.Inventory.Items[:numItems] {
+		if invItem.Flags&itemEquipped == 0 {
+			continue
+		}
+		if numEquipped == blueprintMaxEquipped {
+			return "", errors.New("Character has too many equipped items")
+		}
+		bp.Equipped[numEquipped] = invItem.Item
+		numEquipped++
+	}
+
+	data, size := util.BytesFromStruct(bp)
+	bp.Checksum = crc32.ChecksumIEEE(data[:size-4])
+	data, _ = util.BytesFromStruct(bp)
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// Builds a character from a blueprint created by ExportBlueprint. The
+// result is validated the same way a saved character would be, which is
+// what keeps edited blueprints from producing illegal characters.
+func ImportBlueprint(s string) (*FullCharacter, error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.Size(blueprint{})
+	if len(data) != size {
+		return nil, errors.New("Invalid blueprint length")
+	}
+	bp := new(blueprint)
+	if err = util.StructFromBytes(data, bp); err != nil {
+		return nil, err
+	} else if bp.Checksum != crc32.ChecksumIEEE(data[:size-4]) {
+		return nil, errors.New("Blueprint is corrupt")
+	} else if bp.Version != blueprintVersion {
+		return nil, errors.New("Unsupported blueprint version")
+	}
+
+	fc := new(FullCharacter)
+	fc.Character.Class = bp.Class
+	fc.Character.SectionId = bp.SectionId
+	fc.Character.Level = bp.Level
+	fc.Character.Stats = bp.Stats
+	fc.Class = bp.Class
+	fc.SectionId = bp.SectionId
+	// Blueprints don't include techniques.
+	fc.Character.clearTechniques()
+
+	var empty Item
+	for _, item := range bp.Equipped {
+		if item == empty {
+			continue
+		}
+		invItem := &fc.Inventory.Items[fc.Inventory.NumItems]
+		invItem.InUse = 1
+		invItem.Flags = itemEquipped
+		invItem.Item = item
+		fc.Inventory.NumItems++
+	}
+
+	if err = fc.Validate(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
@@ -0,0 +1,85 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/base64"
+	"github.com/dcrodman/archon/util"
+	"hash/crc32"
+	"testing"
+)
+
+func exportTestBlueprint(t *testing.T, fc *FullCharacter) []byte {
+	t.Helper()
+	s, err := fc.ExportBlueprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlueprintRoundTrip(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Ramarl), WithItems())
+	s, err := fc.ExportBlueprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportBlueprint(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Character.Class != fc.Character.Class || imported.Character.Stats != fc.Character.Stats {
+		t.Errorf("Imported %+v; expected %+v", imported.Character, fc.Character)
+	}
+	if imported.Inventory.NumItems != 4 {
+		t.Errorf("Imported %d equipped items; expected 4", imported.Inventory.NumItems)
+	}
+}
+
+func TestImportBlueprintRejectsCorrupt(t *testing.T) {
+	data := exportTestBlueprint(t, NewTestCharacter(t, WithItems()))
+	data[8] ^= 0x01
+	if _, err := ImportBlueprint(base64.URLEncoding.EncodeToString(data)); err == nil {
+		t.Error("Imported a corrupt blueprint")
+	}
+	if _, err := ImportBlueprint(base64.URLEncoding.EncodeToString(data[:len(data)-1])); err == nil {
+		t.Error("Imported a truncated blueprint")
+	}
+}
+
+// The checksum is easy to recompute, so edited blueprints have to be caught
+// by validating the character they produce.
+func TestImportBlueprintRejectsForged(t *testing.T) {
+	useLevelTable(t)
+	var bp blueprint
+	data := exportTestBlueprint(t, NewTestCharacter(t))
+	if err := util.StructFromBytes(data, &bp); err != nil {
+		t.Fatal(err)
+	}
+	bp.Stats.ATP = 9999
+	data, size := util.BytesFromStruct(&bp)
+	bp.Checksum = crc32.ChecksumIEEE(data[:size-4])
+	data, _ = util.BytesFromStruct(&bp)
+	if _, err := ImportBlueprint(base64.URLEncoding.EncodeToString(data)); err == nil {
+		t.Error("Imported a blueprint with forged stats and a valid checksum")
+	}
+}
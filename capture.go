@@ -0,0 +1,123 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Packet captures for debugging. Each record is the direction (1 byte),
+* the time in Unix nanoseconds (8 bytes), the packet length (4 bytes),
+* and the unencrypted packet, with all integers little-endian.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type CaptureDirection uint8
+
+const (
+	CaptureReceived CaptureDirection = 0x00
+	CaptureSent                      = 0x01
+)
+
+type captureHeader struct {
+	Direction CaptureDirection
+	Time      int64
+	Length    uint32
+}
+
+// A single packet read back from a capture.
+type CapturedPacket struct {
+	Direction CaptureDirection
+	Time      time.Time
+	Data      []byte
+}
+
+// Writes the packets sent to and received from a client to w.
+type PacketCapture struct {
+	w io.WriteCloser
+	sync.Mutex
+}
+
+func NewPacketCapture(w io.WriteCloser) *PacketCapture {
+	return &PacketCapture{w: w}
+}
+
+// Create a capture file in dir for a client connected from ipAddr:port.
+func openCaptureFile(dir, ipAddr, port string) (*PacketCapture, error) {
+	name := fmt.Sprintf("%s-%s-%d.cap", ipAddr, port, timeNow().UnixNano())
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketCapture(f), nil
+}
+
+// Append a packet to the capture.
+func (pc *PacketCapture) Record(dir CaptureDirection, data []byte) error {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.w == nil {
+		return errors.New("Capture is closed")
+	}
+	hdr := captureHeader{Direction: dir, Time: timeNow().UnixNano(), Length: uint32(len(data))}
+	if err := binary.Write(pc.w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	_, err := pc.w.Write(data)
+	return err
+}
+
+// Close the underlying writer. Later calls to Record fail.
+func (pc *PacketCapture) Close() error {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.w == nil {
+		return nil
+	}
+	err := pc.w.Close()
+	pc.w = nil
+	return err
+}
+
+// Read every packet from a capture written by PacketCapture.
+func ReadCapture(r io.Reader) ([]CapturedPacket, error) {
+	var packets []CapturedPacket
+	for {
+		var hdr captureHeader
+		err := binary.Read(r, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return packets, err
+		}
+		pkt := CapturedPacket{
+			Direction: hdr.Direction,
+			Time:      time.Unix(0, hdr.Time),
+			Data:      make([]byte, hdr.Length),
+		}
+		if _, err = io.ReadFull(r, pkt.Data); err != nil {
+			return packets, err
+		}
+		packets = append(packets, pkt)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A bytes.Buffer that can be handed to a PacketCapture.
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *captureBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPacketCapture(t *testing.T) {
+	now := time.Unix(1400000000, 5)
+	oldNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = oldNow })
+
+	var buf captureBuffer
+	capture := NewPacketCapture(&buf)
+	expected := []CapturedPacket{
+		{Direction: CaptureReceived, Time: now, Data: []byte{0x08, 0x00, 0x93, 0x00, 1, 2, 3, 4}},
+		{Direction: CaptureSent, Time: now, Data: []byte{0x04, 0x00, 0xE6, 0x00}},
+		{Direction: CaptureSent, Time: now, Data: []byte{}},
+	}
+	for _, pkt := range expected {
+		if err := capture.Record(pkt.Direction, pkt.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := capture.Close(); err != nil || !buf.closed {
+		t.Fatalf("Closing the capture returned %v", err)
+	}
+	if err := capture.Record(CaptureSent, []byte{1}); err == nil {
+		t.Error("Recorded a packet after the capture was closed")
+	}
+
+	packets, err := ReadCapture(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(packets, expected) {
+		t.Errorf("Read back %+v; expected %+v", packets, expected)
+	}
+
+	// A capture cut off partway through a packet.
+	if _, err := ReadCapture(bytes.NewReader(buf.Bytes()[:buf.Len()-2])); err == nil {
+		t.Error("Read a truncated capture")
+	}
+}
+
+func TestClientCapture(t *testing.T) {
+	dir := t.TempDir()
+	useConfig(t, func(c *Config) {
+		c.DebugMode = true
+		c.CaptureDir = dir
+	})
+	c, peer := newTestClientPair(t)
+	if c.SendTimestamp() != 0 {
+		t.Fatal("Failed to send timestamp")
+	}
+	sent := expectPacket(t, peer, LoginTimestampType)
+	deliverPacket(t, c, peer, &BBHeader{Type: LoginCharPreviewReqType})
+	received := c.Data()[:c.packetSize]
+	c.Close()
+
+	// Both ends of the pair capture; find the file for c.
+	files, err := filepath.Glob(filepath.Join(dir, "*-"+c.port+"-*.cap"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Found capture files %v (err %v)", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	packets, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Captured %d packets; expected 2", len(packets))
+	}
+	if packets[0].Direction != CaptureSent || !bytes.Equal(packets[0].Data, sent) {
+		t.Errorf("Captured % x sent; expected % x", packets[0].Data, sent)
+	}
+	if packets[1].Direction != CaptureReceived || !bytes.Equal(packets[1].Data, received) {
+		t.Errorf("Captured % x received; expected % x", packets[1].Data, received)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Challenge mode progress stored in FullCharacter.ChallengeData.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+type Episode uint8
+
+const (
+	Episode1 Episode = 0x01
+	Episode2         = 0x02
+	Episode4         = 0x04
+)
+
+// Title awarded for clearing a challenge mode stage, numbered from 0 in
+// stage order.
+type ChallengeTitle uint8
+
+// Number of challenge stages (and so titles) in each episode that has a
+// challenge mode.
+var challengeTitleCounts = map[Episode]int{
+	Episode1: 9,
+	Episode2: 5,
+}
+
+// Offset into ChallengeData of the 16-bit field holding each episode's
+// earned titles, one bit per title.
+var challengeTitleOffsets = map[Episode]int{
+	Episode1: 0,
+	Episode2: 2,
+}
+
+// Award the character title for episode ep.
+func (fc *FullCharacter) GrantChallengeTitle(ep Episode, title ChallengeTitle) error {
+	if !config.FeatureEnabled(FeatureChallengeMode) {
+		return errors.New("Challenge mode is disabled")
+	}
+	count, ok := challengeTitleCounts[ep]
+	if !ok {
+		return fmt.Errorf("Episode %d has no challenge mode", ep)
+	} else if int(title) >= count {
+		return fmt.Errorf("Invalid challenge title %d for episode %d", title, ep)
+	}
+	field := fc.ChallengeData[challengeTitleOffsets[ep]:]
+	titles := binary.LittleEndian.Uint16(field)
+	binary.LittleEndian.PutUint16(field, titles|1<<title)
+	return nil
+}
+
+// Returns true if the character has earned title in episode ep.
+func (fc *FullCharacter) HasChallengeTitle(ep Episode, title ChallengeTitle) bool {
+	if count, ok := challengeTitleCounts[ep]; !ok || int(title) >= count {
+		return false
+	}
+	titles := binary.LittleEndian.Uint16(fc.ChallengeData[challengeTitleOffsets[ep]:])
+	return titles&(1<<title) != 0
+}
@@ -0,0 +1,62 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import "testing"
+
+func TestGrantChallengeTitle(t *testing.T) {
+	useConfig(t, func(c *Config) {})
+	fc := NewTestCharacter(t)
+	if err := fc.GrantChallengeTitle(Episode1, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := fc.GrantChallengeTitle(Episode2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.HasChallengeTitle(Episode1, 8) || !fc.HasChallengeTitle(Episode2, 0) {
+		t.Error("Granted titles weren't recorded")
+	}
+	// Each episode's titles are tracked separately.
+	if fc.HasChallengeTitle(Episode1, 0) || fc.HasChallengeTitle(Episode2, 8) {
+		t.Error("Title was recorded for the wrong episode")
+	}
+
+	invalid := []struct {
+		ep    Episode
+		title ChallengeTitle
+	}{
+		{Episode1, 9},
+		{Episode2, 5},
+		{Episode4, 0},
+	}
+	for _, test := range invalid {
+		if err := fc.GrantChallengeTitle(test.ep, test.title); err == nil {
+			t.Errorf("Granted title %d for episode %d", test.title, test.ep)
+		}
+	}
+}
+
+func TestGrantChallengeTitleDisabled(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.Features = map[string]bool{FeatureChallengeMode: false}
+	})
+	fc := NewTestCharacter(t)
+	if err := fc.GrantChallengeTitle(Episode1, 0); err == nil {
+		t.Error("Granted a title with challenge mode disabled")
+	}
+}
@@ -19,6 +19,20 @@
 // Constants and structs associated with character data.
 package main
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dcrodman/archon/util"
+	"hash/crc32"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
 // Possible character classes as defined by the game.
 type CharClass uint8
 
@@ -37,6 +51,81 @@ const (
 	Ramarl              = 0x0B
 )
 
+var charClassNames = [...]string{
+	"HUmar", "HUnewearl", "HUcast", "RAmar", "RAcast", "RAcaseal",
+	"FOmarl", "FOnewm", "FOnewearl", "HUcaseal", "FOmar", "RAmarl",
+}
+
+func (c CharClass) String() string {
+	if int(c) >= len(charClassNames) {
+		return "Unknown"
+	}
+	return charClassNames[c]
+}
+
+// Section IDs as defined by the game.
+type SectionID uint8
+
+const (
+	Viridia    SectionID = 0x00
+	Greenill             = 0x01
+	Skyly                = 0x02
+	Bluefull             = 0x03
+	Purplenum            = 0x04
+	Pinkal               = 0x05
+	Redria               = 0x06
+	Oran                 = 0x07
+	Yellowboze           = 0x08
+	Whitill              = 0x09
+)
+
+var sectionIDNames = [...]string{
+	"Viridia", "Greenill", "Skyly", "Bluefull", "Purplenum",
+	"Pinkal", "Redria", "Oran", "Yellowboze", "Whitill",
+}
+
+func (s SectionID) String() string {
+	if int(s) >= len(sectionIDNames) {
+		return "Unknown"
+	}
+	return sectionIDNames[s]
+}
+
+// Languages the client can run in, as stored in Inventory.Language and
+// GuildcardEntry.Language.
+type Language uint8
+
+const (
+	LanguageJapanese           Language = 0x00
+	LanguageEnglish                     = 0x01
+	LanguageGerman                      = 0x02
+	LanguageFrench                      = 0x03
+	LanguageSpanish                     = 0x04
+	LanguageChineseSimplified           = 0x05
+	LanguageChineseTraditional          = 0x06
+	LanguageKorean                      = 0x07
+)
+
+var languageNames = [...]string{
+	"Japanese", "English", "German", "French", "Spanish",
+	"Chinese (Simplified)", "Chinese (Traditional)", "Korean",
+}
+
+// Convert a language code sent by the client, treating unknown codes as English.
+func ParseLanguage(code uint8) Language {
+	if int(code) >= len(languageNames) {
+		return LanguageEnglish
+	}
+	return Language(code)
+}
+
+func (l Language) String() string {
+	if int(l) >= len(languageNames) {
+		return "Unknown"
+	}
+	return languageNames[l]
+}
+
 // Per-player friend guildcard entries.
 type GuildcardEntry struct {
 	Guildcard   uint32
@@ -51,6 +140,77 @@ type GuildcardEntry struct {
 	Comment     [88]uint16
 }
 
+// Set the description shown on the guildcard.
+func (g *GuildcardEntry) SetDescription(desc string) error {
+	return setTextField(g.Description[:], desc)
+}
+
+// Returns the description shown on the guildcard.
+func (g *GuildcardEntry) GetDescription() string {
+	return util.ConvertFromUtf16(g.Description[:])
+}
+
+// Set the comment the owner of the guildcard list has written about the
+// player.
+func (g *GuildcardEntry) SetComment(comment string) error {
+	return setTextField(g.Comment[:], comment)
+}
+
+// Returns the comment the owner of the guildcard list has written.
+func (g *GuildcardEntry) GetComment() string {
+	return util.ConvertFromUtf16(g.Comment[:])
+}
+
+// Returns a guildcard entry for fc, as added to another player's list when
+// they exchange cards. The description and comment start out empty.
+func NewGuildcardEntry(fc *FullCharacter) *GuildcardEntry {
+	return &GuildcardEntry{
+		Guildcard: fc.Guildcard,
+		Name:      fc.Name,
+		TeamName:  fc.TeamName,
+		Language:  fc.Inventory.Language,
+		SectionID: fc.Character.SectionId,
+		CharClass: fc.Character.Class,
+	}
+}
+
+// Checks that the entry's class and section ID are ones the client can
+// display. An unknown language is replaced with English rather than
+// rejected since the client copes with either.
+func (g *GuildcardEntry) Validate() error {
+	g.Language = uint8(ParseLanguage(g.Language))
+	if g.CharClass >= NumCharClasses {
+		return fmt.Errorf("Invalid class %d in guildcard entry %d", g.CharClass, g.Guildcard)
+	} else if g.SectionID > Whitill {
+		return fmt.Errorf("Invalid section ID %d in guildcard entry %d", g.SectionID, g.Guildcard)
+	}
+	return nil
+}
+
+// Where a player is on the server, as reported by a guildcard search.
+type PlayerLocation struct {
+	ShipName string
+	Block    uint32
+	Lobby    uint32
+}
+
+// Build the reply to a guildcard search that found the player with this
+// guildcard at location. The searcher's guildcard is left for the caller
+// to fill in.
+func (g *GuildcardEntry) SearchReply(location PlayerLocation) []byte {
+	pkt := &GuildcardSearchReplyPacket{
+		Header:    BBHeader{Type: GuildcardSearchReplyType},
+		PlayerTag: 0x00010000,
+		TargetGc:  g.Guildcard,
+		LobbyId:   location.Lobby,
+	}
+	desc := fmt.Sprintf("LOBBY%02d,BLOCK%02d,%s", location.Lobby, location.Block, location.ShipName)
+	copy(pkt.Location[:len(pkt.Location)-1], utf16.Encode([]rune(desc)))
+	copy(pkt.Name[:], g.Name[:])
+	data, _ := util.BytesFromStruct(pkt)
+	return PadPacket(data)
+}
+
 // Per-player guildcard data chunk.
 type GuildcardData struct {
 	Unknown  [0x114]uint8
@@ -89,6 +249,71 @@ type CharacterPreview struct {
 	Playtime       uint32
 }
 
+// Returns the serialized CharacterPreview for a slot with no character in
+// it, which is what IsEmptyCharacter checks for.
+func EmptyCharacterSlot() []byte {
+	return make([]byte, binary.Size(CharacterPreview{}))
+}
+
+// Returns true if data is a serialized CharacterPreview for a slot that has
+// no character in it. Data that is the wrong size is treated as corrupt
+// rather than empty.
+func IsEmptyCharacter(data []byte) bool {
+	if len(data) != binary.Size(CharacterPreview{}) {
+		return false
+	}
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the character's name as a player would see it.
+func (prev *CharacterPreview) DisplayName() string {
+	return displayName(util.CompressUtf16(prev.Name[:]))
+}
+
+// Upper bound on each of the hair color components. The client stores
+// them as 16-bit values but only renders the lower byte correctly.
+const maxHairColor = 0xFF
+
+// Clamp the appearance colors into the ranges the client can render so
+// that a malformed creation packet can't produce broken characters.
+func (prev *CharacterPreview) NormalizeColors() {
+	if prev.HairRed > maxHairColor {
+		prev.HairRed = maxHairColor
+	}
+	if prev.HairGreen > maxHairColor {
+		prev.HairGreen = maxHairColor
+	}
+	if prev.HairBlue > maxHairColor {
+		prev.HairBlue = maxHairColor
+	}
+	// The name color is ARGB; anything less than fully opaque will render
+	// the name (partially) invisible to other players.
+	prev.NameColor |= 0xFF000000
+}
+
+// Returns the checksum the client expects alongside a name color, which is
+// the color packed down to 15-bit RGB.
+func NameColorChecksum(color uint32) uint32 {
+	r, g, b := (color>>16)&0xFF, (color>>8)&0xFF, color&0xFF
+	return (r>>3)<<10 | (g>>3)<<5 | b>>3
+}
+
+// Checks that the body proportions are within the range the client's
+// sliders produce, since out of range (or NaN) values distort the model.
+func (prev *CharacterPreview) ValidateAppearance() error {
+	for _, prop := range []float32{prev.PropX, prev.PropY} {
+		if !(prop >= 0 && prop <= 1) {
+			return fmt.Errorf("Invalid body proportion %v", prop)
+		}
+	}
+	return nil
+}
+
 // Per-character stats.
 type CharacterStats struct {
 	ATP uint16
@@ -100,6 +325,996 @@ type CharacterStats struct {
 	LCK uint16
 }
 
+// Item data as it's stored in inventories and banks.
+type Item struct {
+	Data   [12]uint8
+	ItemId uint32
+	Data2  [4]uint8
+}
+
+// Item categories, stored in the first byte of an item's data.
+type ItemType uint8
+
+const (
+	ItemTypeWeapon ItemType = 0x00
+	ItemTypeArmor           = 0x01
+	ItemTypeMag             = 0x02
+	ItemTypeTool            = 0x03
+	ItemTypeMeseta          = 0x04
+)
+
+// Kinds of armor, stored in the second byte of an armor item's data.
+const (
+	ArmorTypeFrame   = 0x01
+	ArmorTypeBarrier = 0x02
+	ArmorTypeUnit    = 0x03
+)
+
+// Set in InventoryItem.Flags for items the character has equipped.
+const itemEquipped = 0x08
+
+// Number of units that can be equipped at the same time.
+const maxEquippedUnits = 4
+
+func (it *Item) Type() ItemType { return ItemType(it.Data[0]) }
+
+// Checks that the item is of a type a character can hold.
+func (it *Item) Validate() error {
+	switch it.Type() {
+	case ItemTypeWeapon, ItemTypeMag, ItemTypeTool:
+		return nil
+	case ItemTypeArmor:
+		switch it.Data[1] {
+		case ArmorTypeFrame, ArmorTypeBarrier, ArmorTypeUnit:
+			return nil
+		}
+		return fmt.Errorf("Unknown armor type %d", it.Data[1])
+	}
+	return fmt.Errorf("Invalid item type %d", it.Data[0])
+}
+
+// Entry in a character's inventory.
+type InventoryItem struct {
+	InUse   uint16
+	Unknown uint16
+	Flags   uint32
+	Item    Item
+}
+
+// Items carried by a character.
+type Inventory struct {
+	NumItems    uint8
+	HPMaterials uint8
+	TPMaterials uint8
+	Language    uint8
+	Items       [30]InventoryItem
+}
+
+// Recompute NumItems from the slots that are in use, moving the items up
+// to fill any gaps since the client only looks at the first NumItems slots.
+func (inv *Inventory) RecountItems() {
+	n := 0
+	for i := range inv.Items {
+		if inv.Items[i].InUse == 0 {
+			continue
+		}
+		if i != n {
+			inv.Items[n] = inv.Items[i]
+			inv.Items[i] = InventoryItem{}
+		}
+		n++
+	}
+	inv.NumItems = uint8(n)
+}
+
+// Checks that the equipped items are in populated slots and that no more
+// than one item of each kind (or four units) is equipped.
+func (inv *Inventory) ValidateEquipped() error {
+	var weapons, frames, barriers, mags, units int
+	for i := range inv.Items {
+		invItem := &inv.Items[i]
+		if invItem.Flags&itemEquipped == 0 {
+			continue
+		}
+		if i >= int(inv.NumItems) || invItem.InUse == 0 {
+			return fmt.Errorf("Item equipped in empty inventory slot %d", i)
+		}
+		switch item := &invItem.Item; item.Type() {
+		case ItemTypeWeapon:
+			weapons++
+		case ItemTypeArmor:
+			switch item.Data[1] {
+			case ArmorTypeFrame:
+				frames++
+			case ArmorTypeBarrier:
+				barriers++
+			case ArmorTypeUnit:
+				units++
+			default:
+				return fmt.Errorf("Unknown armor type %d equipped in slot %d", item.Data[1], i)
+			}
+		case ItemTypeMag:
+			mags++
+		default:
+			return fmt.Errorf("Item in slot %d can't be equipped", i)
+		}
+	}
+	if weapons > 1 || frames > 1 || barriers > 1 || mags > 1 || units > maxEquippedUnits {
+		return errors.New("Too many items of the same kind equipped")
+	}
+	return nil
+}
+
+// Weapon attribute names, indexed by the attribute id stored in the weapon's data.
+var weaponAttributeNames = [...]string{"", "Native", "A.Beast", "Machine", "Dark", "Hit"}
+
+// Limits on weapon attribute percentages. No weapon the game can produce
+// has an attribute outside of +/-100% or attributes totalling over 200%.
+const (
+	maxWeaponPercentage      = 100
+	maxWeaponPercentageTotal = 200
+)
+
+// Returns true if the item is a weapon with attribute percentages that
+// the game can't produce: unknown or repeated attributes, values out of
+// range, or a total over the limit.
+func (it *Item) HasIllegalPercentages() bool {
+	if it.Type() != ItemTypeWeapon {
+		return false
+	}
+	var seen [len(weaponAttributeNames)]bool
+	total := 0
+	for i := 6; i < 12; i += 2 {
+		attr, value := it.Data[i], int(int8(it.Data[i+1]))
+		if attr == 0 {
+			continue
+		} else if int(attr) >= len(weaponAttributeNames) || seen[attr] {
+			return true
+		} else if value > maxWeaponPercentage || value < -maxWeaponPercentage {
+			return true
+		}
+		seen[attr] = true
+		total += value
+	}
+	return total > maxWeaponPercentageTotal
+}
+
+// Returns a human readable description of the item, e.g.
+// "Weapon 01:02 +5 special 3 [Native 10%, Hit 20%]".
+func (it *Item) Describe() string {
+	d := &it.Data
+	switch it.Type() {
+	case ItemTypeWeapon:
+		desc := fmt.Sprintf("Weapon %02X:%02X +%d", d[1], d[2], d[3])
+		if d[4] != 0 {
+			desc += fmt.Sprintf(" special %d", d[4]&0x3F)
+		}
+		var attrs []string
+		for i := 6; i < 12; i += 2 {
+			if attr := d[i]; attr != 0 && int(attr) < len(weaponAttributeNames) {
+				attrs = append(attrs, fmt.Sprintf("%s %d%%", weaponAttributeNames[attr], int8(d[i+1])))
+			}
+		}
+		if len(attrs) > 0 {
+			desc += " [" + strings.Join(attrs, ", ") + "]"
+		}
+		return desc
+	case ItemTypeArmor:
+		switch d[1] {
+		case ArmorTypeFrame:
+			return fmt.Sprintf("Frame %02X (%d slots)", d[2], d[5])
+		case ArmorTypeBarrier:
+			return fmt.Sprintf("Barrier %02X", d[2])
+		case ArmorTypeUnit:
+			return fmt.Sprintf("Unit %02X", d[2])
+		}
+	case ItemTypeMag:
+		// Stats are stored multiplied by 100.
+		stat := func(i int) int { return int(binary.LittleEndian.Uint16(d[i:])) / 100 }
+		return fmt.Sprintf("Mag %02X Lv. %d (DEF %d, POW %d, DEX %d, MIND %d)",
+			d[1], d[2], stat(4), stat(6), stat(8), stat(10))
+	case ItemTypeTool:
+		return fmt.Sprintf("Tool %02X:%02X x%d", d[1], d[2], d[5])
+	}
+	return fmt.Sprintf("Unknown item % X", d[:])
+}
+
+// Returns a description of each item in the inventory, in slot order.
+// Equipped items are marked with "(E)".
+func (inv *Inventory) Describe() []string {
+	var descs []string
+	for i := 0; i < int(inv.NumItems) && i < len(inv.Items); i++ {
+		invItem := &inv.Items[i]
+		desc := invItem.Item.Describe()
+		if invItem.Flags&itemEquipped != 0 {
+			desc = "(E) " + desc
+		}
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// Entry in a character's bank.
+type BankItem struct {
+	Item   Item
+	Amount uint16
+	Flags  uint16
+}
+
+// Items and meseta stored in a character's bank.
+type Bank struct {
+	NumItems uint32
+	Meseta   uint32
+	Items    [200]BankItem
+}
+
+// Most of a stackable tool that can be held in a single slot.
+const maxToolStack = 10
+
+// Move the populated slots up to fill any gaps, set NumItems to the number
+// of them, and clamp the meseta to MaxMeseta so that a corrupt count can't
+// make the client read past the end of the items.
+func (b *Bank) Repair() {
+	n := 0
+	for i := range b.Items {
+		if b.Items[i] == (BankItem{}) {
+			continue
+		}
+		if i != n {
+			b.Items[n] = b.Items[i]
+			b.Items[i] = BankItem{}
+		}
+		n++
+	}
+	b.NumItems = uint32(n)
+	if b.Meseta > MaxMeseta {
+		b.Meseta = MaxMeseta
+	}
+}
+
+// Checks that the bank's item count matches its populated slots, that each
+// item's amount is possible for its type, and that the meseta is under the cap.
+func (b *Bank) Validate() error {
+	if b.NumItems > uint32(len(b.Items)) {
+		return fmt.Errorf("Invalid bank item count %d", b.NumItems)
+	} else if b.Meseta > MaxMeseta {
+		return fmt.Errorf("Invalid bank meseta %d", b.Meseta)
+	}
+	for i := range b.Items {
+		bankItem := &b.Items[i]
+		if uint32(i) >= b.NumItems {
+			if *bankItem != (BankItem{}) {
+				return fmt.Errorf("Bank slot %d is populated past the item count", i)
+			}
+			continue
+		}
+		var maxAmount uint16
+		switch bankItem.Item.Type() {
+		case ItemTypeWeapon, ItemTypeArmor, ItemTypeMag:
+			maxAmount = 1
+		case ItemTypeTool:
+			maxAmount = maxToolStack
+		default:
+			return fmt.Errorf("Item in bank slot %d can't be stored", i)
+		}
+		if bankItem.Amount == 0 || bankItem.Amount > maxAmount {
+			return fmt.Errorf("Invalid amount %d in bank slot %d", bankItem.Amount, i)
+		}
+	}
+	return nil
+}
+
+// Stats, appearance, and progress of a character. Most of the fields after
+// Meseta are the same as those sent in the CharacterPreview.
+type Character struct {
+	Stats          CharacterStats
+	Unknown        uint16
+	Unknown2       [2]uint32
+	Level          uint32
+	Experience     uint32
+	Meseta         uint32
+	GuildcardStr   [16]byte
+	Unknown3       [2]uint32
+	NameColor      uint32
+	Model          byte
+	Padding        [15]byte
+	NameColorChksm uint32
+	SectionId      byte
+	Class          byte
+	V2flags        byte
+	Version        byte
+	V1Flags        uint32
+	Costume        uint16
+	Skin           uint16
+	Face           uint16
+	Head           uint16
+	Hair           uint16
+	HairRed        uint16
+	HairGreen      uint16
+	HairBlue       uint16
+	PropX          float32
+	PropY          float32
+	Name           [16]uint16
+	Playtime       uint32
+	Techniques     [20]uint8
+	Config         [232]uint8
+}
+
+// Techniques, in the order they're stored in Character.Techniques.
+type Technique uint8
+
+const (
+	Foie     Technique = 0x00
+	Gifoie             = 0x01
+	Rafoie             = 0x02
+	Barta              = 0x03
+	Gibarta            = 0x04
+	Rabarta            = 0x05
+	Zonde              = 0x06
+	Gizonde            = 0x07
+	Razonde            = 0x08
+	Grants             = 0x09
+	Deband             = 0x0A
+	Jellen             = 0x0B
+	Zalure             = 0x0C
+	Shifta             = 0x0D
+	Ryuker             = 0x0E
+	Resta              = 0x0F
+	Anti               = 0x10
+	Reverser           = 0x11
+	Megid              = 0x12
+)
+
+var techniqueNames = [...]string{
+	"Foie", "Gifoie", "Rafoie", "Barta", "Gibarta", "Rabarta", "Zonde",
+	"Gizonde", "Razonde", "Grants", "Deband", "Jellen", "Zalure", "Shifta",
+	"Ryuker", "Resta", "Anti", "Reverser", "Megid",
+}
+
+func (t Technique) String() string {
+	if int(t) >= len(techniqueNames) {
+		return "Unknown"
+	}
+	return techniqueNames[t]
+}
+
+// Value in Character.Techniques for a technique that hasn't been learned.
+const techNotLearned = 0xFF
+
+// A technique and the level it's been learned at. Like Character.Level,
+// the level is zero-indexed.
+type TechLevelInfo struct {
+	Technique Technique
+	Level     uint8
+}
+
+// Returns the techniques the character has learned, in technique order.
+func (c *Character) LearnedTechniques() []TechLevelInfo {
+	var techs []TechLevelInfo
+	for i := 0; i < len(techniqueNames); i++ {
+		if level := c.Techniques[i]; level != techNotLearned {
+			techs = append(techs, TechLevelInfo{Technique(i), level})
+		}
+	}
+	return techs
+}
+
+// Mark every technique as not learned, as for a new character.
+func (c *Character) clearTechniques() {
+	for i := range c.Techniques {
+		c.Techniques[i] = techNotLearned
+	}
+}
+
+// Highest technique level (one-indexed) each class can learn; androids
+// can't learn any.
+var maxTechLevels = [NumCharClasses]uint8{
+	Humar: 15, Hunewearl: 20, Hucast: 0, Ramar: 15, Racast: 0, Racaseal: 0,
+	Fomarl: 30, Fonewm: 30, Fonewearl: 30, Hucaseal: 0, Fomar: 30, Ramarl: 20,
+}
+
+// Highest level of Anti any class can learn.
+const maxAntiLevel = 7
+
+// Returns true if class is one of the forces, the only classes that can
+// learn Grants and Megid.
+func isForce(class CharClass) bool {
+	switch class {
+	case Fomarl, Fonewm, Fonewearl, Fomar:
+		return true
+	}
+	return false
+}
+
+// Checks that each technique the character has learned can be learned by
+// its class, at no more than the class's maximum level. Ryuker and Reverser
+// only have a single level and Anti stops at level 7.
+func (fc *FullCharacter) ValidateTechniques() error {
+	class := CharClass(fc.Character.Class)
+	if class >= NumCharClasses {
+		return fmt.Errorf("Invalid class %d", class)
+	}
+	for _, tech := range fc.Character.LearnedTechniques() {
+		maxLevel := maxTechLevels[class]
+		switch tech.Technique {
+		case Grants, Megid:
+			if !isForce(class) {
+				maxLevel = 0
+			}
+		case Ryuker, Reverser:
+			if maxLevel > 1 {
+				maxLevel = 1
+			}
+		case Anti:
+			if maxLevel > maxAntiLevel {
+				maxLevel = maxAntiLevel
+			}
+		}
+		if tech.Level >= maxLevel {
+			return fmt.Errorf("%s can't learn %s level %d", class, tech.Technique, tech.Level+1)
+		}
+	}
+	return nil
+}
+
+// Complete set of data for a character, laid out the same way as the
+// payload of the E7 packet so that it can be sent to the client as-is.
+type FullCharacter struct {
+	Inventory     Inventory
+	Character     Character
+	Unknown       [16]uint8
+	Options       uint32
+	QuestData1    [520]uint8
+	Bank          Bank
+	Guildcard     uint32
+	Name          [24]uint16
+	TeamName      [16]uint16
+	GuildcardDesc [88]uint16
+	Reserved      uint8
+	Reserved2     uint8
+	SectionId     uint8
+	Class         uint8
+	Unknown2      uint32
+	SymbolChats   [1248]uint8
+	Shortcuts     [2624]uint8
+	AutoReply     [172]uint16
+	InfoBoard     [172]uint16
+	Unknown3      [28]uint8
+	ChallengeData [320]uint8
+	TechMenu      [40]uint8
+	Unknown4      [44]uint8
+	QuestData2    [88]uint8
+	KeyConfig     KeyTeamConfig
+}
+
+// Returned when stored character data doesn't match its checksum.
+var ErrCorruptCharacter = errors.New("Character data is corrupt")
+
+// Returns the CRC32 of the character's serialized data.
+func (fc *FullCharacter) Checksum() uint32 {
+	data, _ := util.BytesFromStruct(fc)
+	return crc32.ChecksumIEEE(data)
+}
+
+// Deserialize a character that was stored along with its checksum, returning
+// ErrCorruptCharacter if the data is the wrong size or doesn't match.
+func VerifyStoredCharacter(blob []byte, storedChecksum uint32) (*FullCharacter, error) {
+	fc := new(FullCharacter)
+	if len(blob) != binary.Size(fc) || crc32.ChecksumIEEE(blob) != storedChecksum {
+		return nil, ErrCorruptCharacter
+	}
+	if err := binary.Read(bytes.NewReader(blob), binary.LittleEndian, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Offsets of Character.Level and Character.Meseta in a serialized
+// FullCharacter, which are used to guess the byte order of imported data.
+var (
+	importLevelOffset  = binary.Size(Inventory{}) + binary.Size(CharacterStats{}) + 10
+	importMesetaOffset = importLevelOffset + 8
+)
+
+// Guess the byte order of a serialized FullCharacter from another server,
+// which may have been written big-endian. The level and meseta are read in
+// both orders and the first order in which both are possible wins, with
+// little-endian (what the client uses) preferred when both are.
+func DetectCharacterEndianness(data []byte) (binary.ByteOrder, error) {
+	if len(data) != binary.Size(FullCharacter{}) {
+		return nil, ErrCorruptCharacter
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		level := order.Uint32(data[importLevelOffset:])
+		meseta := order.Uint32(data[importMesetaOffset:])
+		if level < MaxLevel && meseta <= MaxMeseta {
+			return order, nil
+		}
+	}
+	return nil, errors.New("Unable to determine the byte order of the character data")
+}
+
+// Deserialize a character exported by another server, detecting its byte
+// order, and validate it the same way a saved character would be.
+func ImportCharacter(data []byte) (*FullCharacter, error) {
+	order, err := DetectCharacterEndianness(data)
+	if err != nil {
+		return nil, err
+	}
+	fc := new(FullCharacter)
+	if err = binary.Read(bytes.NewReader(data), order, fc); err != nil {
+		return nil, err
+	} else if err = fc.Validate(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Strip the language marker ("\tE" or "\tJ") that the client prefixes
+// names with and convert the rest to a UTF-8 string.
+func displayName(name []uint16) string {
+	str := util.ConvertFromUtf16(name)
+	if len(str) >= 2 && str[0] == '\t' {
+		str = str[2:]
+	}
+	return str
+}
+
+// Longest character name the client allows, not counting the language
+// marker.
+const maxCharacterNameLength = 12
+
+// Checks that name (without its language marker) is one the client could
+// have produced: not empty, not too long, and free of control codes.
+func ValidateCharacterName(name string) error {
+	length := len(utf16.Encode([]rune(name)))
+	if strings.TrimSpace(name) == "" {
+		return errors.New("Character name is empty")
+	} else if length > maxCharacterNameLength {
+		return fmt.Errorf("Character name is longer than %d characters", maxCharacterNameLength)
+	} else if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return errors.New("Character name contains control codes")
+	}
+	return nil
+}
+
+// Change the character's name, updating both copies of it and the name
+// color checksum. The language marker from the old name is kept, defaulting
+// to English.
+func (fc *FullCharacter) Rename(newName string) error {
+	if err := ValidateCharacterName(newName); err != nil {
+		return err
+	}
+	marker := "\tE"
+	if old := util.ConvertFromUtf16(fc.Character.Name[:]); len(old) >= 2 && old[0] == '\t' {
+		marker = old[:2]
+	}
+	encoded := utf16.Encode([]rune(marker + newName))
+	writeTextField(fc.Character.Name[:], encoded)
+	writeTextField(fc.Name[:], encoded)
+	fc.Character.NameColorChksm = NameColorChecksum(fc.Character.NameColor)
+	return nil
+}
+
+// Returns the character's name as a player would see it.
+func (fc *FullCharacter) DisplayName() string {
+	return displayName(fc.Character.Name[:])
+}
+
+// Returns a short human readable description of the character,
+// e.g. "Foo Lv. 87 RAcast (Viridia)".
+func (fc *FullCharacter) Label() string {
+	// Levels are zero-indexed by the client.
+	return fmt.Sprintf("%s Lv. %d %s (%s)", fc.DisplayName(), fc.Character.Level+1,
+		CharClass(fc.Character.Class), SectionID(fc.Character.SectionId))
+}
+
+// Returns a one line summary of the character for the logs, e.g.
+// "name=Foo gc=12345678 lv=87 class=RAcast sec=Viridia meseta=999999".
+func (fc *FullCharacter) LogSummary() string {
+	c := &fc.Character
+	return fmt.Sprintf("name=%s gc=%d lv=%d class=%s sec=%s meseta=%d",
+		fc.DisplayName(), fc.Guildcard, c.Level+1, CharClass(c.Class),
+		SectionID(c.SectionId), c.Meseta)
+}
+
+// Returns an item id that isn't used by any of the character's items, or
+// an error if the character already has an item with the highest id.
+func (fc *FullCharacter) nextItemId() (uint32, error) {
+	var id uint32
+	for i := 0; i < int(fc.Inventory.NumItems) && i < len(fc.Inventory.Items); i++ {
+		if itemId := fc.Inventory.Items[i].Item.ItemId; itemId > id {
+			id = itemId
+		}
+	}
+	for i := 0; i < int(fc.Bank.NumItems) && i < len(fc.Bank.Items); i++ {
+		if itemId := fc.Bank.Items[i].Item.ItemId; itemId > id {
+			id = itemId
+		}
+	}
+	if id == math.MaxUint32 {
+		return 0, errors.New("No item ids left to assign")
+	}
+	return id + 1, nil
+}
+
+// Give the character a copy of it with a new item id, placing it in the
+// inventory or, if that's full, the bank. Used by GMs to grant items.
+func (fc *FullCharacter) GrantItem(it Item) error {
+	if err := it.Validate(); err != nil {
+		return err
+	} else if it.HasIllegalPercentages() {
+		return errors.New("Illegal weapon percentages")
+	}
+	if itemTable != nil {
+		if err := itemTable.ValidateItem(&it); err != nil {
+			return err
+		}
+	}
+	id, err := fc.nextItemId()
+	if err != nil {
+		return err
+	}
+	it.ItemId = id
+
+	inv := &fc.Inventory
+	inv.RecountItems()
+	if int(inv.NumItems) < len(inv.Items) {
+		inv.Items[inv.NumItems] = InventoryItem{InUse: 1, Item: it}
+		inv.RecountItems()
+		return nil
+	}
+	if bank := &fc.Bank; int(bank.NumItems) < len(bank.Items) {
+		bank.Items[bank.NumItems] = BankItem{Item: it, Amount: 1}
+		bank.NumItems++
+		return nil
+	}
+	return errors.New("Inventory and bank are both full")
+}
+
+// Change the character's section ID. The section ID is stored both in the
+// character data and in the top level of the E7 data, so both are updated
+// to keep them from drifting apart.
+func (fc *FullCharacter) ChangeSectionID(id SectionID) error {
+	if id > Whitill {
+		return fmt.Errorf("Invalid section ID %d", id)
+	}
+	fc.Character.SectionId = byte(id)
+	fc.SectionId = uint8(id)
+	return nil
+}
+
+// Checks that the copies of the class and section ID in the character data
+// and in the top level of the E7 data agree.
+func (fc *FullCharacter) ValidateClassConsistency() error {
+	if fc.Class != fc.Character.Class {
+		return fmt.Errorf("Class %d doesn't match character class %d",
+			fc.Class, fc.Character.Class)
+	} else if fc.SectionId != fc.Character.SectionId {
+		return fmt.Errorf("Section ID %d doesn't match character section ID %d",
+			fc.SectionId, fc.Character.SectionId)
+	}
+	return nil
+}
+
+// Layout of the symbol chats saved with a character: 12 entries, each a
+// flag marking it as used, a name, and the symbol chat itself, which ends
+// with 12 face parts of (type, x, y, flags).
+const (
+	numSymbolChats       = 12
+	symbolChatSize       = 104
+	symbolChatPartsStart = 56
+	numSymbolChatParts   = 12
+	// Type of a face part that isn't shown.
+	symbolChatPartUnused = 0xFF
+	// Face parts are placed on a 64x64 grid and can only be flipped
+	// horizontally and/or vertically.
+	maxSymbolChatCoord = 0x3F
+	symbolChatFlipMask = 0x03
+)
+
+// Checks that every symbol chat in data is laid out the way the client
+// expects, since a malformed one can crash other clients when it's shown.
+func ValidateSymbolChats(data [1248]byte) error {
+	for i := 0; i < numSymbolChats; i++ {
+		entry := data[i*symbolChatSize : (i+1)*symbolChatSize]
+		if used := binary.LittleEndian.Uint32(entry); used > 1 {
+			return fmt.Errorf("Invalid flag %d in symbol chat %d", used, i)
+		}
+		for j := 0; j < numSymbolChatParts; j++ {
+			part := entry[symbolChatPartsStart+j*4:]
+			if part[0] == symbolChatPartUnused {
+				continue
+			}
+			if part[1] > maxSymbolChatCoord || part[2] > maxSymbolChatCoord {
+				return fmt.Errorf("Face part %d of symbol chat %d is out of bounds", j, i)
+			} else if part[3]&^symbolChatFlipMask != 0 {
+				return fmt.Errorf("Invalid flags %02x on face part %d of symbol chat %d", part[3], j, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Copy text into a fixed-size UTF-16 field, zeroing the rest of the field.
+func writeTextField(field []uint16, text []uint16) {
+	n := copy(field, text)
+	for i := n; i < len(field); i++ {
+		field[i] = 0
+	}
+}
+
+// Replace text in a fixed-size UTF-16 field with its sanitized form.
+func sanitizeTextField(field []uint16) {
+	writeTextField(field, utf16.Encode([]rune(util.SanitizeDisplayText(util.ConvertFromUtf16(field)))))
+}
+
+// Strip control codes from text and store it in field, which must have
+// room left over for the terminator.
+func setTextField(field []uint16, text string) error {
+	encoded := utf16.Encode([]rune(util.SanitizeDisplayText(text)))
+	if len(encoded) >= len(field) {
+		return fmt.Errorf("Text is longer than %d characters", len(field)-1)
+	}
+	writeTextField(field, encoded)
+	return nil
+}
+
+// Strip control codes from the player-authored text that gets shown to
+// other players.
+func (fc *FullCharacter) SanitizeText() {
+	sanitizeTextField(fc.InfoBoard[:])
+	sanitizeTextField(fc.AutoReply[:])
+}
+
+// Longest team name, in UTF-16 code units, that leaves room for the
+// terminator the client expects.
+const maxTeamNameLength = len(FullCharacter{}.TeamName) - 1
+
+// Change the character's appearance to the one in prev, e.g. for a
+// dressing room. Only cosmetic fields are copied; the class, stats, and
+// everything else about the character are left alone.
+func (fc *FullCharacter) ApplyAppearance(prev *CharacterPreview) error {
+	if err := prev.ValidateAppearance(); err != nil {
+		return err
+	}
+	prev.NormalizeColors()
+	c := &fc.Character
+	c.NameColor = prev.NameColor
+	c.NameColorChksm = NameColorChecksum(c.NameColor)
+	c.Costume = prev.Costume
+	c.Skin = prev.Skin
+	c.Face = prev.Face
+	c.Head = prev.Head
+	c.Hair = prev.Hair
+	c.HairRed = prev.HairRed
+	c.HairGreen = prev.HairGreen
+	c.HairBlue = prev.HairBlue
+	c.PropX = prev.PropX
+	c.PropY = prev.PropY
+	return nil
+}
+
+// Set the character's team name, keeping the copy in the key and team
+// config in sync since the client expects the two to match. Control codes
+// are stripped and an empty name clears the team name.
+func (fc *FullCharacter) SetTeamName(name string) error {
+	encoded := utf16.Encode([]rune(util.SanitizeDisplayText(name)))
+	if len(encoded) > maxTeamNameLength {
+		return fmt.Errorf("Team name is longer than %d characters", maxTeamNameLength)
+	}
+	writeTextField(fc.TeamName[:], encoded)
+	writeTextField(fc.KeyConfig.Teamname[:], encoded)
+	return nil
+}
+
+// Most meseta a character can carry or keep in the bank.
+const MaxMeseta = 999999
+
+// Clamp the on-hand and bank meseta to MaxMeseta. Character.Meseta is the
+// only record of the meseta a character is carrying; meseta picked up in a
+// game is added to it rather than taking up an inventory slot.
+func (fc *FullCharacter) NormalizeMeseta() {
+	if fc.Character.Meseta > MaxMeseta {
+		fc.Character.Meseta = MaxMeseta
+	}
+	if fc.Bank.Meseta > MaxMeseta {
+		fc.Bank.Meseta = MaxMeseta
+	}
+}
+
+// Checks that no two items in the character's inventory and bank share an
+// item id, which the client's item commands rely on.
+func (fc *FullCharacter) ValidateUniqueItemIDs() error {
+	seen := make(map[uint32]bool)
+	for i := 0; i < int(fc.Inventory.NumItems) && i < len(fc.Inventory.Items); i++ {
+		id := fc.Inventory.Items[i].Item.ItemId
+		if seen[id] {
+			return fmt.Errorf("Duplicate item id %08x in inventory slot %d", id, i)
+		}
+		seen[id] = true
+	}
+	for i := 0; i < int(fc.Bank.NumItems) && i < len(fc.Bank.Items); i++ {
+		id := fc.Bank.Items[i].Item.ItemId
+		if seen[id] {
+			return fmt.Errorf("Duplicate item id %08x in bank slot %d", id, i)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Settings from the client's option menu packed into FullCharacter.Options.
+// New characters are created with DefaultOptions.
+const (
+	// Two bit field; 0 is slow, 1 normal and 2 fast.
+	OptionMessageSpeed  = 0x00000003
+	OptionCursorSave    = 0x00000004
+	OptionButtonConfig  = 0x00000008
+	OptionStereoSound   = 0x00000010
+	OptionRumble        = 0x00000020
+	OptionAutoWeapon    = 0x00000040
+	OptionChoiceSearch  = 0x00010000
+	OptionHideWindow    = 0x00020000
+	OptionAutoChat      = 0x00040000
+	OptionAutoChatReply = 0x00080000
+
+	DefaultOptions = 0x00040058
+
+	knownOptionBits = OptionMessageSpeed | OptionCursorSave | OptionButtonConfig |
+		OptionStereoSound | OptionRumble | OptionAutoWeapon | OptionChoiceSearch |
+		OptionHideWindow | OptionAutoChat | OptionAutoChatReply
+	maxMessageSpeed = 2
+)
+
+// Clear any bits of the options field the client doesn't use so that
+// arbitrary data can't be stashed in it, then reject settings the option
+// menu can't produce.
+func (fc *FullCharacter) ValidateOptions() error {
+	fc.Options &= knownOptionBits
+	if speed := fc.Options & OptionMessageSpeed; speed > maxMessageSpeed {
+		return fmt.Errorf("Invalid message speed %d in options %08x", speed, fc.Options)
+	}
+	if fc.Options&OptionAutoChatReply != 0 && fc.Options&OptionAutoChat == 0 {
+		return fmt.Errorf("Auto chat replies enabled without auto chat in options %08x", fc.Options)
+	}
+	return nil
+}
+
+// QuestData1 holds a 128-byte block of quest flags for each difficulty
+// followed by a few bytes the client never sets.
+const questFlagsSize = 4 * 128
+
+// Largest value of any of the counters in QuestData2.
+const maxQuestDataCounter = 0xFFFF
+
+// Checks that the reserved tail of QuestData1 is zero and that the 32-bit
+// counters in QuestData2 are within maxQuestDataCounter, since a tampered
+// save could use either to confuse quest scripts. Any bit pattern is valid
+// in the quest flags themselves.
+func (fc *FullCharacter) ValidateQuestData() error {
+	for i, b := range fc.QuestData1[questFlagsSize:] {
+		if b != 0 {
+			return fmt.Errorf("Reserved quest data byte %d is set", questFlagsSize+i)
+		}
+	}
+	for i := 0; i+4 <= len(fc.QuestData2); i += 4 {
+		counter := binary.LittleEndian.Uint32(fc.QuestData2[i:])
+		if counter > maxQuestDataCounter {
+			return fmt.Errorf("Invalid quest counter %d at offset %d", counter, i)
+		}
+	}
+	return nil
+}
+
+// Release date of Blue Burst; nobody can have been playing for longer
+// than it's been out.
+var blueBurstRelease = time.Date(2004, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+// Returns an error if the character's playtime (in seconds) is more than
+// maxReasonable, e.g. because a save was edited to farm playtime rewards.
+func (c *Character) ValidatePlaytime(maxReasonable time.Duration) error {
+	playtime := time.Duration(c.Playtime) * time.Second
+	if playtime > maxReasonable {
+		return fmt.Errorf("Implausible playtime %v", playtime)
+	}
+	return nil
+}
+
+// Number of items held in an inventory slot. Tools keep their stack size in
+// the sixth byte of the item data; everything else is held one per slot.
+func (it *Item) stackSize() uint32 {
+	if it.Type() == ItemTypeTool && it.Data[5] > 0 {
+		return uint32(it.Data[5])
+	}
+	return 1
+}
+
+// Estimate the meseta value of everything the character owns: meseta on
+// hand and in the bank, plus the price of each item in the inventory and
+// bank according to priceTable. Item types missing from the table are
+// counted as worthless. Values too large for a uint32 are capped at
+// math.MaxUint32.
+func (fc *FullCharacter) EstimatedValue(priceTable map[ItemType]uint32) uint32 {
+	// Each term fits in a uint64 and the total is capped after every one,
+	// so the sum can't overflow.
+	value := uint64(fc.Character.Meseta) + uint64(fc.Bank.Meseta)
+	for i := 0; i < int(fc.Inventory.NumItems) && i < len(fc.Inventory.Items) && value < math.MaxUint32; i++ {
+		it := &fc.Inventory.Items[i].Item
+		value += uint64(priceTable[it.Type()]) * uint64(it.stackSize())
+	}
+	for i := 0; i < int(fc.Bank.NumItems) && i < len(fc.Bank.Items) && value < math.MaxUint32; i++ {
+		bankItem := &fc.Bank.Items[i]
+		value += uint64(priceTable[bankItem.Item.Type()]) * uint64(bankItem.Amount)
+	}
+	if value > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(value)
+}
+
+// Check the character for values the client can't have produced and clean
+// up any player-authored text. Should be called before a character is saved.
+func (fc *FullCharacter) Validate() error {
+	fc.SanitizeText()
+	fc.NormalizeMeseta()
+
+	c := &fc.Character
+	if c.Class >= NumCharClasses {
+		return fmt.Errorf("Invalid class %d", c.Class)
+	} else if c.SectionId > Whitill {
+		return fmt.Errorf("Invalid section ID %d", c.SectionId)
+	} else if c.Level >= MaxLevel {
+		return fmt.Errorf("Invalid level %d", c.Level+1)
+	} else if err := fc.ValidateClassConsistency(); err != nil {
+		return err
+	}
+	fc.Inventory.RecountItems()
+	// The bank is checked as-is rather than repaired so that tampered item
+	// counts are rejected; only characters loaded from the database are repaired.
+	if err := fc.Bank.Validate(); err != nil {
+		return err
+	}
+	for i := 0; i < int(fc.Inventory.NumItems); i++ {
+		if fc.Inventory.Items[i].Item.HasIllegalPercentages() {
+			return fmt.Errorf("Illegal weapon percentages in inventory slot %d", i)
+		}
+	}
+	for i := 0; i < int(fc.Bank.NumItems) && i < len(fc.Bank.Items); i++ {
+		if fc.Bank.Items[i].Item.HasIllegalPercentages() {
+			return fmt.Errorf("Illegal weapon percentages in bank slot %d", i)
+		}
+	}
+	if itemTable != nil {
+		for i := 0; i < int(fc.Inventory.NumItems); i++ {
+			if err := itemTable.ValidateItem(&fc.Inventory.Items[i].Item); err != nil {
+				return fmt.Errorf("Inventory slot %d: %s", i, err.Error())
+			}
+		}
+		for i := 0; i < int(fc.Bank.NumItems) && i < len(fc.Bank.Items); i++ {
+			if err := itemTable.ValidateItem(&fc.Bank.Items[i].Item); err != nil {
+				return fmt.Errorf("Bank slot %d: %s", i, err.Error())
+			}
+		}
+	}
+	if err := fc.Inventory.ValidateEquipped(); err != nil {
+		return err
+	} else if err := fc.ValidateUniqueItemIDs(); err != nil {
+		return err
+	} else if err := fc.ValidateStats(); err != nil {
+		return err
+	} else if err := fc.ValidateQuestData(); err != nil {
+		return err
+	} else if err := c.ValidatePlaytime(time.Since(blueBurstRelease)); err != nil {
+		return err
+	} else if err := fc.ValidateTechniques(); err != nil {
+		return err
+	} else if err := ValidateSymbolChats(fc.SymbolChats); err != nil {
+		return err
+	}
+	return fc.ValidateOptions()
+}
+
 // Default keyboard/joystick configuration used for players who are
 // logging in for the first time.
 var baseKeyConfig = [420]byte{
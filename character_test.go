@@ -0,0 +1,936 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/dcrodman/archon/util"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestBankValidate(t *testing.T) {
+	if err := NewTestCharacter(t, WithBank()).Bank.Validate(); err != nil {
+		t.Errorf("Valid bank failed validation: %s", err.Error())
+	}
+
+	tampered := map[string]func(b *Bank){
+		"stacked weapon":  func(b *Bank) { b.Items[0].Amount = 65535 },
+		"oversized stack": func(b *Bank) { b.Items[1].Amount = maxToolStack + 1 },
+		"empty stack":     func(b *Bank) { b.Items[1].Amount = 0 },
+		"inflated count":  func(b *Bank) { b.NumItems = 3 },
+		"deflated count":  func(b *Bank) { b.NumItems = 1 },
+		"count past end":  func(b *Bank) { b.NumItems = uint32(len(b.Items)) + 1 },
+		"too much meseta": func(b *Bank) { b.Meseta = MaxMeseta + 1 },
+	}
+	for name, tamper := range tampered {
+		b := NewTestCharacter(t, WithBank()).Bank
+		tamper(&b)
+		if err := b.Validate(); err == nil {
+			t.Errorf("Bank with %s passed validation", name)
+		}
+	}
+}
+
+func TestValidateRejectsBankCountMismatch(t *testing.T) {
+	fc := NewTestCharacter(t, WithBank())
+	fc.Bank.NumItems = 1
+	if err := fc.Validate(); err == nil {
+		t.Error("Character with a mismatched bank item count passed validation")
+	}
+	if fc.Bank.NumItems != 1 {
+		t.Error("Validate repaired the bank instead of rejecting it")
+	}
+}
+
+func TestBankRepair(t *testing.T) {
+	b := NewTestCharacter(t, WithBank()).Bank
+	b.Items[5] = b.Items[1]
+	b.Items[1] = BankItem{}
+	b.NumItems = 150
+	b.Meseta = MaxMeseta + 1
+	b.Repair()
+	if b.NumItems != 2 {
+		t.Errorf("Repaired item count is %d; expected 2", b.NumItems)
+	}
+	if b.Items[1].Amount != 5 || b.Items[5] != (BankItem{}) {
+		t.Error("Populated slots weren't compacted")
+	}
+	if b.Meseta != MaxMeseta {
+		t.Errorf("Repaired meseta is %d; expected %d", b.Meseta, MaxMeseta)
+	}
+	if err := b.Validate(); err != nil {
+		t.Errorf("Repaired bank failed validation: %s", err.Error())
+	}
+}
+
+func TestRename(t *testing.T) {
+	fc := NewTestCharacter(t)
+	fc.Character.NameColor = 0xFF40A0E0
+	fc.Character.NameColorChksm = 0xDEAD
+	if err := fc.Rename("Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	expected := utf16.Encode([]rune("\tERenamed"))
+	if !equalText(fc.Character.Name[:], expected) {
+		t.Errorf("Character name is %q", util.ConvertFromUtf16(fc.Character.Name[:]))
+	}
+	if !equalText(fc.Name[:], expected) {
+		t.Errorf("Top-level name is %q", util.ConvertFromUtf16(fc.Name[:]))
+	}
+	if fc.DisplayName() != "Renamed" {
+		t.Errorf("Display name is %q", fc.DisplayName())
+	}
+	if fc.Character.NameColorChksm != 0x229C {
+		t.Errorf("Name color checksum is %#x; expected 0x229c", fc.Character.NameColorChksm)
+	}
+
+	if err := fc.Rename("Bad\x01Name"); err == nil {
+		t.Error("Renamed a character to a name with control codes")
+	}
+	if fc.DisplayName() != "Renamed" {
+		t.Error("Failed rename changed the name")
+	}
+}
+
+// Returns true if field holds text followed by nothing but terminators.
+func equalText(field, text []uint16) bool {
+	for i, ch := range field {
+		if i < len(text) && ch != text[i] || i >= len(text) && ch != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestValidateTechniques(t *testing.T) {
+	// Zero-indexed levels at the limit for each class and technique.
+	legal := []struct {
+		class CharClass
+		tech  Technique
+		level uint8
+	}{
+		{Humar, Foie, 14},
+		{Hunewearl, Foie, 19},
+		{Ramarl, Zonde, 19},
+		{Ramar, Resta, 14},
+		{Fomar, Megid, 29},
+		{Fonewm, Anti, 6},
+		{Hunewearl, Anti, 6},
+		{Fomarl, Reverser, 0},
+	}
+	for _, test := range legal {
+		fc := NewTestCharacter(t, WithClass(test.class))
+		fc.Character.Techniques[test.tech] = test.level
+		if err := fc.ValidateTechniques(); err != nil {
+			t.Errorf("%s with %s level %d failed validation: %s",
+				test.class, test.tech, test.level+1, err.Error())
+		}
+	}
+
+	illegal := []struct {
+		class CharClass
+		tech  Technique
+		level uint8
+	}{
+		{Humar, Foie, 15},
+		{Hunewearl, Foie, 20},
+		{Ramarl, Zonde, 20},
+		{Racast, Foie, 0},
+		{Humar, Grants, 0},
+		{Fomar, Megid, 30},
+		{Fonewm, Anti, 7},
+		{Fomarl, Reverser, 1},
+	}
+	for _, test := range illegal {
+		fc := NewTestCharacter(t, WithClass(test.class))
+		fc.Character.Techniques[test.tech] = test.level
+		if err := fc.ValidateTechniques(); err == nil {
+			t.Errorf("%s with %s level %d passed validation", test.class, test.tech, test.level+1)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	valid := []uint32{
+		0,
+		DefaultOptions,
+		DefaultOptions | OptionAutoChatReply,
+		maxMessageSpeed | OptionRumble | OptionHideWindow,
+	}
+	for _, options := range valid {
+		fc := NewTestCharacter(t)
+		fc.Options = options
+		if err := fc.ValidateOptions(); err != nil {
+			t.Errorf("Options %08x failed validation: %s", options, err.Error())
+		} else if fc.Options != options {
+			t.Errorf("Options %08x were changed to %08x", options, fc.Options)
+		}
+	}
+
+	fc := NewTestCharacter(t)
+	fc.Options = DefaultOptions | 0xFF000080
+	if err := fc.ValidateOptions(); err != nil {
+		t.Errorf("Options with unknown bits failed validation: %s", err.Error())
+	} else if fc.Options != DefaultOptions {
+		t.Errorf("Unknown option bits weren't cleared: %08x", fc.Options)
+	}
+
+	invalid := []uint32{
+		DefaultOptions | OptionMessageSpeed,
+		OptionAutoChatReply,
+	}
+	for _, options := range invalid {
+		fc := NewTestCharacter(t)
+		fc.Options = options
+		if err := fc.ValidateOptions(); err == nil {
+			t.Errorf("Options %08x passed validation", options)
+		}
+	}
+}
+
+func TestNormalizeColors(t *testing.T) {
+	prev := &CharacterPreview{HairRed: 0x1FF, HairGreen: 0x80, HairBlue: 0xFFFF, NameColor: 0x00FF8000}
+	prev.NormalizeColors()
+	if prev.HairRed != 0xFF || prev.HairGreen != 0x80 || prev.HairBlue != 0xFF {
+		t.Errorf("Hair colors normalized to %d, %d, %d", prev.HairRed, prev.HairGreen, prev.HairBlue)
+	}
+	if prev.NameColor != 0xFFFF8000 {
+		t.Errorf("Name color normalized to %08x; expected it to be made opaque", prev.NameColor)
+	}
+}
+
+func TestIsEmptyCharacter(t *testing.T) {
+	if !IsEmptyCharacter(EmptyCharacterSlot()) {
+		t.Error("Empty slot wasn't detected as empty")
+	}
+	if IsEmptyCharacter(nil) || IsEmptyCharacter(make([]byte, 10)) {
+		t.Error("Data of the wrong size was treated as an empty slot")
+	}
+	data, _ := util.BytesFromStruct(&CharacterPreview{Level: 1})
+	if IsEmptyCharacter(data) {
+		t.Error("Slot with a character in it was treated as empty")
+	}
+}
+
+func TestLabel(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Racast), WithLevel(86))
+	fc.Character.SectionId = Oran
+	if label := fc.Label(); label != "Tester Lv. 87 RAcast (Oran)" {
+		t.Errorf("Character is labelled %q", label)
+	}
+	fc.Character.Class = 0x20
+	fc.Character.SectionId = 0x20
+	if label := fc.Label(); label != "Tester Lv. 87 Unknown (Unknown)" {
+		t.Errorf("Character with an invalid class is labelled %q", label)
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	fc := NewTestCharacter(t)
+	copy(fc.InfoBoard[:], utf16.Encode([]rune("\tEHello\x07 there")))
+	copy(fc.AutoReply[:], utf16.Encode([]rune("\tJAway\x1b")))
+	if err := fc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if text := util.ConvertFromUtf16(fc.InfoBoard[:]); text != "\tEHello there" {
+		t.Errorf("Info board sanitized to %q", text)
+	}
+	if text := util.ConvertFromUtf16(fc.AutoReply[:]); text != "\tJAway" {
+		t.Errorf("Auto reply sanitized to %q", text)
+	}
+}
+
+func TestChangeSectionID(t *testing.T) {
+	fc := NewTestCharacter(t)
+	if err := fc.ChangeSectionID(Yellowboze); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Character.SectionId != byte(Yellowboze) || fc.SectionId != uint8(Yellowboze) {
+		t.Errorf("Section IDs changed to %d and %d; expected both to be %d",
+			fc.Character.SectionId, fc.SectionId, Yellowboze)
+	}
+	if err := fc.ValidateClassConsistency(); err != nil {
+		t.Error(err)
+	}
+
+	if err := fc.ChangeSectionID(Whitill + 1); err == nil {
+		t.Error("Changed to an invalid section ID")
+	}
+	if fc.Character.SectionId != byte(Yellowboze) || fc.SectionId != uint8(Yellowboze) {
+		t.Error("Invalid section ID was applied")
+	}
+}
+
+func TestNormalizeMeseta(t *testing.T) {
+	fc := NewTestCharacter(t)
+	fc.Character.Meseta = 5000
+	fc.Bank.Meseta = MaxMeseta
+	fc.NormalizeMeseta()
+	if fc.Character.Meseta != 5000 || fc.Bank.Meseta != MaxMeseta {
+		t.Errorf("Meseta under the cap changed to %d and %d", fc.Character.Meseta, fc.Bank.Meseta)
+	}
+
+	fc.Character.Meseta = MaxMeseta + 1
+	fc.Bank.Meseta = 0xFFFFFFFF
+	if err := fc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Character.Meseta != MaxMeseta || fc.Bank.Meseta != MaxMeseta {
+		t.Errorf("Meseta over the cap was clamped to %d and %d", fc.Character.Meseta, fc.Bank.Meseta)
+	}
+}
+
+func TestLearnedTechniques(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Fomarl))
+	if techs := fc.Character.LearnedTechniques(); len(techs) != 0 {
+		t.Errorf("New character knows %v", techs)
+	}
+	fc.Character.Techniques[Megid] = 29
+	fc.Character.Techniques[Foie] = 4
+	fc.Character.Techniques[Resta] = 0
+	expected := []TechLevelInfo{{Foie, 4}, {Resta, 0}, {Megid, 29}}
+	if techs := fc.Character.LearnedTechniques(); !reflect.DeepEqual(techs, expected) {
+		t.Errorf("Learned techniques are %v; expected %v", techs, expected)
+	}
+	if name := Technique(Megid).String(); name != "Megid" {
+		t.Errorf("Megid is named %q", name)
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Racast), WithLevel(86))
+	fc.Character.SectionId = byte(Viridia)
+	fc.Character.Meseta = 999999
+	expected := "name=Tester gc=42000001 lv=87 class=RAcast sec=Viridia meseta=999999"
+	if summary := fc.LogSummary(); summary != expected {
+		t.Errorf("Summary is %q; expected %q", summary, expected)
+	}
+}
+
+func TestGrantItem(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems(), WithBank())
+	weapon := Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x03, 0x00}}
+	if err := fc.GrantItem(weapon); err != nil {
+		t.Fatal(err)
+	}
+	granted := fc.Inventory.Items[fc.Inventory.NumItems-1].Item
+	if granted.Data != weapon.Data {
+		t.Errorf("Inventory ends with %x; expected the granted weapon", granted.Data)
+	}
+	if err := fc.ValidateUniqueItemIDs(); err != nil {
+		t.Errorf("Granted item reused an item id: %s", err.Error())
+	}
+
+	// Once the inventory is full, items go to the bank.
+	for fc.Inventory.NumItems < uint8(len(fc.Inventory.Items)) {
+		if err := fc.GrantItem(weapon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bankItems := fc.Bank.NumItems
+	if err := fc.GrantItem(weapon); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Bank.NumItems != bankItems+1 || fc.Bank.Items[bankItems].Item.Data != weapon.Data {
+		t.Error("Item granted with a full inventory wasn't put in the bank")
+	}
+	for fc.Bank.NumItems < uint32(len(fc.Bank.Items)) {
+		if err := fc.GrantItem(weapon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fc.GrantItem(weapon); err == nil {
+		t.Error("Granted an item with a full inventory and bank")
+	}
+	if err := fc.ValidateUniqueItemIDs(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrantItemRejectsInvalid(t *testing.T) {
+	fc := NewTestCharacter(t)
+	invalid := []Item{
+		{Data: [12]uint8{0x05, 0x00, 0x00}},
+		{Data: [12]uint8{ItemTypeArmor, 0x07, 0x00}},
+		// Illegal item: Native +101%.
+		{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00, 0, 0, 0, 1, 101}},
+	}
+	for _, it := range invalid {
+		if err := fc.GrantItem(it); err == nil {
+			t.Errorf("Granted invalid item %x", it.Data)
+		}
+	}
+	if fc.Inventory.NumItems != 0 {
+		t.Errorf("Inventory has %d items after invalid grants", fc.Inventory.NumItems)
+	}
+}
+
+func TestGrantItemChecksItemTable(t *testing.T) {
+	prev := itemTable
+	itemTable = &ItemTable{items: map[uint32]ItemParams{
+		itemKey(uint8(ItemTypeWeapon), 0x01, 0x00): {MaxGrind: 10},
+	}}
+	defer func() { itemTable = prev }()
+
+	fc := NewTestCharacter(t)
+	if err := fc.GrantItem(Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00, 11}}); err == nil {
+		t.Error("Granted a weapon ground past the limit in the item table")
+	}
+	if err := fc.GrantItem(Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00, 10}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrantItemOutOfIds(t *testing.T) {
+	fc := NewTestCharacter(t, WithBank())
+	fc.Bank.Items[1].Item.ItemId = math.MaxUint32
+	if err := fc.GrantItem(Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00}}); err == nil {
+		t.Error("Granted an item after running out of item ids")
+	}
+	if fc.Inventory.NumItems != 0 {
+		t.Error("Item was added without an id")
+	}
+}
+
+func TestInventoryDescribe(t *testing.T) {
+	var inv Inventory
+	items := []Item{
+		{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x02, 5, 0x83, 0, 1, 10, 5, 0xEC}},
+		{Data: [12]uint8{ItemTypeArmor, ArmorTypeFrame, 0x04, 0, 0, 3}},
+		{Data: [12]uint8{ItemTypeArmor, ArmorTypeBarrier, 0x07}},
+		{Data: [12]uint8{ItemTypeMag, 0x00, 5, 0, 0xF4, 0x01, 0x64, 0x00, 0, 0, 0, 0}},
+		{Data: [12]uint8{ItemTypeTool, 0x00, 0x01, 0, 0, 4}},
+		{Data: [12]uint8{0x05, 0xAB}},
+	}
+	for i, it := range items {
+		inv.Items[i] = InventoryItem{InUse: 1, Item: it}
+	}
+	inv.Items[0].Flags |= itemEquipped
+	inv.RecountItems()
+
+	expected := []string{
+		"(E) Weapon 01:02 +5 special 3 [Native 10%, Hit -20%]",
+		"Frame 04 (3 slots)",
+		"Barrier 07",
+		"Mag 00 Lv. 5 (DEF 5, POW 1, DEX 0, MIND 0)",
+		"Tool 00:01 x4",
+		"Unknown item 05 AB 00 00 00 00 00 00 00 00 00 00",
+	}
+	if descs := inv.Describe(); !reflect.DeepEqual(descs, expected) {
+		t.Errorf("Inventory described as:\n%s\nexpected:\n%s",
+			strings.Join(descs, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestCharacterSelectMenuEmptySlots(t *testing.T) {
+	var previews [MaxCharacterSlots]*CharacterPreview
+	previews[1] = &CharacterPreview{Level: 9, NameColor: 0xFFFFFFFF}
+	menu := BuildCharacterSelectMenu(previews)
+
+	empty := EmptyCharacterSlot()
+	for i := 0; i < MaxCharacterSlots; i++ {
+		start := BBHeaderSize + i*(4+len(empty)) + 4
+		data := menu[start : start+len(empty)]
+		if isEmpty := IsEmptyCharacter(data); isEmpty != (previews[i] == nil) {
+			t.Errorf("Slot %d is empty: %v", i, isEmpty)
+		}
+		if previews[i] == nil && !bytes.Equal(data, empty) {
+			t.Errorf("Slot %d doesn't match EmptyCharacterSlot", i)
+		}
+	}
+}
+
+func TestRecountItems(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems())
+	inv := &fc.Inventory
+	tool := inv.Items[4]
+	// Leave a gap in the middle and a count that doesn't match.
+	inv.Items[2] = InventoryItem{}
+	inv.NumItems = 9
+	inv.RecountItems()
+	if inv.NumItems != 4 {
+		t.Errorf("Recounted %d items; expected 4", inv.NumItems)
+	}
+	if inv.Items[3] != tool || inv.Items[4] != (InventoryItem{}) {
+		t.Error("Items weren't moved up to fill the gap")
+	}
+
+	inv.NumItems = 0
+	if err := fc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if inv.NumItems != 4 {
+		t.Errorf("Validate left the item count at %d", inv.NumItems)
+	}
+}
+
+func TestHasIllegalPercentages(t *testing.T) {
+	weapon := func(attrs ...uint8) *Item {
+		it := &Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00}}
+		copy(it.Data[6:], attrs)
+		return it
+	}
+	legal := []*Item{
+		weapon(),
+		weapon(1, 50, 5, 30),
+		weapon(2, 100, 3, 100),
+		weapon(4, 0x9C, 1, 100, 5, 100), // -100%
+		{Data: [12]uint8{ItemTypeTool, 0x00, 0x00, 0x00, 0x00, 0x04, 0x01, 0x7F}},
+	}
+	for _, it := range legal {
+		if it.HasIllegalPercentages() {
+			t.Errorf("Legal item %x was flagged", it.Data)
+		}
+	}
+	illegal := []*Item{
+		weapon(1, 101),
+		weapon(1, 0x9B), // -101%
+		weapon(1, 100, 2, 100, 3, 1),
+		weapon(1, 10, 1, 10),
+		weapon(6, 10),
+	}
+	for _, it := range illegal {
+		if !it.HasIllegalPercentages() {
+			t.Errorf("Illegal weapon %x wasn't flagged", it.Data)
+		}
+	}
+
+	fc := NewTestCharacter(t, WithItems())
+	fc.Inventory.Items[0].Item.Data = weapon(1, 100, 2, 100, 3, 1).Data
+	if err := fc.Validate(); err == nil {
+		t.Error("Character carrying a hacked weapon passed validation")
+	}
+}
+
+func TestGuildcardSearchReply(t *testing.T) {
+	entry := &GuildcardEntry{Guildcard: 42000007}
+	copy(entry.Name[:], utf16.Encode([]rune("\tEFriend")))
+	reply := entry.SearchReply(PlayerLocation{ShipName: "Archon", Block: 2, Lobby: 5})
+
+	if len(reply)%8 != 0 {
+		t.Errorf("Reply is %d bytes; expected a multiple of 8", len(reply))
+	}
+	if pktType := binary.LittleEndian.Uint16(reply[2:]); pktType != GuildcardSearchReplyType {
+		t.Errorf("Reply has type %02x", pktType)
+	}
+	if gc := binary.LittleEndian.Uint32(reply[0x10:]); gc != 42000007 {
+		t.Errorf("Reply is for guildcard %d", gc)
+	}
+	location := util.ConvertFromUtf16(util.CompressUtf16(reply[0x28 : 0x28+136]))
+	if location != "LOBBY05,BLOCK02,Archon" {
+		t.Errorf("Reply has location %q", location)
+	}
+	if lobby := binary.LittleEndian.Uint32(reply[0xB4:]); lobby != 5 {
+		t.Errorf("Reply has lobby id %d", lobby)
+	}
+	if name := util.ConvertFromUtf16(util.CompressUtf16(reply[0xF4 : 0xF4+64])); name != "\tEFriend" {
+		t.Errorf("Reply has name %q", name)
+	}
+}
+
+func TestValidateUniqueItemIDs(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems(), WithBank())
+	if err := fc.ValidateUniqueItemIDs(); err != nil {
+		t.Errorf("Character with unique item ids failed validation: %s", err.Error())
+	}
+
+	fc.Bank.Items[1].Item.ItemId = fc.Inventory.Items[2].Item.ItemId
+	if err := fc.ValidateUniqueItemIDs(); err == nil {
+		t.Error("Item id shared by the inventory and bank wasn't detected")
+	}
+	if err := fc.Validate(); err == nil {
+		t.Error("Character with a duplicated item passed validation")
+	}
+
+	fc = NewTestCharacter(t, WithItems())
+	fc.Inventory.Items[1].Item.ItemId = fc.Inventory.Items[0].Item.ItemId
+	if err := fc.ValidateUniqueItemIDs(); err == nil {
+		t.Error("Item id repeated in the inventory wasn't detected")
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	tests := []struct {
+		code uint8
+		lang Language
+		name string
+	}{
+		{0x00, LanguageJapanese, "Japanese"},
+		{0x01, LanguageEnglish, "English"},
+		{0x04, LanguageSpanish, "Spanish"},
+		{0x07, LanguageKorean, "Korean"},
+		// Unknown codes fall back to English.
+		{0x08, LanguageEnglish, "English"},
+		{0xFF, LanguageEnglish, "English"},
+	}
+	for _, test := range tests {
+		lang := ParseLanguage(test.code)
+		if lang != test.lang || lang.String() != test.name {
+			t.Errorf("Code %02x parsed as %s; expected %s", test.code, lang, test.name)
+		}
+	}
+	if name := Language(0x20).String(); name != "Unknown" {
+		t.Errorf("Invalid language is named %q", name)
+	}
+}
+
+func TestBuildCharacterSelectMenu(t *testing.T) {
+	var previews [MaxCharacterSlots]*CharacterPreview
+	previews[0] = &CharacterPreview{Level: 4, NameColor: 0xFFFFFFFF}
+	previews[2] = &CharacterPreview{Level: 99, NameColor: 0xFFFFFFFF}
+	menu := BuildCharacterSelectMenu(previews)
+
+	var pkt CharSelectMenuPacket
+	if err := util.StructFromBytes(menu, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Header.Type != LoginCharPreviewType || pkt.Header.Flags != MaxCharacterSlots {
+		t.Errorf("Menu has type %02x with %d entries", pkt.Header.Type, pkt.Header.Flags)
+	}
+	if int(pkt.Header.Size) != len(menu) || len(menu)%8 != 0 {
+		t.Errorf("Menu is %d bytes with size %d; expected a padded size", len(menu), pkt.Header.Size)
+	}
+	for i, entry := range pkt.Entries {
+		if entry.Slot != uint32(i) {
+			t.Errorf("Entry %d is for slot %d", i, entry.Slot)
+		}
+		if previews[i] != nil && entry.Character != *previews[i] {
+			t.Errorf("Slot %d has the wrong character", i)
+		}
+	}
+}
+
+func TestEstimatedValue(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems(), WithBank())
+	// Mags aren't priced, so they're worth nothing.
+	prices := map[ItemType]uint32{
+		ItemTypeWeapon: 1000,
+		ItemTypeArmor:  200,
+		ItemTypeTool:   50,
+	}
+	// 300 + 10000 meseta, a weapon, two armors and 4 tools carried, and a
+	// weapon and 5 tools in the bank.
+	expected := uint32(300 + 10000 + 1000 + 2*200 + 4*50 + 1000 + 5*50)
+	if value := fc.EstimatedValue(prices); value != expected {
+		t.Errorf("Estimated value is %d; expected %d", value, expected)
+	}
+	if value := fc.EstimatedValue(nil); value != 10300 {
+		t.Errorf("Value without prices is %d; expected just the meseta", value)
+	}
+}
+
+func TestEstimatedValueOverflow(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems(), WithBank())
+	prices := map[ItemType]uint32{ItemTypeWeapon: math.MaxUint32 / 2, ItemTypeTool: math.MaxUint32}
+	if value := fc.EstimatedValue(prices); value != math.MaxUint32 {
+		t.Errorf("Estimated value is %d; expected it to be capped at %d", value, uint32(math.MaxUint32))
+	}
+}
+
+func TestSetTeamName(t *testing.T) {
+	fc := NewTestCharacter(t)
+	if err := fc.SetTeamName("\tEGuild\x07"); err != nil {
+		t.Fatal(err)
+	}
+	if name := util.ConvertFromUtf16(fc.TeamName[:]); name != "\tEGuild" {
+		t.Errorf("Team name set to %q", name)
+	}
+	if fc.KeyConfig.Teamname != fc.TeamName {
+		t.Error("Key config team name doesn't match the character's")
+	}
+
+	if err := fc.SetTeamName(strings.Repeat("a", maxTeamNameLength+1)); err == nil {
+		t.Error("Expected an overlong team name to be rejected")
+	}
+	if name := util.ConvertFromUtf16(fc.TeamName[:]); name != "\tEGuild" {
+		t.Errorf("Rejected name changed the team name to %q", name)
+	}
+	if err := fc.SetTeamName(strings.Repeat("a", maxTeamNameLength)); err != nil {
+		t.Errorf("Longest team name was rejected: %v", err)
+	}
+
+	if err := fc.SetTeamName(""); err != nil {
+		t.Fatal(err)
+	}
+	if fc.TeamName != [16]uint16{} || fc.KeyConfig.Teamname != [16]uint16{} {
+		t.Error("Expected an empty name to clear the team name")
+	}
+}
+
+func TestValidateQuestData(t *testing.T) {
+	fc := NewTestCharacter(t)
+	for i := range fc.QuestData1[:questFlagsSize] {
+		fc.QuestData1[i] = 0xFF
+	}
+	binary.LittleEndian.PutUint32(fc.QuestData2[4:], maxQuestDataCounter)
+	if err := fc.ValidateQuestData(); err != nil {
+		t.Errorf("Rejected valid quest data: %v", err)
+	}
+
+	tampered := *fc
+	tampered.QuestData1[len(tampered.QuestData1)-1] = 1
+	if err := tampered.ValidateQuestData(); err == nil {
+		t.Error("Accepted quest data with a reserved byte set")
+	}
+	tampered = *fc
+	binary.LittleEndian.PutUint32(tampered.QuestData2[len(tampered.QuestData2)-4:], maxQuestDataCounter+1)
+	if err := tampered.ValidateQuestData(); err == nil {
+		t.Error("Accepted an out of range quest counter")
+	}
+	if err := tampered.Validate(); err == nil {
+		t.Error("Character validation didn't check the quest data")
+	}
+}
+
+func TestDetectCharacterEndianness(t *testing.T) {
+	fc := NewTestCharacter(t, WithLevel(50))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, order, fc); err != nil {
+			t.Fatal(err)
+		}
+		if detected, err := DetectCharacterEndianness(buf.Bytes()); err != nil || detected != order {
+			t.Errorf("Detected %v (err %v); expected %v", detected, err, order)
+		}
+		imported, err := ImportCharacter(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to import %v character: %v", order, err)
+		}
+		if imported.Character.Level != fc.Character.Level || imported.Character.Meseta != fc.Character.Meseta {
+			t.Errorf("Imported %v character at level %d with %d meseta", order,
+				imported.Character.Level, imported.Character.Meseta)
+		}
+	}
+}
+
+func TestDetectCharacterEndiannessInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, NewTestCharacter(t)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := DetectCharacterEndianness(data[1:]); err != ErrCorruptCharacter {
+		t.Errorf("Truncated data returned %v; expected ErrCorruptCharacter", err)
+	}
+	// Impossible in either byte order.
+	copy(data[importLevelOffset:], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	if _, err := DetectCharacterEndianness(data); err == nil {
+		t.Error("Detected a byte order for an impossible level")
+	}
+}
+
+func TestApplyAppearance(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems())
+	before := *fc
+	prev := &CharacterPreview{
+		Level:     99,
+		Class:     byte(Fonewearl),
+		NameColor: 0x00123456,
+		Costume:   2,
+		Skin:      1,
+		Face:      3,
+		Head:      1,
+		Hair:      4,
+		HairRed:   0x1FF,
+		HairGreen: 0x40,
+		HairBlue:  0x20,
+		PropX:     0.25,
+		PropY:     0.75,
+	}
+	if err := fc.ApplyAppearance(prev); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the cosmetic fields change; the hair color and name color are
+	// normalized on the way.
+	expected := before
+	c := &expected.Character
+	c.NameColor = 0xFF123456
+	c.NameColorChksm = NameColorChecksum(c.NameColor)
+	c.Costume, c.Skin, c.Face, c.Head, c.Hair = 2, 1, 3, 1, 4
+	c.HairRed, c.HairGreen, c.HairBlue = maxHairColor, 0x40, 0x20
+	c.PropX, c.PropY = 0.25, 0.75
+	if !reflect.DeepEqual(*fc, expected) {
+		t.Errorf("Applied appearance %+v; expected %+v", fc.Character, expected.Character)
+	}
+
+	bad := *prev
+	bad.PropY = 1.5
+	if err := fc.ApplyAppearance(&bad); err == nil {
+		t.Error("Applied an out of range body proportion")
+	}
+	if !reflect.DeepEqual(*fc, expected) {
+		t.Error("Rejected appearance changed the character")
+	}
+}
+
+func TestValidateGuildcardEntry(t *testing.T) {
+	valid := GuildcardEntry{Guildcard: 42000001, Language: uint8(LanguageKorean),
+		SectionID: byte(Whitill), CharClass: byte(Fonewearl)}
+	entry := valid
+	if err := entry.Validate(); err != nil {
+		t.Errorf("Rejected a valid entry: %v", err)
+	}
+	if entry != valid {
+		t.Errorf("Valid entry was changed to %+v", entry)
+	}
+
+	entry.Language = 0xFF
+	if err := entry.Validate(); err != nil {
+		t.Errorf("Rejected an entry with an unknown language: %v", err)
+	}
+	if entry.Language != uint8(LanguageEnglish) {
+		t.Errorf("Unknown language was changed to %d; expected English", entry.Language)
+	}
+
+	entry = valid
+	entry.SectionID = byte(Whitill) + 1
+	if err := entry.Validate(); err == nil {
+		t.Error("Accepted an entry with an invalid section ID")
+	}
+	entry = valid
+	entry.CharClass = NumCharClasses
+	if err := entry.Validate(); err == nil {
+		t.Error("Accepted an entry with an invalid class")
+	}
+}
+
+func TestValidatePlaytime(t *testing.T) {
+	fc := NewTestCharacter(t)
+	fc.Character.Playtime = 500 * 3600
+	if err := fc.Character.ValidatePlaytime(1000 * time.Hour); err != nil {
+		t.Errorf("Rejected a reasonable playtime: %v", err)
+	}
+	if err := fc.Character.ValidatePlaytime(100 * time.Hour); err == nil {
+		t.Error("Accepted a playtime over the limit")
+	}
+	if err := fc.Validate(); err != nil {
+		t.Errorf("Character with a reasonable playtime failed validation: %v", err)
+	}
+
+	// More than the game has been out for.
+	fc.Character.Playtime = 0xFFFFFFFF
+	if err := fc.Validate(); err == nil {
+		t.Error("Character with an absurd playtime passed validation")
+	}
+}
+
+func TestGuildcardEntryText(t *testing.T) {
+	fc := NewTestCharacter(t)
+	entry := NewGuildcardEntry(fc)
+	if entry.Guildcard != fc.Guildcard || entry.Name != fc.Name {
+		t.Errorf("Entry is for %d, %q", entry.Guildcard, util.ConvertFromUtf16(entry.Name[:]))
+	}
+	if entry.GetDescription() != "" || entry.GetComment() != "" {
+		t.Error("New entry has text in its description or comment")
+	}
+
+	if err := entry.SetDescription("\tEHunter for hire"); err != nil {
+		t.Fatal(err)
+	}
+	if err := entry.SetComment("Met in Forest\x07 1"); err != nil {
+		t.Fatal(err)
+	}
+	if desc := entry.GetDescription(); desc != "\tEHunter for hire" {
+		t.Errorf("Description is %q", desc)
+	}
+	if comment := entry.GetComment(); comment != "Met in Forest 1" {
+		t.Errorf("Comment is %q", comment)
+	}
+
+	// The fields need room left over for the terminator.
+	longest := strings.Repeat("a", len(entry.Description)-1)
+	if err := entry.SetDescription(longest); err != nil {
+		t.Errorf("Rejected the longest description: %v", err)
+	}
+	if err := entry.SetDescription(longest + "a"); err == nil {
+		t.Error("Set an overlong description")
+	}
+	if err := entry.SetComment(longest + "a"); err == nil {
+		t.Error("Set an overlong comment")
+	}
+	if comment := entry.GetComment(); comment != "Met in Forest 1" {
+		t.Errorf("Rejected comment changed it to %q", comment)
+	}
+}
+
+func TestValidateClassConsistency(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Fomarl))
+	if err := fc.ValidateClassConsistency(); err != nil {
+		t.Errorf("Consistent character failed validation: %v", err)
+	}
+
+	mismatched := *fc
+	mismatched.Class = uint8(Humar)
+	if err := mismatched.ValidateClassConsistency(); err == nil {
+		t.Error("Accepted mismatched classes")
+	}
+	if err := mismatched.Validate(); err == nil {
+		t.Error("Character validation didn't check the class copies")
+	}
+
+	mismatched = *fc
+	mismatched.Character.SectionId = fc.SectionId + 1
+	if err := mismatched.ValidateClassConsistency(); err == nil {
+		t.Error("Accepted mismatched section IDs")
+	}
+}
+
+func TestValidateSymbolChats(t *testing.T) {
+	if err := ValidateSymbolChats(baseSymbolChats); err != nil {
+		t.Fatalf("Default symbol chats failed validation: %v", err)
+	}
+	// Offset of the first face part of the first symbol chat.
+	part := symbolChatPartsStart
+	tests := []struct {
+		name   string
+		modify func(data *[1248]byte)
+		valid  bool
+	}{
+		{"BadUsedFlag", func(data *[1248]byte) { data[symbolChatSize] = 2 }, false},
+		{"XOutOfBounds", func(data *[1248]byte) { data[part], data[part+1] = 0, 0x40 }, false},
+		{"YOutOfBounds", func(data *[1248]byte) { data[part], data[part+2] = 0, 0xFF }, false},
+		{"BadFlags", func(data *[1248]byte) { data[part], data[part+3] = 0, 0x04 }, false},
+		{"Flipped", func(data *[1248]byte) { data[part], data[part+3] = 0, 0x03 }, true},
+		// Anything goes for face parts that aren't shown.
+		{"UnusedPart", func(data *[1248]byte) {
+			data[part], data[part+1], data[part+3] = symbolChatPartUnused, 0xFF, 0xFF
+		}, true},
+	}
+	for _, test := range tests {
+		data := baseSymbolChats
+		test.modify(&data)
+		if err := ValidateSymbolChats(data); test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: accepted tampered symbol chats", test.name)
+		}
+	}
+
+	fc := NewTestCharacter(t)
+	fc.SymbolChats[part], fc.SymbolChats[part+1] = 0, 0x40
+	if err := fc.Validate(); err == nil {
+		t.Error("Character validation didn't check the symbol chats")
+	}
+}
@@ -21,14 +21,20 @@ package main
 
 import (
 	"container/list"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	crypto "github.com/dcrodman/archon/encryption"
 	"github.com/dcrodman/archon/util"
+	"github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client struct intended to be included as part of the client definitions
@@ -58,6 +64,40 @@ type Client struct {
 	gcDataSize uint16
 	config     ClientConfig
 	flag       uint32
+
+	// Character the player selected on the character select screen.
+	character *FullCharacter
+	// Set if character.Bank holds the account's shared bank, in which case
+	// the character's own bank is kept in ownBank.
+	sharedBank bool
+	ownBank    Bank
+	// Language the client is running in.
+	language Language
+
+	// Log for the server the client is connected to.
+	logger *logrus.Logger
+
+	// Token bucket used to limit the rate of incoming packets.
+	packetTokens float64
+	lastPacket   time.Time
+
+	// Time the last packet was received, in Unix nanoseconds. Accessed
+	// atomically since the session sweeper reads it.
+	lastActivity int64
+
+	// Held while encrypting and writing a packet, since packets can be sent
+	// to the client from goroutines other than its own (e.g. broadcasts).
+	sendLock sync.Mutex
+	// Set (atomically) once Close has been called.
+	closed int32
+
+	// When the last ping was sent (Unix nanoseconds) and the round trip
+	// time of the last one answered. Both are accessed atomically.
+	pingSent int64
+	lastRTT  int64
+
+	// Record of the client's packets, if captures are enabled.
+	capture *PacketCapture
 }
 
 func NewClient(conn *net.TCPConn, hdrSize uint16, cCrypt, sCrypt *crypto.PSOCrypt) *Client {
@@ -70,30 +110,112 @@ func NewClient(conn *net.TCPConn, hdrSize uint16, cCrypt, sCrypt *crypto.PSOCryp
 		clientCrypt: cCrypt,
 		serverCrypt: sCrypt,
 		buffer:      make([]byte, 512),
+		language:    LanguageEnglish,
+	}
+	c.touch()
+	if config.DebugMode && config.CaptureDir != "" {
+		capture, err := openCaptureFile(config.CaptureDir, c.ipAddr, c.port)
+		if err != nil {
+			log.Warnf("Failed to start packet capture for %s: %s", c.ipAddr, err.Error())
+		} else {
+			c.capture = capture
+		}
 	}
 	return c
 }
 
+// Add an unencrypted packet to the client's capture, if it has one.
+func (c *Client) capturePacket(dir CaptureDirection, data []byte) {
+	if c.capture == nil || atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+	if err := c.capture.Record(dir, data); err != nil {
+		log.Warnf("Failed to capture packet for %s: %s", c.ipAddr, err.Error())
+	}
+}
+
 func (c *Client) IPAddr() string { return c.ipAddr }
 
+// Set the language used for text sent to the client.
+func (c *Client) SetLanguage(lang Language) { c.language = lang }
+
+func (c *Client) Language() Language { return c.language }
+
+// Log an info message tagged with the client's guildcard (or IP address if
+// they haven't logged in yet) so that one client can be followed through the logs.
+func (c *Client) Logf(format string, args ...interface{}) {
+	logger := c.logger
+	if logger == nil {
+		logger = log
+	}
+	logger.Infof(c.logPrefix()+format, args...)
+}
+
+func (c *Client) logPrefix() string {
+	if c.guildcard != 0 {
+		return fmt.Sprintf("[gc:%d] ", c.guildcard)
+	}
+	return fmt.Sprintf("[ip:%s] ", c.ipAddr)
+}
+
+// Record that the client has just sent a packet.
+func (c *Client) touch() { atomic.StoreInt64(&c.lastActivity, timeNow().UnixNano()) }
+
+// Returns when the client last sent a packet.
+func (c *Client) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// Record the round trip time of the last ping when its response arrives.
+func (c *Client) handlePong() {
+	if sent := atomic.SwapInt64(&c.pingSent, 0); sent != 0 {
+		atomic.StoreInt64(&c.lastRTT, timeNow().UnixNano()-sent)
+	}
+}
+
+// Returns the round trip time of the last ping the client answered, or 0
+// if it hasn't answered one.
+func (c *Client) LastRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.lastRTT))
+}
+
 func (c *Client) ClientVector() []uint8 { return c.clientCrypt.Vector }
 
 func (c *Client) ServerVector() []uint8 { return c.serverCrypt.Vector }
 
 func (c *Client) Data() []byte { return c.buffer }
 
-func (c *Client) Close() { c.conn.Close() }
+func (c *Client) Close() {
+	atomic.StoreInt32(&c.closed, 1)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.capture != nil {
+		c.capture.Close()
+	}
+}
 
+// Returns an error rather than writing to the connection if the client has
+// already been disconnected, since handlers can race with the disconnect.
 func (c *Client) Send(data []byte) error {
+	if c.conn == nil || atomic.LoadInt32(&c.closed) != 0 {
+		return errors.New("Client is disconnected")
+	}
 	_, err := c.conn.Write(data)
 	return err
 }
 
 func (c *Client) Encrypt(data []byte, size uint32) {
+	if cryptoDisabled() {
+		return
+	}
 	c.serverCrypt.Encrypt(data, size)
 }
 
 func (c *Client) Decrypt(data []byte, size uint32) {
+	if cryptoDisabled() {
+		return
+	}
 	c.clientCrypt.Decrypt(data, size)
 }
 
@@ -106,31 +228,32 @@ func (c *Client) Process() error {
 	// Wait for the packet header.
 	for c.recvSize < hdrint {
 		bytes, err := c.conn.Read(c.buffer[c.recvSize:c.hdrSize])
-		if bytes == 0 || err == io.EOF {
+		c.recvSize += bytes
+		if err == io.EOF && c.recvSize == 0 {
 			// The client disconnected, we're done.
-			return err
-		} else if err != nil {
+			return io.EOF
+		} else if err == io.EOF && c.recvSize < hdrint {
+			// The client disconnected partway through the header.
+			return io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF {
 			fmt.Println("Sockt error")
 			// Socket error, nothing we can do now.
 			return errors.New("Socket Error (" + c.ipAddr + ") " + err.Error())
 		}
-		c.recvSize += bytes
-
-		if c.recvSize >= hdrint {
-			// We have our header; decrypt it.
-			c.Decrypt(c.buffer[:c.hdrSize], uint32(c.hdrSize))
-			c.packetSize, err = util.GetPacketSize(c.buffer[:2])
-			if err != nil {
-				// Something is seriously wrong if this causes an error. Bail.
-				panic(err.Error())
-			}
-			// PSO likes to occasionally send us packets that are longer than their declared
-			// size, but are always a multiple of the length of the packet header. Adjust the
-			// expected length just in case in order to avoid leaving stray bytes in the buffer.
-			for c.packetSize%c.hdrSize != 0 {
-				c.packetSize++
-			}
-		}
+	}
+	// We have our header; decrypt it.
+	c.Decrypt(c.buffer[:c.hdrSize], uint32(c.hdrSize))
+	var err error
+	c.packetSize, err = util.GetPacketSize(c.buffer[:2])
+	if err != nil {
+		// Something is seriously wrong if this causes an error. Bail.
+		panic(err.Error())
+	}
+	// PSO likes to occasionally send us packets that are longer than their declared
+	// size, but are always a multiple of the length of the packet header. Adjust the
+	// expected length just in case in order to avoid leaving stray bytes in the buffer.
+	for c.packetSize%c.hdrSize != 0 {
+		c.packetSize++
 	}
 	pktSize := int(c.packetSize)
 
@@ -146,19 +269,72 @@ func (c *Client) Process() error {
 	for c.recvSize < pktSize {
 		remaining := pktSize - c.recvSize
 		bytes, err := c.conn.Read(c.buffer[c.recvSize : c.recvSize+remaining])
-		if err != nil {
+		c.recvSize += bytes
+		if err == io.EOF && c.recvSize < pktSize {
+			return io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF {
 			return errors.New("Socket Error (" + c.ipAddr + ") " + err.Error())
 		}
-		c.recvSize += bytes
 	}
 
 	// We have the whole thing; decrypt the rest of it.
 	if c.packetSize > c.hdrSize {
 		c.Decrypt(c.buffer[c.hdrSize:c.packetSize], uint32(c.packetSize-c.hdrSize))
 	}
+	c.capturePacket(CaptureReceived, c.buffer[:c.packetSize])
 	return nil
 }
 
+// Block until a whole packet has been read from the client and return a
+// decrypted copy of it, padded to a multiple of the header size. Returns
+// io.EOF if the client disconnected between packets or io.ErrUnexpectedEOF
+// if it disconnected partway through one.
+func ReceivePacket(client *Client) ([]byte, error) {
+	if err := client.Process(); err != nil {
+		return nil, err
+	}
+	pkt := make([]byte, client.packetSize)
+	copy(pkt, client.buffer)
+	return pkt, nil
+}
+
+// Returns false if the client has sent more than maxPerSecond packets per
+// second (allowing bursts of up to that many). A limit of 0 disables the check.
+func (c *Client) allowPacket(maxPerSecond int) bool {
+	if maxPerSecond <= 0 {
+		return true
+	}
+	now := timeNow()
+	limit := float64(maxPerSecond)
+	if c.lastPacket.IsZero() {
+		c.packetTokens = limit
+	} else {
+		c.packetTokens += now.Sub(c.lastPacket).Seconds() * limit
+		if c.packetTokens > limit {
+			c.packetTokens = limit
+		}
+	}
+	c.lastPacket = now
+	if c.packetTokens < 1 {
+		return false
+	}
+	c.packetTokens--
+	return true
+}
+
+// Returns true if the security data the client echoed back (the Security
+// field of its login packet) was issued by the login server for the
+// guildcard it logged in with. A mismatch means the client skipped the
+// login server or is replaying another player's session.
+func (c *Client) ValidateSecurityData(received []byte) bool {
+	var echoed ClientConfig
+	if util.StructFromBytes(received, &echoed) != nil {
+		return false
+	}
+	token, ok := sessions.Token(c.guildcard)
+	return ok && echoed.Magic == ClientConfigMagic && echoed.SessionToken == token
+}
+
 // Synchronized list for maintaining a list of connected clients.
 type ConnList struct {
 	clientList *list.List
@@ -212,3 +388,141 @@ func (cl *ConnList) Count() int {
 	cl.RUnlock()
 	return length
 }
+
+// Synchronized map of guildcards to the client logged in with each one.
+type SessionList struct {
+	sessions map[uint32]*Client
+	// Security tokens issued by the login server, by guildcard.
+	tokens map[uint32]uint32
+	sync.Mutex
+}
+
+var sessions = NewSessionList()
+
+func NewSessionList() *SessionList {
+	return &SessionList{
+		sessions: make(map[uint32]*Client),
+		tokens:   make(map[uint32]uint32),
+	}
+}
+
+// Generate a random security token for guildcard, replacing any issued by
+// an earlier login. The client hands it back when it connects to the
+// character server.
+func (sl *SessionList) IssueToken(guildcard uint32) uint32 {
+	var token uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &token)
+	sl.Lock()
+	sl.tokens[guildcard] = token
+	sl.Unlock()
+	return token
+}
+
+// Returns the last security token issued for guildcard, if there is one.
+func (sl *SessionList) Token(guildcard uint32) (uint32, bool) {
+	sl.Lock()
+	defer sl.Unlock()
+	token, ok := sl.tokens[guildcard]
+	return token, ok
+}
+
+// Registers c as the session for its guildcard. If another client is already
+// logged in with the same guildcard then either that client is disconnected
+// (if kickExisting is set) or c is not added and an error is returned.
+func (sl *SessionList) Add(c *Client, kickExisting bool) error {
+	sl.Lock()
+	defer sl.Unlock()
+	if existing, ok := sl.sessions[c.guildcard]; ok && existing != c {
+		if !kickExisting {
+			return errors.New("Guildcard " + strconv.FormatUint(uint64(c.guildcard), 10) +
+				" is already logged in")
+		}
+		existing.Close()
+	}
+	sl.sessions[c.guildcard] = c
+	return nil
+}
+
+// Moves the session for c's guildcard over to c, which has just connected
+// to another server with the session's security token. Unlike Add, the
+// client currently holding the session isn't treated as a conflict since
+// it's the same player on its way off of the previous server.
+func (sl *SessionList) Handoff(c *Client) {
+	sl.Lock()
+	sl.sessions[c.guildcard] = c
+	sl.Unlock()
+}
+
+// Returns the client logged in with guildcard, if there is one.
+func (sl *SessionList) Find(guildcard uint32) (*Client, bool) {
+	sl.Lock()
+	defer sl.Unlock()
+	c, ok := sl.sessions[guildcard]
+	return c, ok
+}
+
+// Removes c's session if it's still the one registered for its guildcard.
+func (sl *SessionList) Remove(c *Client) {
+	sl.Lock()
+	if sl.sessions[c.guildcard] == c {
+		delete(sl.sessions, c.guildcard)
+	}
+	sl.Unlock()
+}
+
+// Returns the clients that are currently logged in.
+func (sl *SessionList) Clients() []*Client {
+	sl.Lock()
+	clients := make([]*Client, 0, len(sl.sessions))
+	for _, c := range sl.sessions {
+		clients = append(clients, c)
+	}
+	sl.Unlock()
+	return clients
+}
+
+// Disconnect and remove every session that hasn't sent a packet within
+// timeout, returning the number removed. Clients that crash without closing
+// their connection would otherwise keep their account locked.
+func (sl *SessionList) SweepStale(timeout time.Duration) int {
+	cutoff := timeNow().Add(-timeout)
+	removed := 0
+	sl.Lock()
+	for gc, c := range sl.sessions {
+		if c.LastActivity().Before(cutoff) {
+			c.Logf("Disconnecting stale session")
+			c.Close()
+			delete(sl.sessions, gc)
+			removed++
+		}
+	}
+	sl.Unlock()
+	return removed
+}
+
+// Periodically sweep sessions that have been idle for longer than timeout.
+// The remaining sessions are pinged so that idle but connected players
+// stay active and their latency is measured. Returns a function that stops
+// the sweeper.
+func (sl *SessionList) StartSweeper(timeout time.Duration) func() error {
+	done := make(chan struct{})
+	ticker := time.NewTicker(timeout / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sl.SweepStale(timeout)
+				for _, c := range sl.Clients() {
+					c.SendPing()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return nil
+	}
+}
@@ -0,0 +1,485 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	crypto "github.com/dcrodman/archon/encryption"
+	"github.com/dcrodman/archon/util"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a BB client connected over loopback to a peer standing in for the
+// game. The peer's ciphers mirror the client's, so packets sent to the
+// client can be read with ReceivePacket(peer) and packets sent from the peer
+// with sendEncrypted arrive at the client as if the game had sent them.
+func newTestClientPair(t *testing.T) (c, peer *Client) {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peerConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = newBBClient(conn)
+	peerClientCrypt, _ := crypto.NewBBCryptFromVector(c.serverCrypt.Vector)
+	peerServerCrypt, _ := crypto.NewBBCryptFromVector(c.clientCrypt.Vector)
+	peer = NewClient(peerConn, BBHeaderSize, peerClientCrypt, peerServerCrypt)
+	// Nothing should block for long; fail instead of hanging the tests.
+	deadline := time.Now().Add(5 * time.Second)
+	conn.SetDeadline(deadline)
+	peerConn.SetDeadline(deadline)
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return c, peer
+}
+
+// Send pkt from the peer and have c read it, as the dispatcher would before
+// calling a handler.
+func deliverPacket(t *testing.T, c, peer *Client, pkt interface{}) {
+	t.Helper()
+	data, size := util.BytesFromStruct(pkt)
+	if sendEncrypted(peer, data, uint16(size)) != 0 {
+		t.Fatal("Failed to send packet")
+	}
+	if err := c.Process(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read the next packet sent to peer, failing unless it has type pktType.
+func expectPacket(t *testing.T, peer *Client, pktType uint16) []byte {
+	t.Helper()
+	pkt, err := ReceivePacket(peer)
+	if err != nil {
+		t.Fatalf("Expected packet %02x: %s", pktType, err.Error())
+	}
+	if got := binary.LittleEndian.Uint16(pkt[2:]); got != pktType {
+		t.Fatalf("Received packet %02x; expected %02x", got, pktType)
+	}
+	return pkt
+}
+
+// Read the next packet sent to peer, which must be a client message, and
+// return its text.
+func expectClientMessage(t *testing.T, peer *Client) string {
+	t.Helper()
+	pkt := expectPacket(t, peer, LoginClientMessageType)
+	return util.ConvertFromUtf16(util.CompressUtf16(pkt[12:]))
+}
+
+func TestSessionListFind(t *testing.T) {
+	sl := NewSessionList()
+	c := &Client{guildcard: 42000001}
+	if err := sl.Add(c, false); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := sl.Find(42000001); !ok || found != c {
+		t.Error("Registered client wasn't found")
+	}
+	if _, ok := sl.Find(42000002); ok {
+		t.Error("Found a client for a guildcard that isn't logged in")
+	}
+}
+
+func TestSendDisconnectReason(t *testing.T) {
+	c, peer := newTestClientPair(t)
+	if c.SendDisconnectReason(DisconnectServerFull) != 0 {
+		t.Fatal("Failed to send disconnect")
+	}
+	if msg := expectClientMessage(t, peer); msg != disconnectMessages[DisconnectServerFull] {
+		t.Errorf("Sent message %q", msg)
+	}
+	pkt := expectPacket(t, peer, DisconnectType)
+	if reason := DisconnectReason(binary.LittleEndian.Uint32(pkt[4:])); reason != DisconnectServerFull {
+		t.Errorf("Sent reason %d; expected %d", reason, DisconnectServerFull)
+	}
+
+	// Reasons without a message only send the disconnect.
+	if c.SendDisconnectReason(DisconnectNone) != 0 {
+		t.Fatal("Failed to send disconnect")
+	}
+	expectPacket(t, peer, DisconnectType)
+}
+
+func TestClientLogf(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	c := &Client{ipAddr: "127.0.0.1", logger: logger}
+
+	c.Logf("Connected")
+	if out := buf.String(); !strings.Contains(out, "[ip:127.0.0.1] Connected") {
+		t.Errorf("Log output %q isn't tagged with the client's address", out)
+	}
+	buf.Reset()
+	c.guildcard = 12345678
+	c.Logf("Logged in as %s", "player")
+	if out := buf.String(); !strings.Contains(out, "[gc:12345678] Logged in as player") {
+		t.Errorf("Log output %q isn't tagged with the client's guildcard", out)
+	}
+}
+
+func TestAllowPacket(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	oldNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = oldNow })
+
+	// Ten packets a second spread evenly never runs out of tokens.
+	normal := new(Client)
+	for i := 0; i < 50; i++ {
+		if !normal.allowPacket(10) {
+			t.Fatalf("Packet %d from a client within the limit was refused", i)
+		}
+		now = now.Add(100 * time.Millisecond)
+	}
+
+	// A burst up to the limit is allowed but anything past it isn't.
+	fast := new(Client)
+	for i := 0; i < 10; i++ {
+		if !fast.allowPacket(10) {
+			t.Fatalf("Packet %d of a burst was refused", i)
+		}
+	}
+	if fast.allowPacket(10) {
+		t.Error("Client exceeding the limit wasn't refused")
+	}
+	if !fast.allowPacket(0) {
+		t.Error("Packet was refused with the limit disabled")
+	}
+}
+
+func TestSendTimestamp(t *testing.T) {
+	oldNow := timeNow
+	timeNow = func() time.Time { return time.Date(2014, 3, 5, 7, 8, 9, 123e6, time.UTC) }
+	t.Cleanup(func() { timeNow = oldNow })
+
+	c, peer := newTestClientPair(t)
+	if c.SendTimestamp() != 0 {
+		t.Fatal("Failed to send timestamp")
+	}
+	pkt := expectPacket(t, peer, LoginTimestampType)
+	expected := []byte("2014:03:05: 07:08:09.123\x00\x00\x00\x00")
+	if got := pkt[8:36]; !bytes.Equal(got, expected) {
+		t.Errorf("Sent timestamp %q; expected %q", got, expected)
+	}
+}
+
+func TestSendShipRedirect(t *testing.T) {
+	c, peer := newTestClientPair(t)
+	if c.SendShipRedirect(ShipConfig{Name: "Second", Host: "192.168.1.20", Port: "15001"}) != 0 {
+		t.Fatal("Failed to send redirect")
+	}
+	var pkt RedirectPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, RedirectType), &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.IPAddr != [4]uint8{192, 168, 1, 20} || pkt.Port != 15001 {
+		t.Errorf("Redirected to %v:%d; expected 192.168.1.20:15001", pkt.IPAddr, pkt.Port)
+	}
+
+	if c.SendShipRedirect(ShipConfig{Name: "Broken", Host: "192.168.1.20", Port: "70000"}) == 0 {
+		t.Error("Sent a redirect to an invalid port")
+	}
+}
+
+func TestSweepStale(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	oldNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = oldNow })
+
+	sl := NewSessionList()
+	stale, _ := newTestClientPair(t)
+	stale.guildcard = 42000001
+	stale.touch()
+	now = now.Add(4 * time.Minute)
+	active, _ := newTestClientPair(t)
+	active.guildcard = 42000002
+	active.touch()
+	for _, c := range []*Client{stale, active} {
+		if err := sl.Add(c, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+	if removed := sl.SweepStale(5 * time.Minute); removed != 1 {
+		t.Errorf("Swept %d sessions; expected 1", removed)
+	}
+	if _, ok := sl.Find(stale.guildcard); ok {
+		t.Error("Stale session wasn't removed")
+	}
+	if _, ok := sl.Find(active.guildcard); !ok {
+		t.Error("Active session was removed")
+	}
+	// The account can log in again now that its session is gone.
+	if err := sl.Add(&Client{guildcard: stale.guildcard}, false); err != nil {
+		t.Errorf("Couldn't log in after the stale session was swept: %s", err.Error())
+	}
+}
+
+func TestSendToDisconnectedClient(t *testing.T) {
+	noConn := &Client{hdrSize: BBHeaderSize, serverCrypt: crypto.NewBBCrypt()}
+	if err := noConn.Send(make([]byte, 8)); err == nil {
+		t.Error("Sent to a client without a connection")
+	}
+	if noConn.SendClientMessage("Hello") == 0 {
+		t.Error("Sending to a client without a connection succeeded")
+	}
+
+	closed, _ := newTestClientPair(t)
+	closed.Close()
+	if err := closed.Send(make([]byte, 8)); err == nil {
+		t.Error("Sent to a closed client")
+	}
+	if closed.SendClientMessage("Hello") == 0 {
+		t.Error("Sending to a closed client succeeded")
+	}
+}
+
+func TestValidateSecurityData(t *testing.T) {
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+
+	c := &Client{guildcard: 42000001}
+	echo := func(magic, token uint32) []byte {
+		data, _ := util.BytesFromStruct(&ClientConfig{Magic: magic, SessionToken: token})
+		return data
+	}
+	if c.ValidateSecurityData(echo(ClientConfigMagic, 1)) {
+		t.Error("Accepted security data without an issued session")
+	}
+
+	token := sessions.IssueToken(c.guildcard)
+	if !c.ValidateSecurityData(echo(ClientConfigMagic, token)) {
+		t.Error("Rejected the security data issued by the login server")
+	}
+	if c.ValidateSecurityData(echo(ClientConfigMagic, token+1)) {
+		t.Error("Accepted security data with the wrong token")
+	}
+	if c.ValidateSecurityData(echo(0, token)) {
+		t.Error("Accepted security data without the magic value")
+	}
+	if c.ValidateSecurityData(echo(ClientConfigMagic, token)[:4]) {
+		t.Error("Accepted truncated security data")
+	}
+	other := &Client{guildcard: 42000002}
+	if other.ValidateSecurityData(echo(ClientConfigMagic, token)) {
+		t.Error("Accepted another guildcard's security data")
+	}
+}
+
+func TestSendKeyConfig(t *testing.T) {
+	fc := NewTestCharacter(t)
+	for i := range fc.KeyConfig.KeyConfig {
+		fc.KeyConfig.KeyConfig[i] = byte(i)
+	}
+	for i := range fc.KeyConfig.JoystickConfig {
+		fc.KeyConfig.JoystickConfig[i] = byte(0x80 + i)
+	}
+
+	c, peer := newTestClientPair(t)
+	c.guildcard = 42000001
+	if c.SendKeyConfig(fc) != 0 {
+		t.Fatal("Failed to send key config")
+	}
+	pkt := expectPacket(t, peer, LoginOptionsType)
+	// The key config follows the header and the unknown leading section.
+	keys := 8 + len(fc.KeyConfig.Unknown)
+	joystick := keys + len(fc.KeyConfig.KeyConfig)
+	guildcard := joystick + len(fc.KeyConfig.JoystickConfig)
+	if got := pkt[keys:joystick]; !bytes.Equal(got, fc.KeyConfig.KeyConfig[:]) {
+		t.Errorf("Sent key config % x", got)
+	}
+	if got := pkt[joystick:guildcard]; !bytes.Equal(got, fc.KeyConfig.JoystickConfig[:]) {
+		t.Errorf("Sent joystick config % x", got)
+	}
+	if got := binary.LittleEndian.Uint32(pkt[guildcard:]); got != 42000001 {
+		t.Errorf("Sent guildcard %d; expected 42000001", got)
+	}
+}
+
+func TestPadPacket(t *testing.T) {
+	for _, length := range []int{8, 9, 12, 15, 16, 20, 511} {
+		payload := make([]byte, length)
+		for i := 4; i < length; i++ {
+			payload[i] = 0xAA
+		}
+		padded := PadPacket(payload)
+		expected := (length + 7) / 8 * 8
+		if len(padded) != expected {
+			t.Errorf("%d byte payload padded to %d bytes; expected %d", length, len(padded), expected)
+			continue
+		}
+		if size := binary.LittleEndian.Uint16(padded); int(size) != expected {
+			t.Errorf("%d byte payload has size %d; expected %d", length, size, expected)
+		}
+		if !bytes.Equal(padded[4:length], payload[4:length]) {
+			t.Errorf("%d byte payload was changed by padding", length)
+		}
+		if tail := padded[length:]; !bytes.Equal(tail, make([]byte, len(tail))) {
+			t.Errorf("%d byte payload was padded with % x", length, tail)
+		}
+	}
+}
+
+func TestSendTeamStatus(t *testing.T) {
+	fc := NewTestCharacter(t)
+	fc.KeyConfig.TeamId = 77
+	fc.KeyConfig.TeamPrivilegeLevel = 0x40
+	if err := fc.SetTeamName("\tERangers"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range fc.KeyConfig.TeamFlag {
+		fc.KeyConfig.TeamFlag[i] = byte(i)
+	}
+
+	c, peer := newTestClientPair(t)
+	if c.SendTeamStatus(fc) != 0 {
+		t.Fatal("Failed to send team status")
+	}
+	var pkt TeamStatusPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, TeamStatusType), &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Guildcard != fc.Guildcard || pkt.TeamId != 77 || pkt.TeamPrivilegeLevel != 0x40 {
+		t.Errorf("Sent guildcard %d, team %d, privilege %02x", pkt.Guildcard, pkt.TeamId, pkt.TeamPrivilegeLevel)
+	}
+	if name := util.ConvertFromUtf16(pkt.Teamname[:]); name != "\tERangers" {
+		t.Errorf("Sent team name %q", name)
+	}
+	if pkt.TeamFlag != fc.KeyConfig.TeamFlag {
+		t.Error("Sent team flag doesn't match the character's")
+	}
+}
+
+// Encrypt a packet from peer with the given declared size, padded out to a
+// multiple of the header size, without sending it.
+func encryptTestPacket(peer *Client, size uint16) []byte {
+	data := make([]byte, (int(size)+7)/8*8)
+	binary.LittleEndian.PutUint16(data, size)
+	binary.LittleEndian.PutUint16(data[2:], 0x60)
+	for i := BBHeaderSize; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	peer.Encrypt(data, uint32(len(data)))
+	return data
+}
+
+func TestReceivePacketPartialReads(t *testing.T) {
+	c, peer := newTestClientPair(t)
+	// Declared size isn't a multiple of 8, so the padding is read too.
+	data := encryptTestPacket(peer, 0x14)
+	go func() {
+		for i := 0; i < len(data); i += 3 {
+			end := i + 3
+			if end > len(data) {
+				end = len(data)
+			}
+			peer.conn.Write(data[i:end])
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	pkt, err := ReceivePacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkt) != 24 || binary.LittleEndian.Uint16(pkt) != 0x14 {
+		t.Fatalf("Received % x", pkt)
+	}
+	for i := BBHeaderSize; i < len(pkt); i++ {
+		if pkt[i] != byte(i) {
+			t.Fatalf("Byte %d decrypted to %02x", i, pkt[i])
+		}
+	}
+}
+
+func TestReceivePacketDisconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		sent int
+		err  error
+	}{
+		{"BetweenPackets", 0, io.EOF},
+		{"InHeader", 4, io.ErrUnexpectedEOF},
+		{"InBody", 12, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		c, peer := newTestClientPair(t)
+		data := encryptTestPacket(peer, 0x18)
+		peer.conn.Write(data[:test.sent])
+		peer.conn.Close()
+		if _, err := ReceivePacket(c); err != test.err {
+			t.Errorf("%s: got error %v; expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestBuildE7Packet(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems(), WithBank())
+	fc.KeyConfig.TeamRewards[1] = 0xDEADBEEF
+	pkt, err := BuildE7Packet(fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0x399C isn't a multiple of 8, so the packet is padded.
+	if len(pkt) != 0x39A8 || binary.LittleEndian.Uint16(pkt) != 0x39A8 {
+		t.Fatalf("Packet is %d bytes with size %d; expected %d", len(pkt), binary.LittleEndian.Uint16(pkt), 0x39A8)
+	}
+	if pktType := binary.LittleEndian.Uint16(pkt[2:]); pktType != LoginFullCharacterType {
+		t.Errorf("Packet has type %02x", pktType)
+	}
+	payload := pkt[8 : 8+fullCharacterSize]
+	// The guildcard comes after the inventory, character, and bank sections.
+	guildcard := binary.Size(fc.Inventory) + binary.Size(fc.Character) + len(fc.Unknown) + 4 +
+		len(fc.QuestData1) + binary.Size(fc.Bank)
+	if gc := binary.LittleEndian.Uint32(payload[guildcard:]); gc != fc.Guildcard {
+		t.Errorf("Guildcard at %04x is %d; expected %d", guildcard, gc, fc.Guildcard)
+	}
+	// The key config is last.
+	if last := binary.LittleEndian.Uint32(payload[fullCharacterSize-4:]); last != 0xDEADBEEF {
+		t.Errorf("Payload ends with %08x; expected the team rewards", last)
+	}
+
+	decoded := new(FullCharacter)
+	if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *fc {
+		t.Error("Payload doesn't decode back to the character")
+	}
+}
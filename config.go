@@ -23,6 +23,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -30,14 +32,21 @@ import (
 	"github.com/dcrodman/archon/util"
 	_ "github.com/go-sql-driver/mysql"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Configuration structure that can be shared between sub servers.
 // The fields are intentionally exported to cut down on verbosity
-// with the intent that they be considered immutable.
+// with the intent that they be considered immutable. The exception is the
+// settings in ConfigView, which Reload can change while the server is
+// running and so should only be read through Snapshot.
 type Config struct {
 	Hostname string
 	// Patch ports.
@@ -57,6 +66,16 @@ type Config struct {
 	// Number of lobbies available per block.
 	NumLobbies     int
 	MaxConnections int
+	// Whether logging in to an account that's already online disconnects the
+	// existing session (true) or turns away the new one (false).
+	KickExistingSession bool
+	// Clients sending packets faster than this are disconnected; 0 to disable.
+	MaxPacketsPerSecond int
+	// Seconds a logged in client can go without sending a packet before its
+	// session is considered stale and disconnected; 0 to disable.
+	SessionTimeout int
+	// Seconds between writes of queued character saves; 0 to save immediately.
+	SaveInterval int
 
 	// Patch server welcome message.
 	WelcomeMessage string
@@ -64,10 +83,23 @@ type Config struct {
 	ScrollMessage string
 	MessageBytes  []byte
 	MessageSize   uint16
+	// Message box shown when a player reaches the character select screen.
+	MOTD string
+	// Translations of MOTD keyed by language name (e.g. "Japanese"), used
+	// for clients running in that language.
+	LocalizedMOTD map[string]string
 
 	PatchDir      string
 	ParametersDir string
 	KeysDir       string
+	// Optional JSON file overriding the per-class stat tables.
+	StatTablesFile string
+	// Optional item table used to validate items: either the client's
+	// ItemPMT.prs or a JSON file with per-item limits and names.
+	ItemTableFile string
+	// Classes (e.g. "HUmar") that new characters can be created as; all
+	// classes are allowed if empty.
+	AllowedClasses []string
 
 	// Database parameters.
 	database   *sql.DB
@@ -76,48 +108,115 @@ type Config struct {
 	DBName     string
 	DBUsername string
 	DBPassword string
+	// Queries made while handling a packet are cancelled after this long.
+	DBQueryTimeoutSeconds int
 
 	Logfile   string
 	LogLevel  string
 	DebugMode bool
+	// Send and receive packets unencrypted so that traffic can be read
+	// with a patched client. Only honored in DebugMode and never in
+	// builds with the release tag.
+	DebugDisableCrypto bool
+	// Directory to write a capture of each client's unencrypted packets to
+	// (see capture.go). Only honored in DebugMode.
+	CaptureDir string
+	// Separate log files for individual servers, keyed by server name (e.g.
+	// "LOGIN" or "CHARACTER"). Servers not listed log to Logfile.
+	ComponentLogfiles map[string]string
+	// Identical log messages repeated within this many seconds are collapsed
+	// into a single line with a repeat count; 0 to log every message.
+	LogRepeatWindow int
+	// Secret mixed into the account IDs from AccountLogID so that they
+	// can't be reversed by hashing every guildcard.
+	LogIDSalt string
+
+	// Checksum expected from unmodified clients and whether clients that
+	// send anything else should be turned away.
+	ClientChecksum        uint32
+	RejectModifiedClients bool
 
 	// Ship server config.
 	ShipName string
+	// Other ships to list on the ship select menu after the built-in one.
+	Ships []ShipConfig
+
+	// Optional features to turn on or off, keyed by name (e.g. "mail").
+	// Features not listed use their entry in defaultFeatures.
+	Features map[string]bool
+	// Guards the settings that can be changed by Reload.
+	reloadLock sync.RWMutex
 
 	cachedHostBytes [4]byte
 	cachedScrollMsg []byte
+
+	// Cleanup performed by Close.
+	closers   []func() error
+	closed    bool
+	closeLock sync.Mutex
+}
+
+// Address of a ship players can be sent to from the ship select menu.
+type ShipConfig struct {
+	Name string
+	Host string
+	Port string
+}
+
+// Names of the optional features that can be toggled in Config.Features.
+const (
+	FeatureMail          = "mail"
+	FeatureSharedBank    = "shared_bank"
+	FeatureChallengeMode = "challenge_mode"
+)
+
+// Whether each feature is enabled when the config doesn't mention it.
+var defaultFeatures = map[string]bool{
+	FeatureMail:          true,
+	FeatureSharedBank:    false,
+	FeatureChallengeMode: true,
 }
 
 // Singleton instance. Provides reasonable default values so
 // that some configurations can remain simpler.
-var config *Config = &Config{
-	Hostname:       "127.0.0.1",
-	PatchPort:      "11000",
-	DataPort:       "11001",
-	LoginPort:      "12000",
-	CharacterPort:  "12001",
-	ShipgatePort:   "13000",
-	WebPort:        "14000",
-	ShipPort:       "15000",
-	NumBlocks:      2,
-	NumLobbies:     15,
-	MaxConnections: 30000,
-
-	ShipName:       "Unconfigured",
-	WelcomeMessage: "Unconfigured Welcome Message",
-	ScrollMessage:  "Add a welcome message here",
-
-	PatchDir:      "patches/",
-	ParametersDir: "parameters/",
-	KeysDir:       "keys/",
-
-	DBHost: "127.0.0.1",
-	DBPort: "3306",
-	DBName: "archondb",
-
-	Logfile:   "",
-	LogLevel:  "warn",
-	DebugMode: false,
+var config *Config = defaultConfig()
+
+// Returns a Config with the default values that the config file overrides.
+func defaultConfig() *Config {
+	return &Config{
+		Hostname:       "127.0.0.1",
+		PatchPort:      "11000",
+		DataPort:       "11001",
+		LoginPort:      "12000",
+		CharacterPort:  "12001",
+		ShipgatePort:   "13000",
+		WebPort:        "14000",
+		ShipPort:       "15000",
+		NumBlocks:      2,
+		NumLobbies:     15,
+		MaxConnections: 30000,
+
+		KickExistingSession: true,
+
+		ShipName:       "Unconfigured",
+		WelcomeMessage: "Unconfigured Welcome Message",
+		ScrollMessage:  "Add a welcome message here",
+
+		PatchDir:      "patches/",
+		ParametersDir: "parameters/",
+		KeysDir:       "keys/",
+
+		DBHost: "127.0.0.1",
+		DBPort: "3306",
+		DBName: "archondb",
+
+		DBQueryTimeoutSeconds: 30,
+
+		Logfile:         "",
+		LogLevel:        "warn",
+		LogRepeatWindow: 5,
+		DebugMode:       false,
+	}
 }
 
 func GetConfig() *Config { return config }
@@ -150,6 +249,125 @@ func (config *Config) InitFromFile(fileName string) error {
 	return nil
 }
 
+// Write an example config to path with every setting filled in, using
+// the defaults where there are any and placeholders describing what to
+// fill in otherwise.
+func (config *Config) GenerateExample(path string) error {
+	example := defaultConfig()
+	example.DBUsername = "<database user>"
+	example.DBPassword = "<database password>"
+	example.MOTD = "<message shown on the character select screen>"
+	example.LogIDSalt = "<random string used to anonymize account IDs in logs>"
+
+	data, err := json.Marshal(example)
+	if err != nil {
+		return err
+	}
+	// Leave out the fields that are computed from the others.
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "MessageBytes")
+	delete(fields, "MessageSize")
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(fields); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Check that the fields the server can't run without have been set and that
+// the ports are valid and distinct, so that a bad config fails with a clear
+// message instead of an obscure driver or net.Listen error.
+func (config *Config) Validate() error {
+	required := []struct{ name, value string }{
+		{"Hostname", config.Hostname},
+		{"DBHost", config.DBHost},
+		{"DBPort", config.DBPort},
+		{"DBName", config.DBName},
+		{"DBUsername", config.DBUsername},
+	}
+	// Report everything that's missing at once so that a new config can be
+	// fixed in one pass.
+	var missing []string
+	for _, field := range required {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("Missing required settings: " + strings.Join(missing, ", "))
+	}
+
+	ports := []struct{ name, value string }{
+		{"PatchPort", config.PatchPort},
+		{"DataPort", config.DataPort},
+		{"LoginPort", config.LoginPort},
+		{"CharacterPort", config.CharacterPort},
+		{"ShipgatePort", config.ShipgatePort},
+		{"WebPort", config.WebPort},
+		{"ShipPort", config.ShipPort},
+		{"DBPort", config.DBPort},
+	}
+	// Ports the server listens on, including the ones for each block.
+	used := make(map[int]string)
+	for _, field := range ports {
+		port, err := strconv.Atoi(field.value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%s must be a port number between 1 and 65535, got %q",
+				field.name, field.value)
+		}
+		if field.name == "DBPort" {
+			// Belongs to the database server, not us.
+			continue
+		}
+		if other, ok := used[port]; ok {
+			return fmt.Errorf("%s and %s are both set to %d", other, field.name, port)
+		}
+		used[port] = field.name
+	}
+	shipPort, _ := strconv.Atoi(config.ShipPort)
+	for i := 1; i <= config.NumBlocks; i++ {
+		name := fmt.Sprintf("Block %d (ShipPort + %d)", i, i)
+		if port := shipPort + i; port > 65535 {
+			return fmt.Errorf("%s would be %d, which is out of range", name, port)
+		} else if other, ok := used[port]; ok {
+			return fmt.Errorf("%s and %s are both set to %d", other, name, port)
+		}
+		used[shipPort+i] = name
+	}
+	if config.RejectModifiedClients && config.ClientChecksum == 0 {
+		// Every client would be turned away.
+		return errors.New("RejectModifiedClients is set but ClientChecksum isn't")
+	}
+	return config.checkLogfiles()
+}
+
+// Make sure each of the log files can be opened for writing so that
+// permission problems show up at startup instead of as missing logs.
+func (config *Config) checkLogfiles() error {
+	files := []string{config.Logfile}
+	for _, file := range config.ComponentLogfiles {
+		files = append(files, file)
+	}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return fmt.Errorf("Log file %s is not writable: %s", file, err.Error())
+		}
+		f.Close()
+	}
+	return nil
+}
+
 // Establish a connection to the database and ping it to verify.
 func (config *Config) InitDb() error {
 	dbName := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", config.DBUsername,
@@ -167,6 +385,40 @@ func (config *Config) CloseDB() {
 	config.database.Close()
 }
 
+// Register f to be called by Close, e.g. to stop a background goroutine
+// or close a file the server opened based on the config.
+func (config *Config) OnClose(f func() error) {
+	config.closeLock.Lock()
+	config.closers = append(config.closers, f)
+	config.closeLock.Unlock()
+}
+
+// Shut down everything registered with OnClose, most recent first, and
+// then the database. Returns the first error encountered. Only the first
+// call does anything; later calls return nil.
+func (config *Config) Close() error {
+	config.closeLock.Lock()
+	defer config.closeLock.Unlock()
+	if config.closed {
+		return nil
+	}
+	config.closed = true
+
+	var firstErr error
+	for i := len(config.closers) - 1; i >= 0; i-- {
+		if err := config.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	config.closers = nil
+	if config.database != nil {
+		if err := config.database.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Returns a reference to the database so that it can remain
 // encapsulated and any consistency checks can be centralized.
 func (config *Config) DB() *sql.DB {
@@ -178,20 +430,182 @@ func (config *Config) DB() *sql.DB {
 	return config.database
 }
 
+// Returns a context for database queries that's cancelled once
+// DBQueryTimeoutSeconds have passed. A timeout of 0 disables the limit.
+func (config *Config) QueryContext() (context.Context, context.CancelFunc) {
+	if config.DBQueryTimeoutSeconds <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(),
+		time.Duration(config.DBQueryTimeoutSeconds)*time.Second)
+}
+
+// Returns the MOTD in lang if there's a translation for it, otherwise MOTD.
+func (config *Config) MOTDFor(lang Language) string {
+	return config.Snapshot().MOTDFor(lang)
+}
+
+// Returns the names of the settings that differ between config and
+// reloaded that can't be changed without restarting the server, which is
+// everything outside of ConfigView: the ports being listened on, the
+// database connection, logging, and the files loaded on startup.
+func (config *Config) DiffRequiringRestart(reloaded *Config) []string {
+	settings := []struct {
+		name             string
+		current, updated interface{}
+	}{
+		{"Hostname", config.Hostname, reloaded.Hostname},
+		{"PatchPort", config.PatchPort, reloaded.PatchPort},
+		{"DataPort", config.DataPort, reloaded.DataPort},
+		{"LoginPort", config.LoginPort, reloaded.LoginPort},
+		{"CharacterPort", config.CharacterPort, reloaded.CharacterPort},
+		{"ShipgatePort", config.ShipgatePort, reloaded.ShipgatePort},
+		{"WebPort", config.WebPort, reloaded.WebPort},
+		{"ShipPort", config.ShipPort, reloaded.ShipPort},
+		{"NumBlocks", config.NumBlocks, reloaded.NumBlocks},
+		{"NumLobbies", config.NumLobbies, reloaded.NumLobbies},
+		{"MaxConnections", config.MaxConnections, reloaded.MaxConnections},
+		{"SessionTimeout", config.SessionTimeout, reloaded.SessionTimeout},
+		{"SaveInterval", config.SaveInterval, reloaded.SaveInterval},
+		{"WelcomeMessage", config.WelcomeMessage, reloaded.WelcomeMessage},
+		{"ScrollMessage", config.ScrollMessage, reloaded.ScrollMessage},
+		{"PatchDir", config.PatchDir, reloaded.PatchDir},
+		{"ParametersDir", config.ParametersDir, reloaded.ParametersDir},
+		{"KeysDir", config.KeysDir, reloaded.KeysDir},
+		{"StatTablesFile", config.StatTablesFile, reloaded.StatTablesFile},
+		{"ItemTableFile", config.ItemTableFile, reloaded.ItemTableFile},
+		{"DBHost", config.DBHost, reloaded.DBHost},
+		{"DBPort", config.DBPort, reloaded.DBPort},
+		{"DBName", config.DBName, reloaded.DBName},
+		{"DBUsername", config.DBUsername, reloaded.DBUsername},
+		{"DBPassword", config.DBPassword, reloaded.DBPassword},
+		{"DBQueryTimeoutSeconds", config.DBQueryTimeoutSeconds, reloaded.DBQueryTimeoutSeconds},
+		{"Logfile", config.Logfile, reloaded.Logfile},
+		{"LogLevel", config.LogLevel, reloaded.LogLevel},
+		{"DebugMode", config.DebugMode, reloaded.DebugMode},
+		{"DebugDisableCrypto", config.DebugDisableCrypto, reloaded.DebugDisableCrypto},
+		{"CaptureDir", config.CaptureDir, reloaded.CaptureDir},
+		{"ComponentLogfiles", config.ComponentLogfiles, reloaded.ComponentLogfiles},
+		{"LogRepeatWindow", config.LogRepeatWindow, reloaded.LogRepeatWindow},
+		{"LogIDSalt", config.LogIDSalt, reloaded.LogIDSalt},
+		{"ClientChecksum", config.ClientChecksum, reloaded.ClientChecksum},
+		{"RejectModifiedClients", config.RejectModifiedClients, reloaded.RejectModifiedClients},
+		{"ShipName", config.ShipName, reloaded.ShipName},
+		{"Ships", config.Ships, reloaded.Ships},
+	}
+	var changed []string
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.current, setting.updated) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// Copy of the settings that can be changed by Reload, giving a consistent
+// view of them for as long as it's held.
+type ConfigView struct {
+	KickExistingSession bool
+	MaxPacketsPerSecond int
+	MOTD                string
+	LocalizedMOTD       map[string]string
+	AllowedClasses      []string
+	Features            map[string]bool
+}
+
+// Returns a copy of the settings that can be changed by Reload.
+func (config *Config) Snapshot() ConfigView {
+	config.reloadLock.RLock()
+	defer config.reloadLock.RUnlock()
+	view := ConfigView{
+		KickExistingSession: config.KickExistingSession,
+		MaxPacketsPerSecond: config.MaxPacketsPerSecond,
+		MOTD:                config.MOTD,
+		LocalizedMOTD:       make(map[string]string, len(config.LocalizedMOTD)),
+		AllowedClasses:      append([]string(nil), config.AllowedClasses...),
+		Features:            make(map[string]bool, len(config.Features)),
+	}
+	for lang, motd := range config.LocalizedMOTD {
+		view.LocalizedMOTD[lang] = motd
+	}
+	for name, enabled := range config.Features {
+		view.Features[name] = enabled
+	}
+	return view
+}
+
+// Replace the settings in ConfigView with the ones in reloaded so that they
+// can be changed without restarting the server. Everything else in
+// reloaded is ignored; see DiffRequiringRestart.
+func (config *Config) Reload(reloaded *Config) {
+	view := reloaded.Snapshot()
+	config.reloadLock.Lock()
+	defer config.reloadLock.Unlock()
+	config.KickExistingSession = view.KickExistingSession
+	config.MaxPacketsPerSecond = view.MaxPacketsPerSecond
+	config.MOTD = view.MOTD
+	config.LocalizedMOTD = view.LocalizedMOTD
+	config.AllowedClasses = view.AllowedClasses
+	config.Features = view.Features
+}
+
+// Returns the MaxPacketsPerSecond setting. Cheaper than Snapshot for
+// callers that only need the one setting, such as the per-packet check.
+func (config *Config) PacketRateLimit() int {
+	config.reloadLock.RLock()
+	defer config.reloadLock.RUnlock()
+	return config.MaxPacketsPerSecond
+}
+
+// Returns true if the feature called name is enabled, either explicitly
+// in Features or by default. Unknown features are disabled.
+func (config *Config) FeatureEnabled(name string) bool {
+	config.reloadLock.RLock()
+	defer config.reloadLock.RUnlock()
+	return featureEnabled(config.Features, name)
+}
+
+func (view ConfigView) FeatureEnabled(name string) bool {
+	return featureEnabled(view.Features, name)
+}
+
+func featureEnabled(features map[string]bool, name string) bool {
+	if enabled, ok := features[name]; ok {
+		return enabled
+	}
+	return defaultFeatures[name]
+}
+
+// Returns the MOTD translated into lang, or the default MOTD if there's
+// no translation.
+func (view ConfigView) MOTDFor(lang Language) string {
+	if motd, ok := view.LocalizedMOTD[lang.String()]; ok {
+		return motd
+	}
+	return view.MOTD
+}
+
 // Convert the hostname string into 4 bytes to be used with the redirect packet.
 func (config *Config) HostnameBytes() [4]byte {
 	// Hacky, but chances are the IP address isn't going to start with 0 and a
 	// fixed-length array can't be null.
 	if config.cachedHostBytes[0] == 0x00 {
-		parts := strings.Split(config.Hostname, ".")
-		for i := 0; i < 4; i++ {
-			tmp, _ := strconv.ParseUint(parts[i], 10, 8)
-			config.cachedHostBytes[i] = uint8(tmp)
-		}
+		config.cachedHostBytes = hostBytes(config.Hostname)
 	}
 	return config.cachedHostBytes
 }
 
+// Convert a dotted IPv4 address into the 4 bytes used by redirect packets.
+func hostBytes(host string) [4]byte {
+	var b [4]byte
+	parts := strings.Split(host, ".")
+	for i := 0; i < 4 && i < len(parts); i++ {
+		tmp, _ := strconv.ParseUint(parts[i], 10, 8)
+		b[i] = uint8(tmp)
+	}
+	return b
+}
+
 // Returns the configured scroll message for the login server.
 func (config *Config) ScrollMessageBytes() []byte {
 	return config.cachedScrollMsg[:]
@@ -213,17 +627,42 @@ func (config *Config) String() string {
 		"Num Ship Blocks: " + strconv.FormatInt(int64(config.NumBlocks), 10) + "\n" +
 		"Num Lobbies: " + strconv.FormatInt(int64(config.NumLobbies), 10) + "\n" +
 		"Max Connections: " + strconv.FormatInt(int64(config.MaxConnections), 10) + "\n" +
+		"Kick Existing Session: " + strconv.FormatBool(config.KickExistingSession) + "\n" +
+		"Max Packets Per Second: " + strconv.FormatInt(int64(config.MaxPacketsPerSecond), 10) + "\n" +
+		"Session Timeout: " + strconv.FormatInt(int64(config.SessionTimeout), 10) + "\n" +
+		"Save Interval: " + strconv.FormatInt(int64(config.SaveInterval), 10) + "\n" +
 		"Ship Name: " + config.ShipName + "\n" +
 		"Welcome Message: " + config.WelcomeMessage + "\n" +
+		"MOTD: " + config.MOTD + "\n" +
 		"Parameters Directory: " + config.ParametersDir + "\n" +
 		"Patch Directory: " + config.PatchDir + "\n" +
 		"Keys Directory: " + config.KeysDir + "\n" +
+		"Stat Tables File: " + config.StatTablesFile + "\n" +
+		"Item Table File: " + config.ItemTableFile + "\n" +
 		"Database Host: " + config.DBHost + "\n" +
 		"Database Port: " + config.DBPort + "\n" +
 		"Database Name: " + config.DBName + "\n" +
 		"Database Username: " + config.DBUsername + "\n" +
 		"Database Password: " + config.DBPassword + "\n" +
+		"Database Query Timeout: " + strconv.FormatInt(int64(config.DBQueryTimeoutSeconds), 10) + "\n" +
 		"Output Logged To: " + outfile + "\n" +
 		"Logging Level: " + config.LogLevel + "\n" +
-		"Debug Mode Enabled: " + strconv.FormatBool(config.DebugMode)
+		"Log Repeat Window: " + strconv.FormatInt(int64(config.LogRepeatWindow), 10) + "\n" +
+		"Debug Mode Enabled: " + strconv.FormatBool(config.DebugMode) + "\n" +
+		"Debug Crypto Disabled: " + strconv.FormatBool(cryptoDisabled()) + "\n" +
+		"Reject Modified Clients: " + strconv.FormatBool(config.RejectModifiedClients) + "\n" +
+		"Features: " + config.featureString()
+}
+
+// Returns the state of each known feature as a comma-separated list.
+func (config *Config) featureString() string {
+	names := make([]string, 0, len(defaultFeatures))
+	for name := range defaultFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + strconv.FormatBool(config.FeatureEnabled(name))
+	}
+	return strings.Join(names, ", ")
 }
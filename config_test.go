@@ -0,0 +1,323 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffRequiringRestart(t *testing.T) {
+	current := defaultConfig()
+	if changed := current.DiffRequiringRestart(defaultConfig()); len(changed) > 0 {
+		t.Errorf("Identical configs differ in %v", changed)
+	}
+
+	reloaded := defaultConfig()
+	reloaded.MaxConnections++
+	reloaded.SessionTimeout++
+	reloaded.SaveInterval++
+	reloaded.LogLevel = "debug"
+	reloaded.DebugMode = !current.DebugMode
+	reloaded.ComponentLogfiles = map[string]string{"LOGIN": "login.log"}
+	reloaded.Ships = append(reloaded.Ships, ShipConfig{Name: "Other"})
+	reloaded.DBQueryTimeoutSeconds++
+	reloaded.RejectModifiedClients = !current.RejectModifiedClients
+	reloaded.ClientChecksum++
+	reloaded.StatTablesFile = "stats.json"
+	reloaded.ItemTableFile = "items.json"
+	// Reloadable settings aren't reported.
+	reloaded.MOTD = "Changed"
+	reloaded.MaxPacketsPerSecond++
+
+	expected := []string{"MaxConnections", "SessionTimeout", "SaveInterval",
+		"StatTablesFile", "ItemTableFile", "DBQueryTimeoutSeconds", "LogLevel",
+		"DebugMode", "ComponentLogfiles", "ClientChecksum",
+		"RejectModifiedClients", "Ships"}
+	if changed := current.DiffRequiringRestart(reloaded); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Changed settings are %v; expected %v", changed, expected)
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := defaultConfig()
+	reloaded := defaultConfig()
+	reloaded.MOTD = "Changed"
+	reloaded.Features = map[string]bool{FeatureMail: false}
+	reloaded.MaxConnections = current.MaxConnections + 1
+
+	current.Reload(reloaded)
+	view := current.Snapshot()
+	if view.MOTD != "Changed" || view.FeatureEnabled(FeatureMail) {
+		t.Error("Reloadable settings weren't applied")
+	}
+	if current.MaxConnections == reloaded.MaxConnections {
+		t.Error("Setting requiring a restart was applied")
+	}
+}
+
+func TestPacketRateLimitReloads(t *testing.T) {
+	current := defaultConfig()
+	reloaded := defaultConfig()
+	reloaded.MaxPacketsPerSecond = current.MaxPacketsPerSecond + 10
+	current.Reload(reloaded)
+	if limit := current.PacketRateLimit(); limit != reloaded.MaxPacketsPerSecond {
+		t.Errorf("Packet rate limit is %d after reloading; expected %d", limit, reloaded.MaxPacketsPerSecond)
+	}
+}
+
+func TestSnapshotIsCopy(t *testing.T) {
+	c := defaultConfig()
+	c.Features = map[string]bool{FeatureMail: true}
+	c.AllowedClasses = []string{"HUmar"}
+	view := c.Snapshot()
+	view.Features[FeatureMail] = false
+	view.AllowedClasses[0] = "RAcast"
+	if !c.FeatureEnabled(FeatureMail) || c.AllowedClasses[0] != "HUmar" {
+		t.Error("Changing a snapshot changed the config")
+	}
+}
+
+func TestSnapshotDuringReload(t *testing.T) {
+	current := defaultConfig()
+	versions := make([]*Config, 2)
+	for i := range versions {
+		versions[i] = defaultConfig()
+		versions[i].MOTD = strconv.Itoa(i)
+		versions[i].MaxPacketsPerSecond = i
+		versions[i].Features = map[string]bool{FeatureMail: i == 1}
+	}
+	current.Reload(versions[0])
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				current.Reload(versions[i%2])
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				// Every setting in a snapshot comes from the same reload.
+				view := current.Snapshot()
+				if view.MOTD != strconv.Itoa(view.MaxPacketsPerSecond) ||
+					view.FeatureEnabled(FeatureMail) != (view.MaxPacketsPerSecond == 1) {
+					t.Errorf("Inconsistent snapshot %+v", view)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	c := defaultConfig()
+	c.Features = map[string]bool{FeatureMail: false, FeatureSharedBank: true}
+	if c.FeatureEnabled(FeatureMail) {
+		t.Error("Disabled feature is enabled")
+	}
+	if !c.FeatureEnabled(FeatureSharedBank) {
+		t.Error("Enabled feature is disabled")
+	}
+	// Not mentioned, so the default applies.
+	if !c.FeatureEnabled(FeatureChallengeMode) {
+		t.Error("Challenge mode isn't enabled by default")
+	}
+	if c.FeatureEnabled("unknown") {
+		t.Error("Unknown feature is enabled")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"Complete", func(c *Config) {}, ""},
+		{"MissingDBName", func(c *Config) { c.DBName = "" },
+			"Missing required settings: DBName"},
+		{"MissingDBHost", func(c *Config) { c.DBHost = " " },
+			"Missing required settings: DBHost"},
+		{"MissingSeveral", func(c *Config) { c.DBPort, c.DBUsername = "", "" },
+			"Missing required settings: DBPort, DBUsername"},
+		{"RejectWithoutChecksum", func(c *Config) { c.RejectModifiedClients = true },
+			"RejectModifiedClients is set but ClientChecksum isn't"},
+		{"RejectWithChecksum", func(c *Config) { c.RejectModifiedClients, c.ClientChecksum = true, 0x12345678 }, ""},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.DBHost, c.DBPort, c.DBName, c.DBUsername = "127.0.0.1", "3306", "archondb", "archon"
+		test.modify(c)
+		err := c.Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v; expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateEmptyConfig(t *testing.T) {
+	err := new(Config).Validate()
+	expected := "Missing required settings: Hostname, DBHost, DBPort, DBName, DBUsername"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Got error %v; expected %q", err, expected)
+	}
+}
+
+func TestGenerateExample(t *testing.T) {
+	path := t.TempDir() + "/server_config.json.example"
+	if err := defaultConfig().GenerateExample(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"DBUsername": "<database user>"`) {
+		t.Errorf("Example doesn't have a placeholder for DBUsername:\n%s", data)
+	}
+	if strings.Contains(string(data), "MessageBytes") {
+		t.Error("Example includes a computed setting")
+	}
+
+	example := defaultConfig()
+	if err := example.InitFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := example.Validate(); err != nil {
+		t.Errorf("Example config failed validation: %v", err)
+	}
+	if example.DBPassword != "<database password>" {
+		t.Errorf("Example has DBPassword %q", example.DBPassword)
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"Valid", func(c *Config) {}, ""},
+		{"NotANumber", func(c *Config) { c.LoginPort = "12OOO" },
+			`LoginPort must be a port number between 1 and 65535, got "12OOO"`},
+		{"OutOfRange", func(c *Config) { c.DBPort = "65536" },
+			`DBPort must be a port number between 1 and 65535, got "65536"`},
+		{"Zero", func(c *Config) { c.WebPort = "0" },
+			`WebPort must be a port number between 1 and 65535, got "0"`},
+		{"Collision", func(c *Config) { c.CharacterPort = c.LoginPort },
+			"LoginPort and CharacterPort are both set to 12000"},
+		{"BlockCollision", func(c *Config) { c.WebPort = "15002" },
+			"WebPort and Block 2 (ShipPort + 2) are both set to 15002"},
+		{"BlockOutOfRange", func(c *Config) { c.ShipPort = "65535" },
+			"Block 1 (ShipPort + 1) would be 65536, which is out of range"},
+		// The database server's port can match one of ours.
+		{"DBPortShared", func(c *Config) { c.DBPort = c.LoginPort }, ""},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.DBUsername = "archon"
+		test.modify(c)
+		err := c.Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v; expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	useConfig(t, func(c *Config) { c.LogLevel = "info" })
+	var order []int
+	closeErr := errors.New("Failed to flush")
+	config.OnClose(func() error { order = append(order, 1); return errors.New("Later error") })
+	config.OnClose(func() error { order = append(order, 2); return closeErr })
+	config.OnClose(func() error { order = append(order, 3); return nil })
+	logger := newLogger(t.TempDir() + "/archon.log")
+	config.OnClose(sessions.StartSweeper(time.Hour))
+
+	if err := config.Close(); err != closeErr {
+		t.Errorf("Close returned %v; expected the first error", err)
+	}
+	if expected := []int{3, 2, 1}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Closers ran in order %v; expected %v", order, expected)
+	}
+	if _, err := logger.Out.(*os.File).Write([]byte("x")); err == nil {
+		t.Error("Log file is still open")
+	}
+
+	// Nothing is run twice; stopping the sweeper again would panic.
+	if err := config.Close(); err != nil {
+		t.Errorf("Second Close returned %v", err)
+	}
+	if len(order) != 3 {
+		t.Errorf("Closers ran again: %v", order)
+	}
+}
+
+func TestValidateLogfiles(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		logfile   string
+		component string
+		ok        bool
+	}{
+		{"Stdout", "", "", true},
+		{"Writable", dir + "/archon.log", dir + "/login.log", true},
+		{"MissingDirectory", dir + "/missing/archon.log", "", false},
+		{"Directory", dir, "", false},
+		{"UnwritableComponent", dir + "/archon.log", dir + "/missing/login.log", false},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.DBUsername = "archon"
+		c.Logfile = test.logfile
+		if test.component != "" {
+			c.ComponentLogfiles = map[string]string{"LOGIN": test.component}
+		}
+		if err := c.Validate(); test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: unwritable log file passed validation", test.name)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !release
+// +build !release
+
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Development builds allow encryption to be turned off for debugging.
+ */
+package main
+
+// Returns true if packets should be sent and received unencrypted, which
+// requires both DebugMode and DebugDisableCrypto to be set.
+func cryptoDisabled() bool {
+	return config.DebugMode && config.DebugDisableCrypto
+}
@@ -0,0 +1,53 @@
+//go:build !release
+// +build !release
+
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	crypto "github.com/dcrodman/archon/encryption"
+	"testing"
+)
+
+func TestDebugDisableCrypto(t *testing.T) {
+	tests := []struct {
+		debugMode, disableCrypto, encrypted bool
+	}{
+		{false, false, true},
+		{true, false, true},
+		// Ignored outside of debug mode.
+		{false, true, true},
+		{true, true, false},
+	}
+	plain := []byte("ArchonPlaintext!")
+	for _, test := range tests {
+		useConfig(t, func(c *Config) {
+			c.DebugMode = test.debugMode
+			c.DebugDisableCrypto = test.disableCrypto
+		})
+		c := &Client{serverCrypt: crypto.NewBBCrypt()}
+		data := append([]byte(nil), plain...)
+		c.Encrypt(data, uint32(len(data)))
+		if encrypted := !bytes.Equal(data, plain); encrypted != test.encrypted {
+			t.Errorf("DebugMode=%v DebugDisableCrypto=%v: encrypted is %v",
+				test.debugMode, test.disableCrypto, encrypted)
+		}
+	}
+}
@@ -70,14 +70,28 @@ func NewPCCrypt() *PSOCrypt {
 // Returns a newly allocated PSOCrypt with randomly generated, appropriately
 // sized keys for encrypting packets over PSOBB connections.
 func NewBBCrypt() *PSOCrypt {
-	crypt := &PSOCrypt{Vector: createKey(48)}
-	var err error
-	if crypt.cipher, err = newCipher(crypt.Vector); err != nil {
+	crypt, err := NewBBCryptFromVector(createKey(48))
+	if err != nil {
 		panic(err)
 	}
 	return crypt
 }
 
+// Returns a PSOCrypt for PSOBB connections keyed with an existing 48-byte
+// vector, such as one read from a welcome packet, so that traffic from a
+// known session can be encrypted or decrypted.
+func NewBBCryptFromVector(vector []byte) (*PSOCrypt, error) {
+	if len(vector) != 48 {
+		return nil, KeySizeError(len(vector))
+	}
+	crypt := &PSOCrypt{Vector: append([]uint8(nil), vector...)}
+	var err error
+	if crypt.cipher, err = newCipher(crypt.Vector); err != nil {
+		return nil, err
+	}
+	return crypt, nil
+}
+
 // Encrypt a block of data in place.
 func (crypt *PSOCrypt) Encrypt(data []byte, size uint32) {
 	blockSize := crypt.cipher.blockSize()
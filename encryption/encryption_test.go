@@ -0,0 +1,110 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Ciphertexts computed with a separate implementation of PSOBB's Blowfish
+// variant, so that changes to the key schedule or block functions are caught.
+var bbVectors = []struct {
+	vector     []byte
+	plaintext  string
+	ciphertext string
+}{
+	{
+		vector:     sequence(48, func(i int) byte { return byte(i) }),
+		plaintext:  "417263686f6e42420001020304050607",
+		ciphertext: "b3220a85e5df82b42164dfb1f07a6aa0",
+	},
+	{
+		vector:     sequence(48, func(i int) byte { return byte(i*37 + 11) }),
+		plaintext:  "417263686f6e42420001020304050607",
+		ciphertext: "47112a371108c3f8a0a1f615e420d2b9",
+	},
+}
+
+func sequence(n int, f func(int) byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = f(i)
+	}
+	return b
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBBCryptKnownVectors(t *testing.T) {
+	for i, test := range bbVectors {
+		crypt, err := NewBBCryptFromVector(test.vector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := decodeHex(t, test.plaintext)
+		crypt.Encrypt(data, uint32(len(data)))
+		if got := hex.EncodeToString(data); got != test.ciphertext {
+			t.Errorf("Vector %d encrypted to %s; expected %s", i, got, test.ciphertext)
+		}
+		crypt.Decrypt(data, uint32(len(data)))
+		if got := hex.EncodeToString(data); got != test.plaintext {
+			t.Errorf("Vector %d decrypted to %s; expected %s", i, got, test.plaintext)
+		}
+	}
+}
+
+func TestNewBBCryptFromVector(t *testing.T) {
+	vector := sequence(48, func(i int) byte { return byte(i) })
+	crypt, err := NewBBCryptFromVector(vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vector[0] = 0xFF
+	if crypt.Vector[0] != 0 {
+		t.Error("Cipher shares its vector with the caller")
+	}
+
+	// A cipher built from another's vector must be able to read its data,
+	// which is how the client and server end up agreeing on keys.
+	random := NewBBCrypt()
+	copied, err := NewBBCryptFromVector(random.Vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Sixteen bytes!!!")
+	random.Encrypt(data, uint32(len(data)))
+	copied.Decrypt(data, uint32(len(data)))
+	if !bytes.Equal(data, []byte("Sixteen bytes!!!")) {
+		t.Errorf("Data encrypted with the original cipher decrypted to %q", data)
+	}
+
+	for _, size := range []int{0, 47, 49} {
+		if _, err := NewBBCryptFromVector(make([]byte, size)); err == nil {
+			t.Errorf("Accepted a %d byte vector", size)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Scripted database/sql driver for testing the code that talks to the
+* database without a MySQL server. Tests list the statements they expect
+* along with the rows or results to give back for each one.
+ */
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A statement the code under test is expected to run.
+type fakeQuery struct {
+	// Substring of the statement, compared after collapsing whitespace.
+	contains string
+	// Arguments the statement must be run with; not checked if nil.
+	args []driver.Value
+	// Rows returned by a query.
+	columns []string
+	rows    [][]driver.Value
+	// Result of an exec.
+	rowsAffected int64
+	lastInsertId int64
+	// Returned instead of a result if set.
+	err error
+	// How long the statement takes; statements are cancelled if their
+	// context is done first.
+	delay time.Duration
+
+	used bool
+	// Arguments the statement was actually run with.
+	gotArgs []driver.Value
+}
+
+// Return rows from a query.
+func (q *fakeQuery) WillReturnRows(columns []string, rows ...[]driver.Value) *fakeQuery {
+	q.columns, q.rows = columns, rows
+	return q
+}
+
+// Report n rows affected by an exec.
+func (q *fakeQuery) WillAffect(n int64) *fakeQuery {
+	q.rowsAffected = n
+	return q
+}
+
+func (q *fakeQuery) WillFail(err error) *fakeQuery {
+	q.err = err
+	return q
+}
+
+func (q *fakeQuery) WillDelay(d time.Duration) *fakeQuery {
+	q.delay = d
+	return q
+}
+
+func (q *fakeQuery) WithArgs(args ...driver.Value) *fakeQuery {
+	q.args = args
+	return q
+}
+
+// Returns the arguments the statement was run with, or nil if it hasn't run.
+func (q *fakeQuery) Args() []driver.Value {
+	return q.gotArgs
+}
+
+type fakeDB struct {
+	t        testing.TB
+	expected []*fakeQuery
+	// Every statement run, including transaction commits and rollbacks.
+	log []string
+	sync.Mutex
+}
+
+var (
+	fakeDBs    = make(map[string]*fakeDB)
+	fakeDBLock sync.Mutex
+	fakeDBNext int
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// Returns a database backed by a new fakeDB. The test fails if any of the
+// expected statements haven't been run by the time it finishes.
+func newFakeDB(t testing.TB) (*sql.DB, *fakeDB) {
+	fake := &fakeDB{t: t}
+	fakeDBLock.Lock()
+	fakeDBNext++
+	name := fmt.Sprintf("fake%d", fakeDBNext)
+	fakeDBs[name] = fake
+	fakeDBLock.Unlock()
+
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fake.Lock()
+		defer fake.Unlock()
+		for _, q := range fake.expected {
+			if !q.used {
+				t.Errorf("Expected statement wasn't run: %s", q.contains)
+			}
+		}
+	})
+	return db, fake
+}
+
+// Expect a statement containing contains. Statements are matched to the
+// first unused expectation they contain, regardless of order.
+func (fake *fakeDB) Expect(contains string) *fakeQuery {
+	q := &fakeQuery{contains: collapseSpace(contains)}
+	fake.Lock()
+	fake.expected = append(fake.expected, q)
+	fake.Unlock()
+	return q
+}
+
+// Returns the statements run so far.
+func (fake *fakeDB) Log() []string {
+	fake.Lock()
+	defer fake.Unlock()
+	return append([]string(nil), fake.log...)
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func (fake *fakeDB) run(ctx context.Context, query string, args []driver.NamedValue) (*fakeQuery, error) {
+	query = collapseSpace(query)
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	fake.Lock()
+	fake.log = append(fake.log, query)
+	var match *fakeQuery
+	for _, q := range fake.expected {
+		if !q.used && strings.Contains(query, q.contains) {
+			match = q
+			break
+		}
+	}
+	if match != nil {
+		match.used = true
+		match.gotArgs = values
+	}
+	fake.Unlock()
+
+	if match == nil {
+		fake.t.Errorf("Unexpected statement: %s", query)
+		return nil, fmt.Errorf("Unexpected statement: %s", query)
+	}
+	if match.args != nil && !reflect.DeepEqual(match.args, values) {
+		fake.t.Errorf("Statement %q run with %v; expected %v", query, values, match.args)
+	}
+	if match.delay > 0 {
+		select {
+		case <-time.After(match.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return match, match.err
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBLock.Lock()
+	defer fakeDBLock.Unlock()
+	fake, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("No fake database named %s", name)
+	}
+	return &fakeConn{fake}, nil
+}
+
+type fakeConn struct{ fake *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.fake.Lock()
+	c.fake.log = append(c.fake.log, "BEGIN")
+	c.fake.Unlock()
+	return fakeTx{c.fake}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, err := c.fake.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: q.columns, rows: q.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	q, err := c.fake.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{q.lastInsertId, q.rowsAffected}, nil
+}
+
+// Convert arguments the way database/sql normally would so that
+// expectations can be written with driver values, but accept anything.
+func (c *fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	values := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		values[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return values
+}
+
+type fakeTx struct{ fake *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.fake.Lock()
+	tx.fake.log = append(tx.fake.log, "COMMIT")
+	tx.fake.Unlock()
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.fake.Lock()
+	tx.fake.log = append(tx.fake.log, "ROLLBACK")
+	tx.fake.Unlock()
+	return nil
+}
+
+type fakeResult struct{ lastInsertId, rowsAffected int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.lastInsertId, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
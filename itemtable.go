@@ -0,0 +1,306 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Item parameter table with the per-item limits from the client's ItemPMT
+* file, or from a JSON file that can also give the items' names.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dcrodman/archon/prs"
+	"github.com/dcrodman/archon/util"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Parameters for a single kind of item.
+type ItemParams struct {
+	Name string
+	// Most copies of a tool that can be held in one slot; 0 means the item
+	// can't be stacked.
+	MaxStack uint8
+	// Highest attribute percentage a weapon can have; 0 means the default
+	// limit applies.
+	MaxPercentage int
+	// Highest grind a weapon can have.
+	MaxGrind uint8
+}
+
+// Format of the item table file. Items are keyed by the first three bytes
+// of their data in hex, e.g. "000100" for a Saber.
+type itemTableFile struct {
+	Items map[string]ItemParams
+}
+
+type ItemTable struct {
+	items map[uint32]ItemParams
+}
+
+// Tables that have already been loaded, keyed by path.
+var (
+	itemTables    = make(map[string]*ItemTable)
+	itemTableLock sync.Mutex
+)
+
+// Table loaded from the server's ItemTableFile, if it has one.
+var itemTable *ItemTable
+
+// Load the item table from the file at path, which is either the client's
+// PRS-compressed ItemPMT (if the name ends in .prs) or a JSON file. Tables
+// are cached, so loading the same path again returns the table that was
+// already loaded.
+func LoadItemTable(path string) (*ItemTable, error) {
+	itemTableLock.Lock()
+	defer itemTableLock.Unlock()
+	if table, ok := itemTables[path]; ok {
+		return table, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table *ItemTable
+	if strings.HasSuffix(strings.ToLower(path), ".prs") {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%s is empty", path)
+		}
+		pmt := make([]byte, prs.DecompressSize(data))
+		prs.Decompress(data, pmt)
+		table, err = ParseItemPMT(pmt)
+	} else {
+		table, err = parseItemTableJSON(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	itemTables[path] = table
+	return table, nil
+}
+
+func parseItemTableJSON(data []byte) (*ItemTable, error) {
+	var file itemTableFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	table := &ItemTable{items: make(map[uint32]ItemParams, len(file.Items))}
+	for id, params := range file.Items {
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != 3 {
+			return nil, fmt.Errorf("Invalid item id %q", id)
+		}
+		table.items[itemKey(b[0], b[1], b[2])] = params
+	}
+	return table, nil
+}
+
+// Size of the trailer at the end of ItemPMT, which holds the offset of the
+// root table.
+const itemPMTTrailerSize = 0x20
+
+// Number of weapon classes and tool classes in ItemPMT.
+const (
+	itemPMTWeaponClasses = 0xED
+	itemPMTToolClasses   = 0x1B
+)
+
+// Tool class for technique disks. Disks have an entry per technique, but
+// the item data only has the disk's level in the third byte, so the table
+// gets an entry for each level instead.
+const (
+	toolClassDisk = 0x02
+	maxDiskLevel  = 30
+)
+
+// Weapon entry as it's stored in ItemPMT, up to the grind limit.
+type itemPMTWeapon struct {
+	Id          uint32
+	Type        uint16
+	Skin        uint16
+	TeamPoints  uint32
+	ClassFlags  uint16
+	ATPMin      uint16
+	ATPMax      uint16
+	ATPRequired uint16
+	MSTRequired uint16
+	ATARequired uint16
+	MST         uint16
+	MaxGrind    uint8
+}
+
+// Size of each entry in ItemPMT's weapon and tool lists.
+const (
+	itemPMTWeaponSize = 0x2C
+	itemPMTToolSize   = 0x18
+)
+
+// Returns the most of a tool in class that can be held in one slot. ItemPMT
+// doesn't record this; the client only stacks recovery items, atomizers,
+// antidotes, telepipes, trap visions, grinders, materials and photon drops.
+func toolStackLimit(class uint8) uint8 {
+	switch class {
+	case 0x00, 0x01, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x0A, 0x0B, 0x10:
+		return maxToolStack
+	}
+	return 0
+}
+
+// Build an item table from a decompressed ItemPMT. The root table starts
+// with the offsets of the weapon, armor, unit, tool and mag lists, each of
+// which is made up of (count, offset) pairs; every item in them is added to
+// the table along with the limits ItemPMT gives for it.
+func ParseItemPMT(data []byte) (*ItemTable, error) {
+	// Returns the uint32 at offset, or false if it's out of range.
+	read := func(offset uint32) (uint32, bool) {
+		if uint64(offset)+4 > uint64(len(data)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data[offset:]), true
+	}
+	// Returns the count and offset of the list at offset, checking that
+	// count entries of size fit in the file.
+	list := func(offset, size uint32) (uint32, uint32, error) {
+		count, ok := read(offset)
+		start, ok2 := read(offset + 4)
+		if !ok || !ok2 || uint64(start)+uint64(count)*uint64(size) > uint64(len(data)) {
+			return 0, 0, fmt.Errorf("Invalid item list at %#x", offset)
+		}
+		return count, start, nil
+	}
+	if len(data) < itemPMTTrailerSize {
+		return nil, fmt.Errorf("Item table is too short (%d bytes)", len(data))
+	}
+	root, ok := read(uint32(len(data) - itemPMTTrailerSize + 0x10))
+	weapons, ok2 := read(root)
+	armors, ok3 := read(root + 4)
+	units, ok4 := read(root + 8)
+	tools, ok5 := read(root + 12)
+	mags, ok6 := read(root + 16)
+	if !ok || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 {
+		return nil, fmt.Errorf("Invalid item table root offset %#x", root)
+	}
+
+	table := &ItemTable{items: make(map[uint32]ItemParams)}
+	for class := uint32(0); class < itemPMTWeaponClasses; class++ {
+		count, start, err := list(weapons+class*8, itemPMTWeaponSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < count && i <= 0xFF; i++ {
+			var w itemPMTWeapon
+			if err := util.StructFromBytes(data[start+i*itemPMTWeaponSize:], &w); err != nil {
+				return nil, err
+			}
+			table.items[itemKey(uint8(ItemTypeWeapon), uint8(class), uint8(i))] =
+				ItemParams{MaxGrind: w.MaxGrind}
+		}
+	}
+	// Frames and barriers are the first two armor lists; units have their own.
+	armorLists := []uint32{armors, armors + 8, units}
+	for i, offset := range armorLists {
+		count, _, err := list(offset, 0)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < count && j <= 0xFF; j++ {
+			table.items[itemKey(uint8(ItemTypeArmor), uint8(i+1), uint8(j))] = ItemParams{}
+		}
+	}
+	count, _, err := list(mags, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count && i <= 0xFF; i++ {
+		table.items[itemKey(uint8(ItemTypeMag), uint8(i), 0)] = ItemParams{}
+	}
+	for class := uint32(0); class < itemPMTToolClasses; class++ {
+		count, _, err := list(tools+class*8, itemPMTToolSize)
+		if err != nil {
+			return nil, err
+		}
+		if class == toolClassDisk {
+			count = maxDiskLevel
+		}
+		params := ItemParams{MaxStack: toolStackLimit(uint8(class))}
+		for i := uint32(0); i < count && i <= 0xFF; i++ {
+			table.items[itemKey(uint8(ItemTypeTool), uint8(class), uint8(i))] = params
+		}
+	}
+	return table, nil
+}
+
+func itemKey(b0, b1, b2 uint8) uint32 {
+	return uint32(b0)<<16 | uint32(b1)<<8 | uint32(b2)
+}
+
+// Returns the parameters for it, if it's in the table.
+func (t *ItemTable) Lookup(it *Item) (ItemParams, bool) {
+	params, ok := t.items[itemKey(it.Data[0], it.Data[1], it.Data[2])]
+	return params, ok
+}
+
+// Returns the name of it, or its description if it isn't in the table.
+func (t *ItemTable) Name(it *Item) string {
+	if params, ok := t.Lookup(it); ok && params.Name != "" {
+		return params.Name
+	}
+	return it.Describe()
+}
+
+// Returns the most copies of it that can be held in one slot.
+func (t *ItemTable) MaxStack(it *Item) uint32 {
+	if params, ok := t.Lookup(it); ok && params.MaxStack > 0 {
+		return uint32(params.MaxStack)
+	}
+	return 1
+}
+
+// Returns the highest attribute percentage it can have.
+func (t *ItemTable) MaxPercentage(it *Item) int {
+	if params, ok := t.Lookup(it); ok && params.MaxPercentage > 0 {
+		return params.MaxPercentage
+	}
+	return maxWeaponPercentage
+}
+
+// Checks the item's stack size and attribute percentages against the
+// limits in the table.
+func (t *ItemTable) ValidateItem(it *Item) error {
+	if it.Type() == ItemTypeTool && it.stackSize() > t.MaxStack(it) {
+		return fmt.Errorf("%s stacked %d high; limit is %d",
+			t.Name(it), it.stackSize(), t.MaxStack(it))
+	}
+	if it.Type() == ItemTypeWeapon {
+		if params, ok := t.Lookup(it); ok && params.MaxGrind > 0 && it.Data[3] > params.MaxGrind {
+			return fmt.Errorf("%s is ground to +%d; limit is +%d",
+				t.Name(it), it.Data[3], params.MaxGrind)
+		}
+		limit := t.MaxPercentage(it)
+		for i := 6; i < 12; i += 2 {
+			if it.Data[i] != 0 && int(int8(it.Data[i+1])) > limit {
+				return fmt.Errorf("%s has %d%% attribute; limit is %d%%",
+					t.Name(it), int8(it.Data[i+1]), limit)
+			}
+		}
+	}
+	return nil
+}
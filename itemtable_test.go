@@ -0,0 +1,115 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testItemPMT = "config/parameters/ItemPMT.prs"
+
+func newItem(data ...uint8) *Item {
+	it := new(Item)
+	copy(it.Data[:], data)
+	return it
+}
+
+func TestLoadItemPMT(t *testing.T) {
+	table, err := LoadItemTable(testItemPMT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := LoadItemTable(testItemPMT); err != nil || again != table {
+		t.Error("Loading the table again didn't return the cached table")
+	}
+
+	saber := newItem(0x00, 0x01, 0x00)
+	if params, ok := table.Lookup(saber); !ok || params.MaxGrind != 35 {
+		t.Errorf("Saber has parameters %+v, %v; expected a max grind of 35", params, ok)
+	}
+	tests := []struct {
+		name     string
+		item     *Item
+		maxStack uint32
+	}{
+		{"Monomate", newItem(0x03, 0x00, 0x00), 10},
+		{"Telepipe", newItem(0x03, 0x07, 0x00), 10},
+		{"Foie disk", newItem(0x03, 0x02, 0x04), 1},
+		{"Scape Doll", newItem(0x03, 0x09, 0x00), 1},
+		{"Frame", newItem(0x01, 0x01, 0x00), 1},
+		{"Barrier", newItem(0x01, 0x02, 0x00), 1},
+		{"Knight/Power", newItem(0x01, 0x03, 0x00), 1},
+		{"Mag", newItem(0x02, 0x00), 1},
+	}
+	for _, test := range tests {
+		if _, ok := table.Lookup(test.item); !ok {
+			t.Errorf("%s isn't in the table", test.name)
+		} else if got := table.MaxStack(test.item); got != test.maxStack {
+			t.Errorf("%s stacks to %d; expected %d", test.name, got, test.maxStack)
+		}
+	}
+	if _, ok := table.Lookup(newItem(0x00, 0xF0, 0x00)); ok {
+		t.Error("Found a weapon class that ItemPMT doesn't have")
+	}
+
+	if err := table.ValidateItem(newItem(0x00, 0x01, 0x00, 35)); err != nil {
+		t.Errorf("Saber +35 failed validation: %s", err.Error())
+	}
+	if err := table.ValidateItem(newItem(0x00, 0x01, 0x00, 36)); err == nil {
+		t.Error("Saber +36 passed validation")
+	}
+	if err := table.ValidateItem(newItem(0x03, 0x00, 0x00, 0, 0, 11)); err == nil {
+		t.Error("Stack of 11 Monomates passed validation")
+	}
+}
+
+func TestParseItemPMTRejectsTruncated(t *testing.T) {
+	if _, err := ParseItemPMT(make([]byte, 16)); err == nil {
+		t.Error("Parsed a table shorter than the trailer")
+	}
+	// A trailer pointing past the end of the data.
+	data := make([]byte, 0x40)
+	data[0x30] = 0xFF
+	if _, err := ParseItemPMT(data); err == nil {
+		t.Error("Parsed a table with an out of range root offset")
+	}
+}
+
+func TestLoadItemTableJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "items.json")
+	json := `{"Items": {"000100": {"Name": "Saber", "MaxPercentage": 50, "MaxGrind": 35},
+		"030000": {"Name": "Monomate", "MaxStack": 10}}}`
+	if err := ioutil.WriteFile(path, []byte(json), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadItemTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := table.Name(newItem(0x00, 0x01, 0x00)); name != "Saber" {
+		t.Errorf("Saber is named %q", name)
+	}
+	if limit := table.MaxPercentage(newItem(0x00, 0x01, 0x00)); limit != 50 {
+		t.Errorf("Saber's percentage limit is %d", limit)
+	}
+	if stack := table.MaxStack(newItem(0x03, 0x00, 0x00)); stack != 10 {
+		t.Errorf("Monomates stack to %d", stack)
+	}
+}
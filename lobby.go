@@ -0,0 +1,200 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Lobby membership shared between the clients connected to a block.
+* Movement updates are batched and sent once per tick rather than relayed
+* to every other player as soon as they arrive.
+ */
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Maximum number of players that can be in a lobby at once.
+const MaxLobbyClients = 12
+
+// Menu id the client sends back when a lobby is picked from the list.
+const LobbyMenuId = 0x1A0001
+
+// Summary of a lobby for the lobby list.
+type LobbyInfo struct {
+	Id      uint32
+	Players int
+}
+
+// Synchronized set of clients in a lobby. Each client's position in the
+// slot array is the client id the game uses to refer to them.
+type Lobby struct {
+	id      uint32
+	clients [MaxLobbyClients]*Client
+	// Latest movement packet from each client id not yet sent out.
+	movement [MaxLobbyClients][]byte
+	started  bool
+	stopOnce sync.Once
+	done     chan struct{}
+	stopped  chan struct{}
+	sync.RWMutex
+}
+
+func NewLobby(id uint32) *Lobby {
+	return &Lobby{
+		id:      id,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start sending queued movement updates every tick in the background.
+func (l *Lobby) Start(tick time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.started {
+		return
+	}
+	l.started = true
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		defer close(l.stopped)
+		for {
+			select {
+			case <-ticker.C:
+				l.FlushMovement()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background sends started by Start. Safe to call more than once
+// or on a lobby that was never started.
+func (l *Lobby) Stop() {
+	l.stopOnce.Do(func() {
+		l.Lock()
+		started := l.started
+		l.Unlock()
+		if started {
+			close(l.done)
+			<-l.stopped
+		}
+	})
+}
+
+func (l *Lobby) Id() uint32 { return l.id }
+
+// Adds c to the first open slot in the lobby and returns its client id.
+func (l *Lobby) AddClient(c *Client) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	for i, client := range l.clients {
+		if client == nil {
+			l.clients[i] = c
+			return i, nil
+		}
+	}
+	return -1, errors.New("Lobby is full")
+}
+
+// Removes c from the lobby and returns the client id it had been assigned,
+// or -1 if it wasn't in the lobby.
+func (l *Lobby) RemoveClient(c *Client) int {
+	l.Lock()
+	defer l.Unlock()
+	for i, client := range l.clients {
+		if client == c {
+			l.clients[i] = nil
+			l.movement[i] = nil
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Lobby) Info() LobbyInfo {
+	return LobbyInfo{Id: l.id, Players: len(l.Members())}
+}
+
+// Returns the clients currently in the lobby.
+func (l *Lobby) Members() []*Client {
+	members := make([]*Client, 0, MaxLobbyClients)
+	l.RLock()
+	for _, client := range l.clients {
+		if client != nil {
+			members = append(members, client)
+		}
+	}
+	l.RUnlock()
+	return members
+}
+
+// Send pkt to every client in the lobby other than except (which may be nil).
+// Each client gets its own copy since encryption happens in place.
+func (l *Lobby) Broadcast(pkt []byte, except *Client) {
+	for _, client := range l.Members() {
+		if client == except {
+			continue
+		}
+		data := make([]byte, len(pkt))
+		copy(data, pkt)
+		sendEncrypted(client, data, uint16(len(data)))
+	}
+}
+
+// Queue a movement packet from c to be sent to the rest of the lobby on the
+// next tick, replacing any of c's movement that hasn't been sent yet since
+// only its latest position matters. Chat and anything else that has to
+// arrive in order should go through Broadcast instead.
+func (l *Lobby) QueueMovement(c *Client, pkt []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	for i, client := range l.clients {
+		if client == c {
+			l.movement[i] = PadPacket(append([]byte(nil), pkt...))
+			return nil
+		}
+	}
+	return errors.New("Client is not in the lobby")
+}
+
+// Send each client the queued movement from everyone else in the lobby,
+// combined into a single write.
+func (l *Lobby) FlushMovement() {
+	l.Lock()
+	clients := l.clients
+	movement := l.movement
+	l.movement = [MaxLobbyClients][]byte{}
+	l.Unlock()
+
+	for i, client := range clients {
+		if client == nil {
+			continue
+		}
+		var batch []byte
+		for j, pkt := range movement {
+			if j != i {
+				batch = append(batch, pkt...)
+			}
+		}
+		if len(batch) > 0 {
+			sendEncryptedBatch(client, batch)
+		}
+	}
+}
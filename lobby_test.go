@@ -0,0 +1,254 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"github.com/dcrodman/archon/util"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testLobbyPacketType = 0x60
+	testChatPacketType  = 0x06
+)
+
+func newTestLobbyPacket() []byte {
+	data, _ := util.BytesFromStruct(&BBHeader{Type: testLobbyPacketType})
+	return data
+}
+
+func TestLobbyAddRemove(t *testing.T) {
+	l := NewLobby(1)
+	var clients [MaxLobbyClients]*Client
+	for i := range clients {
+		clients[i] = new(Client)
+		if id, err := l.AddClient(clients[i]); err != nil || id != i {
+			t.Fatalf("Client %d was assigned id %d (err %v)", i, id, err)
+		}
+	}
+	if _, err := l.AddClient(new(Client)); err == nil {
+		t.Error("Added a client to a full lobby")
+	}
+
+	if id := l.RemoveClient(clients[4]); id != 4 {
+		t.Errorf("Removed client had id %d; expected 4", id)
+	}
+	if id := l.RemoveClient(clients[4]); id != -1 {
+		t.Errorf("Removing a client twice returned id %d", id)
+	}
+	if n := len(l.Members()); n != MaxLobbyClients-1 {
+		t.Errorf("Lobby has %d members; expected %d", n, MaxLobbyClients-1)
+	}
+
+	// The lowest free id is reused.
+	if id, err := l.AddClient(new(Client)); err != nil || id != 4 {
+		t.Errorf("New client was assigned id %d (err %v); expected 4", id, err)
+	}
+}
+
+func TestLobbyBroadcast(t *testing.T) {
+	l := NewLobby(1)
+	sender, senderPeer := newTestClientPair(t)
+	other, otherPeer := newTestClientPair(t)
+	l.AddClient(sender)
+	l.AddClient(other)
+
+	l.Broadcast(newTestLobbyPacket(), sender)
+	expectPacket(t, otherPeer, testLobbyPacketType)
+	l.Broadcast(newTestLobbyPacket(), nil)
+	expectPacket(t, senderPeer, testLobbyPacketType)
+	expectPacket(t, otherPeer, testLobbyPacketType)
+}
+
+func TestLobbyConcurrentBroadcast(t *testing.T) {
+	const senders, sends = 4, 20
+	l := NewLobby(1)
+	var peers []*Client
+	for i := 0; i < 3; i++ {
+		c, peer := newTestClientPair(t)
+		l.AddClient(c)
+		peers = append(peers, peer)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				l.Broadcast(newTestLobbyPacket(), nil)
+			}
+		}()
+	}
+	// Membership changes while packets are going out.
+	c, _ := newTestClientPair(t)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < sends; j++ {
+			l.AddClient(c)
+			l.RemoveClient(c)
+			l.Info()
+		}
+	}()
+	wg.Wait()
+
+	for _, peer := range peers {
+		for i := 0; i < senders*sends; i++ {
+			expectPacket(t, peer, testLobbyPacketType)
+		}
+	}
+}
+
+func TestBuildLobbyListMenu(t *testing.T) {
+	full := NewLobby(3)
+	for i := 0; i < MaxLobbyClients; i++ {
+		full.AddClient(new(Client))
+	}
+	lobbies := []LobbyInfo{{Id: 1, Players: 0}, {Id: 2, Players: 5}, full.Info()}
+	menu := BuildLobbyListMenu(lobbies)
+
+	// 8 byte header followed by a 12 byte entry per lobby, padded to 8.
+	if len(menu) != 48 || binary.LittleEndian.Uint16(menu) != 48 {
+		t.Fatalf("Menu is %d bytes with size %d; expected 48", len(menu), binary.LittleEndian.Uint16(menu))
+	}
+	if pktType := binary.LittleEndian.Uint16(menu[2:]); pktType != LobbyListType {
+		t.Errorf("Menu has type %02x", pktType)
+	}
+	if count := binary.LittleEndian.Uint32(menu[4:]); count != 3 {
+		t.Errorf("Menu has %d lobbies; expected 3", count)
+	}
+	for i, lobby := range []LobbyInfo{{1, 0}, {2, 5}, {3, MaxLobbyClients}} {
+		entry := menu[8+i*12:]
+		menuId := binary.LittleEndian.Uint32(entry)
+		id := binary.LittleEndian.Uint32(entry[4:])
+		players := binary.LittleEndian.Uint32(entry[8:])
+		if menuId != LobbyMenuId || id != lobby.Id || players != uint32(lobby.Players) {
+			t.Errorf("Entry %d is menu %x, lobby %d with %d players; expected lobby %d with %d",
+				i, menuId, id, players, lobby.Id, lobby.Players)
+		}
+	}
+}
+
+// A movement packet reporting position x.
+func newTestMovement(x uint32) []byte {
+	data, _ := util.BytesFromStruct(&struct {
+		Header BBHeader
+		X      uint32
+	}{BBHeader{Type: testLobbyPacketType}, x})
+	return data
+}
+
+// Read the next packet sent to peer, which must be a movement packet, and
+// return its position.
+func expectMovement(t *testing.T, peer *Client) uint32 {
+	t.Helper()
+	return binary.LittleEndian.Uint32(expectPacket(t, peer, testLobbyPacketType)[8:])
+}
+
+func TestLobbyMovementBatching(t *testing.T) {
+	l := NewLobby(1)
+	var clients, peers []*Client
+	for i := 0; i < 3; i++ {
+		c, peer := newTestClientPair(t)
+		l.AddClient(c)
+		clients = append(clients, c)
+		peers = append(peers, peer)
+	}
+	// Only the latest movement within a tick is sent.
+	for x := uint32(1); x <= 5; x++ {
+		if err := l.QueueMovement(clients[0], newTestMovement(x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.QueueMovement(clients[1], newTestMovement(20))
+	if err := l.QueueMovement(new(Client), newTestMovement(1)); err == nil {
+		t.Error("Queued movement for a client that isn't in the lobby")
+	}
+	l.FlushMovement()
+
+	if x := expectMovement(t, peers[0]); x != 20 {
+		t.Errorf("First client was sent position %d; expected 20", x)
+	}
+	if x := expectMovement(t, peers[1]); x != 5 {
+		t.Errorf("Second client was sent position %d; expected 5", x)
+	}
+	for _, expected := range []uint32{5, 20} {
+		if x := expectMovement(t, peers[2]); x != expected {
+			t.Errorf("Third client was sent position %d; expected %d", x, expected)
+		}
+	}
+
+	// Nothing is left queued, so the broadcast is the next thing sent.
+	l.FlushMovement()
+	l.Broadcast(newTestMovement(99), nil)
+	for i, peer := range peers {
+		if x := expectMovement(t, peer); x != 99 {
+			t.Errorf("Client %d was sent position %d after the flush", i, x)
+		}
+	}
+}
+
+func TestLobbyMovementTick(t *testing.T) {
+	l := NewLobby(1)
+	sender, _ := newTestClientPair(t)
+	other, otherPeer := newTestClientPair(t)
+	l.AddClient(sender)
+	l.AddClient(other)
+
+	l.Start(time.Millisecond)
+	defer l.Stop()
+	l.QueueMovement(sender, newTestMovement(7))
+	if x := expectMovement(t, otherPeer); x != 7 {
+		t.Errorf("Sent position %d; expected 7", x)
+	}
+}
+
+func TestLobbyChatBypassesMovementQueue(t *testing.T) {
+	l := NewLobby(1)
+	sender, _ := newTestClientPair(t)
+	other, otherPeer := newTestClientPair(t)
+	l.AddClient(sender)
+	l.AddClient(other)
+
+	// Chat is broadcast right away, ahead of the movement still waiting
+	// for the next tick.
+	l.QueueMovement(sender, newTestMovement(7))
+	chat, _ := util.BytesFromStruct(&BBHeader{Type: testChatPacketType})
+	l.Broadcast(chat, sender)
+	expectPacket(t, otherPeer, testChatPacketType)
+
+	l.FlushMovement()
+	if x := expectMovement(t, otherPeer); x != 7 {
+		t.Errorf("Sent position %d; expected 7", x)
+	}
+}
+
+func TestLobbyStop(t *testing.T) {
+	// Stopping a lobby that was never started doesn't hang.
+	NewLobby(1).Stop()
+
+	l := NewLobby(2)
+	l.Start(time.Millisecond)
+	l.Start(time.Millisecond)
+	l.Stop()
+	l.Stop()
+}
@@ -21,18 +21,22 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	crypto "github.com/dcrodman/archon/encryption"
-	"github.com/dcrodman/archon/prs"
 	"github.com/dcrodman/archon/util"
+	"golang.org/x/crypto/bcrypt"
 	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -91,54 +95,150 @@ type parameterEntry struct {
 	Filename [0x40]uint8
 }
 
-// Handle account verification tasks.
+// Hash a password with bcrypt for storing in account_data.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+var (
+	// Replaceable so that tests can see which hashes passwords are checked
+	// against.
+	compareHashAndPassword = bcrypt.CompareHashAndPassword
+
+	// Hash that passwords for nonexistent accounts are checked against.
+	dummyPasswordHash string
+	dummyPasswordOnce sync.Once
+)
+
+// Returns true if password matches the hash stored for an account. Accounts
+// created before passwords were hashed with bcrypt store the hex-encoded
+// sha256 of the password instead; needsRehash is set for those so that
+// the hash can be upgraded once the password is known to be right.
+func checkPassword(stored string, password []byte) (ok, needsRehash bool) {
+	if strings.HasPrefix(stored, "$2") {
+		return compareHashAndPassword([]byte(stored), password) == nil, false
+	}
+	sum := sha256.Sum256(password)
+	legacy := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(legacy), []byte(stored)) == 1, true
+}
+
+// Check password against a throwaway hash so that logging in with a
+// username that doesn't exist takes as long as using the wrong password,
+// which would otherwise reveal which usernames have accounts.
+func checkDummyPassword(password []byte) {
+	dummyPasswordOnce.Do(func() {
+		var err error
+		if dummyPasswordHash, err = HashPassword("archon-nonexistent-account"); err != nil {
+			log.Error(err.Error())
+		}
+	})
+	checkPassword(dummyPasswordHash, password)
+}
+
+// Results of HandleLogin.
+const (
+	LoginOk       = 0
+	LoginDBError  = -1
+	LoginRejected = 1
+)
+
+// Decode the 0x93 login packet in data and check the credentials in it
+// against the account table. Returns LoginOk if the client may log in, a
+// negative value if the database couldn't be read, or a positive value if
+// the credentials were rejected. The client is sent the reason for any
+// failure.
+func HandleLogin(client *Client, data []byte) int {
+	_, result, err := verifyLogin(client, data)
+	if err != nil {
+		client.Logf("Login failed: %s", err.Error())
+	}
+	return result
+}
+
+// Handle account verification tasks for the login packet the client just
+// sent, returning the packet if the client may log in.
 func VerifyAccount(client *Client) (*LoginPkt, error) {
-	var loginPkt LoginPkt
-	util.StructFromBytes(client.Data(), &loginPkt)
+	loginPkt, _, err := verifyLogin(client, client.Data())
+	return loginPkt, err
+}
 
-	// Passwords are stored as sha256 hashes, so hash what the client sent us for the query.
-	hasher := sha256.New()
-	hasher.Write(util.StripPadding(loginPkt.Password[:]))
+// Implements HandleLogin and VerifyAccount, returning the decoded packet
+// along with the result code.
+func verifyLogin(client *Client, data []byte) (*LoginPkt, int, error) {
+	var loginPkt LoginPkt
+	if err := util.StructFromBytes(data, &loginPkt); err != nil {
+		client.SendSecurity(BBLoginErrorUnknown, 0, 0)
+		return nil, LoginRejected, err
+	}
 	pktUername := string(util.StripPadding(loginPkt.Username[:]))
-	pktPassword := hex.EncodeToString(hasher.Sum(nil)[:])
+	pktPassword := util.StripPadding(loginPkt.Password[:])
 
 	var username, password string
 	var isBanned, isActive bool
-	row := config.DB().QueryRow("SELECT username, password, "+
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	row := config.DB().QueryRowContext(ctx, "SELECT username, password, "+
 		"guildcard, is_gm, is_banned, is_active, team_id from account_data "+
-		"WHERE username = ? and password = ?", pktUername, pktPassword)
+		"WHERE username = ?", pktUername)
 	err := row.Scan(&username, &password, &client.guildcard,
 		&client.isGm, &isBanned, &isActive, &client.teamId)
+	var passwordOk, needsRehash bool
+	if err == nil {
+		passwordOk, needsRehash = checkPassword(password, pktPassword)
+	} else if err == sql.ErrNoRows {
+		checkDummyPassword(pktPassword)
+	}
 	switch {
 	// Check if we have a valid username/combination.
-	case err == sql.ErrNoRows:
+	case err == sql.ErrNoRows || (err == nil && !passwordOk):
 		// The same error is returned for invalid passwords as attempts to log in
-		// with a nonexistent username as some measure of account security. Note
-		// that if this is changed to query by username and add a password check,
-		// the index on account_data will need to be modified.
+		// with a nonexistent username as some measure of account security.
 		client.SendSecurity(BBLoginErrorPassword, 0, 0)
-		return nil, errors.New("Account does not exist for username: " + pktUername)
+		return nil, LoginRejected, errors.New("Invalid username or password for username: " + pktUername)
 	// Database error?
 	case err != nil:
 		client.SendClientMessage("Encountered an unexpected error while accessing the " +
 			"database.\n\nPlease contact your server administrator.")
 		log.Error(err.Error())
-		return nil, err
+		return nil, LoginDBError, err
 	// Is the account banned?
 	case isBanned:
 		client.SendSecurity(BBLoginErrorBanned, 0, 0)
-		return nil, errors.New("Account banned: " + username)
+		return nil, LoginRejected, errors.New("Account banned: " + username)
 	// Has the account been activated?
 	case !isActive:
 		client.SendClientMessage("Encountered an unexpected error while accessing the " +
 			"database.\n\nPlease contact your server administrator.")
-		return nil, errors.New("Account must be activated for username: " + username)
+		return nil, LoginRejected, errors.New("Account must be activated for username: " + username)
+	}
+	if needsRehash {
+		if hash, err := HashPassword(string(pktPassword)); err != nil {
+			log.Error(err.Error())
+		} else if _, err = config.DB().ExecContext(ctx, "UPDATE account_data SET password = ? "+
+			"WHERE guildcard = ?", hash, client.guildcard); err != nil {
+			log.Error(err.Error())
+		}
 	}
 	// Copy over the config, which should indicate how far they are in the login flow.
-	util.StructFromBytes(loginPkt.Security[:], &client.config)
+	if err = util.StructFromBytes(loginPkt.Security[:], &client.config); err != nil {
+		client.SendSecurity(BBLoginErrorUnknown, 0, 0)
+		return nil, LoginRejected, err
+	}
+	client.SetLanguage(ParseLanguage(loginPkt.Language))
+
+	// Record where the player logged in from so that operators can find
+	// accounts sharing an address or machine.
+	_, err = config.DB().ExecContext(ctx, "UPDATE account_data SET lastip = ?, lasthwinfo = ?, "+
+		"first_ip = COALESCE(first_ip, ?), last_login = NOW() WHERE guildcard = ?", client.IPAddr(),
+		loginPkt.HardwareInfo[:], client.IPAddr(), client.guildcard)
+	if err != nil {
+		log.Error(err.Error())
+	}
 
 	// TODO: Account, hardware, and IP ban checks.
-	return &loginPkt, nil
+	return &loginPkt, LoginOk, nil
 }
 
 // Handle the initial login sent to the Login port.
@@ -156,27 +256,64 @@ func handleLogin(client *Client, charPort uint16) error {
 	// Newserv sets this field when the client first connects. I think this is
 	// used to indicate that the client has made it through the LOGIN server,
 	// but for now we'll just set it and leave it alone.
-	client.config.Magic = 0x48615467
+	client.config.Magic = ClientConfigMagic
+	// Only allow one client to be logged in to an account at a time. This is
+	// the only place sessions are registered; the other servers take over the
+	// session once the client proves it came from here.
+	if err = sessions.Add(client, config.Snapshot().KickExistingSession); err != nil {
+		client.SendSecurity(BBLoginErrorUserInUse, 0, 0)
+		return err
+	}
+	// The client echoes this back to the character server, letting it check
+	// that the connection belongs to the session that logged in here.
+	client.config.SessionToken = sessions.IssueToken(client.guildcard)
 
 	client.SendSecurity(BBLoginErrorNone, client.guildcard, client.teamId)
 	client.SendRedirect(charPort, config.HostnameBytes())
 	return nil
 }
 
+// Run a client connecting to the login port through the whole login flow:
+// send the welcome packet, wait for its login packet, authenticate it, and
+// send the security data and a redirect to the character server at charPort.
+func RunLoginSequence(client *Client, charPort uint16) error {
+	if client.SendWelcome() != 0 {
+		return errors.New("Error sending welcome packet to: " + client.IPAddr())
+	}
+	if err := client.Process(); err != nil {
+		return err
+	}
+	var hdr BBHeader
+	if err := util.StructFromBytes(client.Data(), &hdr); err != nil {
+		return err
+	} else if hdr.Type != LoginType {
+		return fmt.Errorf("Expected login packet from %s; got %02x", client.IPAddr(), hdr.Type)
+	}
+	return handleLogin(client, charPort)
+}
+
 // Handle initial login sent to the character port.
 func handleCharLogin(client *Client) error {
-	var err error = nil
-	if pkt, err := VerifyAccount(client); err == nil {
-		client.SendSecurity(BBLoginErrorNone, client.guildcard, client.teamId)
-		// At this point, if we've chosen (or created) a character then the
-		// client will send us the slot number and the corresponding phase.
-		if pkt.SlotNum >= 0 && pkt.Phase == 4 {
-			client.SendTimestamp()
-			client.SendShipList(shipList)
-			client.SendScrollMessage()
-		}
+	pkt, err := VerifyAccount(client)
+	if err != nil {
+		return err
 	}
-	return err
+	if !client.ValidateSecurityData(pkt.Security[:]) {
+		client.SendSecurity(BBLoginErrorUnknown, 0, 0)
+		return errors.New("Security data from " + client.IPAddr() +
+			" doesn't match the session for guildcard " +
+			strconv.FormatUint(uint64(client.guildcard), 10))
+	}
+	sessions.Handoff(client)
+	client.SendSecurity(BBLoginErrorNone, client.guildcard, client.teamId)
+	// At this point, if we've chosen (or created) a character then the
+	// client will send us the slot number and the corresponding phase.
+	if pkt.SlotNum >= 0 && pkt.Phase == 4 {
+		client.SendTimestamp()
+		client.SendShipList(shipList)
+		client.SendScrollMessage()
+	}
+	return nil
 }
 
 // Handle the options request - load key config and other option data from the
@@ -185,13 +322,15 @@ func handleKeyConfig(client *Client) error {
 	optionData := make([]byte, 420)
 	archondb := config.DB()
 
-	row := archondb.QueryRow(
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	row := archondb.QueryRowContext(ctx,
 		"SELECT key_config from player_options where guildcard = ?", client.guildcard)
 	err := row.Scan(&optionData)
 	if err == sql.ErrNoRows {
 		// We don't have any saved key config - give them the defaults.
 		copy(optionData[:420], baseKeyConfig[:])
-		_, err = archondb.Exec("INSERT INTO player_options (guildcard, key_config) "+
+		_, err = archondb.ExecContext(ctx, "INSERT INTO player_options (guildcard, key_config) "+
 			" VALUES (?, ?)", client.guildcard, optionData[:420])
 	}
 	if err != nil {
@@ -199,34 +338,100 @@ func handleKeyConfig(client *Client) error {
 		return err
 	}
 	client.SendOptions(optionData)
+	// The options request is only sent once the client reaches the character
+	// select screen, which makes it a convenient time to greet them.
+	if motd := config.MOTDFor(client.Language()); motd != "" {
+		client.SendClientMessage(motd)
+	}
 	return nil
 }
 
-// Handle the character select/preview request. Will either return information
-// about a character given a particular slot in via 0xE5 response or ack the
-// selection with an 0xE4 (also used for an empty slot).
-func handleCharacterSelect(client *Client) error {
-	var pkt CharSelectionPacket
-	util.StructFromBytes(client.Data(), &pkt)
-	prev := new(CharacterPreview)
+// Columns of the characters table that make up a CharacterPreview, in the
+// order scanCharacterPreview reads them.
+const characterPreviewColumns = "experience, level, guildcard_str, " +
+	"name_color, name_color_chksm, model, section_id, char_class, " +
+	"v2_flags, version, v1_flags, costume, skin, face, head, hair, " +
+	"hair_red, hair_green, hair_blue, proportion_x, proportion_y, " +
+	"name, playtime"
 
-	// Character preview request.
-	archondb := config.DB()
+// Read a preview selected with characterPreviewColumns, followed by any
+// extra columns. Returns nil for a slot that was blanked out instead of
+// deleted, since it's still empty.
+func scanCharacterPreview(scan func(dest ...interface{}) error, extra ...interface{}) (*CharacterPreview, error) {
+	prev := new(CharacterPreview)
 	var gc, name []uint8
-	row := archondb.QueryRow("SELECT experience, level, guildcard_str, "+
-		" name_color, name_color_chksm, model, section_id, char_class, "+
-		"v2_flags, version, v1_flags, costume, skin, face, head, hair, "+
-		"hair_red, hair_green, hair_blue, proportion_x, proportion_y, "+
-		"name, playtime FROM characters WHERE guildcard = ? AND slot_num = ?",
-		client.guildcard, pkt.Slot)
-	err := row.Scan(&prev.Experience, &prev.Level, &gc,
+	dest := []interface{}{&prev.Experience, &prev.Level, &gc,
 		&prev.NameColor, &prev.NameColorChksm, &prev.Model, &prev.SectionId,
 		&prev.Class, &prev.V2flags, &prev.Version, &prev.V1Flags, &prev.Costume,
 		&prev.Skin, &prev.Face, &prev.Head, &prev.Hair, &prev.HairRed,
 		&prev.HairGreen, &prev.HairBlue, &prev.PropX, &prev.PropY,
-		&name, &prev.Playtime)
+		&name, &prev.Playtime}
+	if err := scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	copy(prev.GuildcardStr[:], gc[:])
+	copy(prev.Name[:], name[:])
+	if data, _ := util.BytesFromStruct(prev); IsEmptyCharacter(data) {
+		return nil, nil
+	}
+	return prev, nil
+}
 
-	if err == sql.ErrNoRows {
+// Load the previews of the characters in each of the account's slots for
+// the character select menu. Empty slots are nil.
+func LoadCharacterPreviews(db *sql.DB, guildcard uint32) ([MaxCharacterSlots]*CharacterPreview, error) {
+	var previews [MaxCharacterSlots]*CharacterPreview
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT "+characterPreviewColumns+
+		", slot_num FROM characters WHERE guildcard = ?", guildcard)
+	if err != nil {
+		return previews, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slot int
+		prev, err := scanCharacterPreview(rows.Scan, &slot)
+		if err != nil {
+			return previews, err
+		}
+		if slot >= 0 && slot < MaxCharacterSlots {
+			previews[slot] = prev
+		}
+	}
+	return previews, rows.Err()
+}
+
+// Handle the character select/preview request. A preview request is
+// answered with the character select menu covering every slot; selecting
+// a character acks the selection with an 0xE4, which is also used for an
+// empty slot.
+func handleCharacterSelect(client *Client) error {
+	var pkt CharSelectionPacket
+	if err := util.StructFromBytes(client.Data(), &pkt); err != nil {
+		return err
+	} else if pkt.Slot >= MaxCharacterSlots {
+		return fmt.Errorf("Invalid character slot %d", pkt.Slot)
+	}
+	archondb := config.DB()
+
+	if pkt.Selecting != 0x01 {
+		previews, err := LoadCharacterPreviews(archondb, client.guildcard)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		client.SendCharacterSelectMenu(previews)
+		return nil
+	}
+
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	row := archondb.QueryRowContext(ctx, "SELECT "+characterPreviewColumns+
+		" FROM characters WHERE guildcard = ? AND slot_num = ?",
+		client.guildcard, pkt.Slot)
+	prev, err := scanCharacterPreview(row.Scan)
+	if err == sql.ErrNoRows || (err == nil && prev == nil) {
 		// We don't have a character for this slot.
 		client.SendCharacterAck(pkt.Slot, 2)
 		return nil
@@ -235,25 +440,73 @@ func handleCharacterSelect(client *Client) error {
 		return err
 	}
 
-	if pkt.Selecting == 0x01 {
-		// They've selected a character from the menu.
-		client.config.SlotNum = uint8(pkt.Slot)
-		client.SendSecurity(BBLoginErrorNone, client.guildcard, client.teamId)
-		client.SendCharacterAck(pkt.Slot, 1)
-	} else {
-		// They have a character in that slot; send the character preview.
-		copy(prev.GuildcardStr[:], gc[:])
-		copy(prev.Name[:], name[:])
-		client.SendCharacterPreview(prev)
+	// They've selected a character from the menu; load the rest of it
+	// so that it's ready once they move on to the ship.
+	fc, err := LoadFullCharacter(archondb, client.guildcard, pkt.Slot)
+	if err == ErrCorruptCharacter {
+		client.SendClientMessage("This character's data is damaged and can't be loaded.")
+		return err
+	} else if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if client.character != nil {
+		// Switching characters; save the one they had selected first.
+		if err := saveClientCharacter(client); err != nil {
+			log.Error(err.Error())
+		}
+	}
+	client.character = fc
+	client.sharedBank = false
+	client.config.SlotNum = uint8(pkt.Slot)
+	if config.Snapshot().FeatureEnabled(FeatureSharedBank) {
+		if err := useSharedBank(client, archondb); err != nil {
+			log.Error(err.Error())
+			return err
+		}
 	}
+	client.SendSecurity(BBLoginErrorNone, client.guildcard, client.teamId)
+	client.SendCharacterAck(pkt.Slot, 1)
 	return nil
 }
 
+// Returns true if the checksum the client sent matches the one
+// configured for unmodified clients. The checksum isn't part of the login
+// packet; BB clients send it separately in 0x01E8 before logging in.
+func ValidateLoginChecksum(p *ChecksumPacket) bool {
+	return p.Checksum == config.ClientChecksum
+}
+
+// Ack the client's file checksum, rejecting it if it doesn't match and
+// the server is configured to turn away modified clients.
+func handleChecksum(client *Client) error {
+	var pkt ChecksumPacket
+	if err := util.StructFromBytes(client.Data(), &pkt); err != nil {
+		return err
+	}
+	if config.RejectModifiedClients && !ValidateLoginChecksum(&pkt) {
+		client.SendChecksumAck(0)
+		return fmt.Errorf("Rejected client checksum %08x from %s", pkt.Checksum, client.IPAddr())
+	}
+	client.SendChecksumAck(1)
+	return nil
+}
+
+// Returns the checksum of data sent to the client in chunks (guildcard
+// data and parameter files), which the client verifies once it has every
+// chunk. The client uses the standard IEEE CRC32; if the checksum doesn't
+// match, the client rejects the whole transfer.
+func TransferChecksum(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
 // Load the player's saved guildcards, build the chunk data, and
 // send the chunk header.
 func handleGuildcardDataStart(client *Client) error {
 	archondb := config.DB()
-	rows, err := archondb.Query(
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	rows, err := archondb.QueryContext(ctx,
 		"SELECT friend_gc, name, team_name, description, language, "+
 			"section_id, char_class, comment FROM guildcard_entries "+
 			"WHERE guildcard = ?", client.guildcard)
@@ -265,7 +518,7 @@ func handleGuildcardDataStart(client *Client) error {
 	gcData := new(GuildcardData)
 
 	// Maximum of 140 entries can be sent.
-	for i := 0; rows.Next() && i < 140; i++ {
+	for i := 0; rows.Next() && i < 140; {
 		// TODO: This may not actually work yet, but I haven't gotten to
 		// figuring out how this is used yet.
 		var name, teamName, desc, comment []uint8
@@ -276,10 +529,17 @@ func handleGuildcardDataStart(client *Client) error {
 			log.Error(err.Error())
 			return err
 		}
+		// Leave out corrupt entries rather than sending them to the client.
+		if err = entry.Validate(); err != nil {
+			log.Warn(err.Error())
+			*entry = GuildcardEntry{}
+			continue
+		}
+		i++
 	}
 	var size int
 	client.gcData, size = util.BytesFromStruct(gcData)
-	checksum := crc32.ChecksumIEEE(client.gcData)
+	checksum := TransferChecksum(client.gcData)
 	client.gcDataSize = uint16(size)
 
 	client.SendGuildcardHeader(checksum, client.gcDataSize)
@@ -287,28 +547,336 @@ func handleGuildcardDataStart(client *Client) error {
 }
 
 // Send another chunk of the client's guildcard data.
-func handleGuildcardChunk(client *Client) {
+func handleGuildcardChunk(client *Client) error {
 	var chunkReq GuildcardChunkReqPacket
-	util.StructFromBytes(client.Data(), &chunkReq)
+	if err := util.StructFromBytes(client.Data(), &chunkReq); err != nil {
+		return err
+	}
 	if chunkReq.Continue != 0x01 {
 		// Cancelled sending guildcard chunks.
-		return
+		return nil
+	} else if uint64(chunkReq.ChunkRequested)*MaxChunkSize >= uint64(client.gcDataSize) {
+		return fmt.Errorf("Invalid guildcard chunk %d", chunkReq.ChunkRequested)
 	}
 	client.SendGuildcardChunk(chunkReq.ChunkRequested)
+	return nil
+}
+
+// Returns true if any of the account's characters other than the one in
+// ignoreSlot is named name. Names are compared as the player would see
+// them so that differences in encoding don't matter.
+func AccountHasCharacterNamed(db *sql.DB, guildcard uint32, name string, ignoreSlot uint32) (bool, error) {
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT name FROM characters "+
+		"WHERE guildcard = ? AND slot_num != ?", guildcard, ignoreSlot)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var charName []uint8
+		if err = rows.Scan(&charName); err != nil {
+			return false, err
+		}
+		if displayName(util.CompressUtf16(charName)) == name {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Check that a new character's class and section ID are valid and that the
+// class is one of the AllowedClasses in cfg (if any are listed).
+func ValidateClassSection(class CharClass, section SectionID, cfg ConfigView) error {
+	if class >= NumCharClasses {
+		return fmt.Errorf("Invalid class %d", class)
+	} else if section > Whitill {
+		return fmt.Errorf("Invalid section ID %d", section)
+	}
+	if len(cfg.AllowedClasses) == 0 {
+		return nil
+	}
+	for _, allowed := range cfg.AllowedClasses {
+		if strings.EqualFold(allowed, class.String()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Class %s is not allowed on this server", class)
+}
+
+// Number of characters an account can have.
+const MaxCharacterSlots = 4
+
+// Slot in a character creation request asking for the character to be put
+// in the first empty slot.
+const AnyCharacterSlot = 0xFFFFFFFF
+
+// Which of an account's character slots are in use.
+type CharacterSlots [MaxCharacterSlots]bool
+
+// Returns the lowest numbered slot without a character in it, or false if
+// every slot is taken.
+func (cs CharacterSlots) FirstFreeSlot() (int, bool) {
+	for i, used := range cs {
+		if !used {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// Look up which of the account's slots have characters in them.
+func LoadCharacterSlots(db *sql.DB, guildcard uint32) (CharacterSlots, error) {
+	var slots CharacterSlots
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT slot_num FROM characters WHERE guildcard = ?", guildcard)
+	if err != nil {
+		return slots, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slot int
+		if err = rows.Scan(&slot); err != nil {
+			return slots, err
+		}
+		if slot >= 0 && slot < MaxCharacterSlots {
+			slots[slot] = true
+		}
+	}
+	return slots, rows.Err()
+}
+
+// Returns the number of characters stored for the account, including any
+// outside the slots the client knows about.
+func CountCharacters(db *sql.DB, guildcard uint32) (int, error) {
+	var count int
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM characters WHERE guildcard = ?",
+		guildcard).Scan(&count)
+	return count, err
+}
+
+// Returns the number of characters stored for the account other than the
+// one in slot.
+func countOtherCharacters(db *sql.DB, guildcard, slot uint32) (int, error) {
+	var count int
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM characters WHERE guildcard = ? "+
+		"AND slot_num != ?", guildcard, slot).Scan(&count)
+	return count, err
+}
+
+// Returns how long ago the character in slot was created.
+func CharacterAge(db *sql.DB, guildcard uint32, slot int) (time.Duration, error) {
+	var seconds int64
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	row := db.QueryRowContext(ctx, "SELECT TIMESTAMPDIFF(SECOND, creation_time, NOW()) "+
+		"FROM characters WHERE guildcard = ? AND slot_num = ?", guildcard, slot)
+	if err := row.Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Load the character in slot from the database. The full character is
+// read from the saved character data, which must match its checksum, and
+// the fields stored in their own columns (which the dressing room changes)
+// are applied on top of it. Characters that haven't been saved since the
+// data was added only have the column fields filled in.
+func LoadFullCharacter(db *sql.DB, guildcard uint32, slot uint32) (*FullCharacter, error) {
+	var data []byte
+	var checksum sql.NullInt64
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	row := db.QueryRowContext(ctx, "SELECT char_data, char_checksum FROM characters "+
+		"WHERE guildcard = ? AND slot_num = ?", guildcard, slot)
+	if err := row.Scan(&data, &checksum); err != nil {
+		return nil, err
+	}
+	var fc *FullCharacter
+	if len(data) > 0 {
+		var err error
+		if fc, err = VerifyStoredCharacter(data, uint32(checksum.Int64)); err != nil {
+			log.Errorf("Stored data for character %d in slot %d is corrupt", guildcard, slot)
+			return nil, err
+		}
+	} else {
+		fc = &FullCharacter{Options: DefaultOptions}
+		fc.Character.clearTechniques()
+	}
+
+	c := &fc.Character
+	var gc, name []uint8
+	row = db.QueryRowContext(ctx, "SELECT experience, level, guildcard_str, "+
+		"name_color, name_color_chksm, model, section_id, char_class, "+
+		"v2_flags, version, v1_flags, costume, skin, face, head, hair, "+
+		"hair_red, hair_green, hair_blue, proportion_x, proportion_y, "+
+		"name, playtime, atp, mst, evp, hp, dfp, ata, lck, meseta, bank_meseta "+
+		"FROM characters WHERE guildcard = ? AND slot_num = ?", guildcard, slot)
+	err := row.Scan(&c.Experience, &c.Level, &gc, &c.NameColor,
+		&c.NameColorChksm, &c.Model, &c.SectionId, &c.Class, &c.V2flags,
+		&c.Version, &c.V1Flags, &c.Costume, &c.Skin, &c.Face, &c.Head,
+		&c.Hair, &c.HairRed, &c.HairGreen, &c.HairBlue, &c.PropX, &c.PropY,
+		&name, &c.Playtime, &c.Stats.ATP, &c.Stats.MST, &c.Stats.EVP,
+		&c.Stats.HP, &c.Stats.DFP, &c.Stats.ATA, &c.Stats.LCK, &c.Meseta,
+		&fc.Bank.Meseta)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.GuildcardStr[:], gc)
+	copy(c.Name[:], util.CompressUtf16(name))
+	copy(fc.Name[:], c.Name[:])
+	fc.Guildcard = guildcard
+	fc.SectionId = c.SectionId
+	fc.Class = c.Class
+	fc.Bank.Repair()
+	return fc, nil
+}
+
+// Write fc back to the character in slot, along with its checksum. Characters
+// that fail validation aren't written.
+func SaveCharacter(db *sql.DB, guildcard, slot uint32, fc *FullCharacter) error {
+	if err := fc.Validate(); err != nil {
+		return fmt.Errorf("Refusing to save character %d in slot %d: %s",
+			guildcard, slot, err.Error())
+	}
+	data, _ := util.BytesFromStruct(fc)
+	c := &fc.Character
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	_, err := db.ExecContext(ctx, "UPDATE characters SET experience=?, level=?, "+
+		"playtime=?, atp=?, mst=?, evp=?, hp=?, dfp=?, ata=?, lck=?, "+
+		"meseta=?, bank_meseta=?, char_data=?, char_checksum=? "+
+		"WHERE guildcard = ? AND slot_num = ?",
+		c.Experience, c.Level, c.Playtime, c.Stats.ATP, c.Stats.MST,
+		c.Stats.EVP, c.Stats.HP, c.Stats.DFP, c.Stats.ATA, c.Stats.LCK,
+		c.Meseta, fc.Bank.Meseta, data, fc.Checksum(), guildcard, slot)
+	return err
+}
+
+// Load the bank shared by all of the account's characters. ok is false if
+// the account doesn't have one yet.
+func LoadSharedBank(db *sql.DB, guildcard uint32) (bank Bank, ok bool, err error) {
+	var data []byte
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	err = db.QueryRowContext(ctx, "SELECT bank FROM shared_banks WHERE guildcard = ?",
+		guildcard).Scan(&data)
+	if err == sql.ErrNoRows {
+		return bank, false, nil
+	} else if err != nil {
+		return bank, false, err
+	}
+	if err = util.StructFromBytes(data, &bank); err != nil {
+		return bank, false, err
+	}
+	bank.Repair()
+	return bank, true, nil
+}
+
+// Write the account's shared bank. Banks that fail validation aren't written.
+func SaveSharedBank(db *sql.DB, guildcard uint32, bank *Bank) error {
+	if err := bank.Validate(); err != nil {
+		return fmt.Errorf("Refusing to save shared bank for %d: %s", guildcard, err.Error())
+	}
+	data, _ := util.BytesFromStruct(bank)
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	_, err := db.ExecContext(ctx, "INSERT INTO shared_banks (guildcard, bank) VALUES (?, ?) "+
+		"ON DUPLICATE KEY UPDATE bank = VALUES(bank)", guildcard, data)
+	return err
+}
+
+// Swap the client's character's bank for the account's shared bank, keeping
+// the character's own bank aside so that it's saved untouched.
+func useSharedBank(client *Client, db *sql.DB) error {
+	bank, _, err := LoadSharedBank(db, client.guildcard)
+	if err != nil {
+		return err
+	}
+	client.ownBank = client.character.Bank
+	client.character.Bank = bank
+	client.sharedBank = true
+	return nil
+}
+
+// Queue for character saves; nil if saves are written immediately.
+var characterSaves *SaveQueue
+
+// Save the client's selected character, either immediately or through the
+// save queue if one is configured. A shared bank is always written
+// immediately, since other characters on the account can load it.
+func saveClientCharacter(client *Client) error {
+	slot := uint32(client.config.SlotNum)
+	fc := client.character
+	if client.sharedBank {
+		if err := SaveSharedBank(config.DB(), client.guildcard, &fc.Bank); err != nil {
+			return err
+		}
+		saved := *fc
+		saved.Bank = client.ownBank
+		fc = &saved
+	}
+	if characterSaves != nil {
+		characterSaves.Queue(client.guildcard, slot, fc)
+		return nil
+	}
+	return SaveCharacter(config.DB(), client.guildcard, slot, fc)
 }
 
 // Create or update a character in a slot.
 func handleCharacterUpdate(client *Client) error {
 	var charPkt CharPreviewPacket
 	charPkt.Character = new(CharacterPreview)
-	util.StructFromBytes(client.Data(), &charPkt)
+	if err := util.StructFromBytes(client.Data(), &charPkt); err != nil {
+		return err
+	}
+	archonDB := config.DB()
+	if charPkt.Slot == AnyCharacterSlot && client.flag != 0x02 {
+		// No slot given for a new character; use the first empty one.
+		slots, err := LoadCharacterSlots(archonDB, client.guildcard)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		slot, ok := slots.FirstFreeSlot()
+		if !ok {
+			client.SendClientMessage("You can't create any more characters.")
+			return fmt.Errorf("Guildcard %d has no free character slots", client.guildcard)
+		}
+		charPkt.Slot = uint32(slot)
+	}
+	if charPkt.Slot >= MaxCharacterSlots {
+		return fmt.Errorf("Invalid character slot %d", charPkt.Slot)
+	}
 	p := charPkt.Character
+	if err := p.ValidateAppearance(); err != nil {
+		return err
+	}
+	p.NormalizeColors()
+
+	ctx, cancel := config.QueryContext()
+	defer cancel()
+	exists, err := AccountHasCharacterNamed(archonDB, client.guildcard, p.DisplayName(), charPkt.Slot)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	} else if exists {
+		client.SendClientMessage("You already have a character with that name.")
+		return errors.New("Duplicate character name for guildcard " +
+			strconv.FormatUint(uint64(client.guildcard), 10))
+	}
 
-	archonDB := config.DB()
 	if client.flag == 0x02 {
 		// Player is using the dressing room; update the character. Messy
 		// query, but unavoidable if we don't want to be stuck with blobs.
-		_, err := archonDB.Exec("UPDATE characters SET name_color=?, model=?, "+
+		_, err := archonDB.ExecContext(ctx, "UPDATE characters SET name_color=?, model=?, "+
 			"name_color_chksm=?, section_id=?, char_class=?, costume=?, skin=?, "+
 			"head=?, hair_red=?, hair_green=?, hair_blue,=? proportion_x=?, "+
 			"proportion_y=?, name=? WHERE guildcard = ? AND slot_num = ?",
@@ -321,8 +889,25 @@ func handleCharacterUpdate(client *Client) error {
 			return err
 		}
 	} else {
+		err := ValidateClassSection(CharClass(p.Class), SectionID(p.SectionId), config.Snapshot())
+		if err != nil {
+			client.SendClientMessage("That class can't be created on this server.")
+			return err
+		}
+		// The character being replaced doesn't count, so the account should
+		// have room unless the client has been getting characters stored
+		// some other way. Checked before the delete so that a rejected
+		// request leaves the existing character alone.
+		count, err := countOtherCharacters(archonDB, client.guildcard, charPkt.Slot)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		} else if count >= MaxCharacterSlots {
+			client.SendClientMessage("You can't create any more characters.")
+			return fmt.Errorf("Guildcard %d already has %d characters", client.guildcard, count)
+		}
 		// Delete a character if it already exists.
-		_, err := archonDB.Exec("DELETE FROM characters WHERE "+
+		_, err = archonDB.ExecContext(ctx, "DELETE FROM characters WHERE "+
 			"guildcard = ? AND slot_num = ?", client.guildcard, charPkt.Slot)
 		if err != nil {
 			log.Error(err.Error())
@@ -341,14 +926,14 @@ func handleCharacterUpdate(client *Client) error {
 		*/
 
 		// Create the new character.
-		_, err = archonDB.Exec("INSERT INTO characters (guildcard, slot_num,"+
+		_, err = archonDB.ExecContext(ctx, "INSERT INTO characters (guildcard, slot_num,"+
 			"experience, level, guildcard_str, name_color, model, name_color_chksm,"+
 			"section_id, char_class, v2_flags, version, v1_flags, costume,"+
 			"skin, face, head, hair, hair_red, hair_green, hair_blue,"+
 			"proportion_x, proportion_y, name, playtime, atp, mst, evp, "+
-			"hp, dfp, ata, lck, meseta, bank_use, bank_meseta) "+
+			"hp, dfp, ata, lck, meseta, bank_use, bank_meseta, creation_time) "+
 			"VALUES (?, ?, 0, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
-			"?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0)",
+			"?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, NOW())",
 			client.guildcard, charPkt.Slot, p.GuildcardStr[:], p.NameColor,
 			p.Model, p.NameColorChksm, p.SectionId, p.Class, p.V2flags,
 			p.Version, p.V1Flags, p.Costume, p.Skin, p.Face, p.Head,
@@ -370,14 +955,15 @@ func handleCharacterUpdate(client *Client) error {
 
 // Player selected one of the items on the ship select screen.
 func handleShipSelection(client *Client) error {
-	var pkt MenuSelectionPacket
-	util.StructFromBytes(client.Data(), &pkt)
-	selectedShip := pkt.ItemId - 1
-	if selectedShip < 0 || selectedShip >= uint32(len(shipList)) {
-		return errors.New("Invalid ship selection: " + string(selectedShip))
-	}
-	s := &shipList[selectedShip]
-	client.SendRedirect(s.port, s.ipAddr)
+	_, itemId, err := ParseMenuSelection(client.Data()[:client.packetSize])
+	if err != nil {
+		return err
+	}
+	selectedShip := itemId - 1
+	if selectedShip >= uint32(len(shipList)) {
+		return fmt.Errorf("Invalid ship selection %d", itemId)
+	}
+	client.SendShipRedirect(shipList[selectedShip].addr)
 	return nil
 }
 
@@ -385,9 +971,7 @@ func handleShipSelection(client *Client) error {
 // to send the welcome packet to begin encryption.
 func NewLoginClient(conn *net.TCPConn) (*Client, error) {
 	var err error
-	cCrypt := crypto.NewBBCrypt()
-	sCrypt := crypto.NewBBCrypt()
-	lc := NewClient(conn, BBHeaderSize, cCrypt, sCrypt)
+	lc := newBBClient(conn)
 	if lc.SendWelcome() != 0 {
 		err = errors.New("Error sending welcome packet to: " + lc.IPAddr())
 		lc = nil
@@ -395,6 +979,11 @@ func NewLoginClient(conn *net.TCPConn) (*Client, error) {
 	return lc, err
 }
 
+// Create a client using BB encryption without sending the welcome packet.
+func newBBClient(conn *net.TCPConn) *Client {
+	return NewClient(conn, BBHeaderSize, crypto.NewBBCrypt(), crypto.NewBBCrypt())
+}
+
 // Login sub-server definition.
 type LoginServer struct {
 	// Cached and parsed representation of the character port.
@@ -423,7 +1012,7 @@ func (server LoginServer) loadParameterFiles() {
 
 		entry := new(parameterEntry)
 		entry.Size = uint32(fileSize)
-		entry.Checksum = crc32.ChecksumIEEE(data)
+		entry.Checksum = TransferChecksum(data)
 		entry.Offset = uint32(offset)
 		copy(entry.Filename[:], []uint8(paramFile))
 
@@ -456,21 +1045,31 @@ func (server LoginServer) loadParameterFiles() {
 func (server *LoginServer) Init() {
 	server.loadParameterFiles()
 
-	// Load the base stats for creating new characters. Newserv, Sylverant, and Tethealla
-	// all seem to rely on this file, so we'll do the same.
-	paramDir := config.ParametersDir
-	statsFile, _ := os.Open(paramDir + "/PlyLevelTbl.prs")
-	compressed, err := ioutil.ReadAll(statsFile)
+	// Load the base stats for creating new characters and the level tables
+	// used to check character stats. Newserv, Sylverant, and Tethealla all
+	// seem to rely on this file, so we'll do the same.
+	err := LoadLevelTable(config.ParametersDir + "/PlyLevelTbl.prs")
 	if err != nil {
 		fmt.Println("Error reading stats file: " + err.Error())
 		os.Exit(1)
 	}
-	decompressedSize := prs.DecompressSize(compressed)
-	decompressed := make([]byte, decompressedSize)
-	prs.Decompress(compressed, decompressed)
 
-	for i := 0; i < 12; i++ {
-		util.StructFromBytes(decompressed[i*14:], &BaseStats[i])
+	// Customized stat tables replace the defaults if the server has any.
+	if config.StatTablesFile != "" {
+		err = LoadStatTables(config.StatTablesFile)
+		if os.IsNotExist(err) {
+			fmt.Printf("Stat table file %s not found; using defaults\n", config.StatTablesFile)
+		} else if err != nil {
+			fmt.Println("Error loading stat tables: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if config.ItemTableFile != "" {
+		if itemTable, err = LoadItemTable(config.ItemTableFile); err != nil {
+			fmt.Println("Error loading item table: " + err.Error())
+			os.Exit(1)
+		}
 	}
 
 	charPort, _ := strconv.ParseUint(config.CharacterPort, 10, 16)
@@ -478,14 +1077,21 @@ func (server *LoginServer) Init() {
 	fmt.Println()
 }
 
+// The welcome packet is sent by StartClient as part of the login sequence.
 func (server LoginServer) NewClient(conn *net.TCPConn) (*Client, error) {
-	return NewLoginClient(conn)
+	return newBBClient(conn), nil
+}
+
+func (server LoginServer) StartClient(c *Client) error {
+	return RunLoginSequence(c, server.charRedirectPort)
 }
 
 func (server LoginServer) Handle(c *Client) error {
-	var err error = nil
 	var hdr BBHeader
-	util.StructFromBytes(c.Data()[:BBHeaderSize], &hdr)
+	err := util.StructFromBytes(c.Data(), &hdr)
+	if err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case LoginType:
@@ -494,7 +1100,7 @@ func (server LoginServer) Handle(c *Client) error {
 		// Just wait until we recv 0 from the client to d/c.
 		break
 	default:
-		log.Infof("Received unknown packet %x from %s", hdr.Type, c.IPAddr())
+		c.Logf("Received unknown packet %x", hdr.Type)
 	}
 	return err
 }
@@ -513,9 +1119,11 @@ func (server CharacterServer) NewClient(conn *net.TCPConn) (*Client, error) {
 }
 
 func (server CharacterServer) Handle(c *Client) error {
-	var err error = nil
 	var hdr BBHeader
-	util.StructFromBytes(c.Data()[:BBHeaderSize], &hdr)
+	err := util.StructFromBytes(c.Data(), &hdr)
+	if err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case LoginType:
@@ -528,28 +1136,35 @@ func (server CharacterServer) Handle(c *Client) error {
 	case LoginCharPreviewReqType:
 		err = handleCharacterSelect(c)
 	case LoginChecksumType:
-		// Everybody else seems to ignore this, so...
-		c.SendChecksumAck(1)
+		err = handleChecksum(c)
 	case LoginGuildcardReqType:
 		err = handleGuildcardDataStart(c)
 	case LoginGuildcardChunkReqType:
-		handleGuildcardChunk(c)
+		err = handleGuildcardChunk(c)
 	case LoginParameterHeaderReqType:
 		c.SendParameterHeader(uint32(len(paramFiles)), paramHeaderData)
 	case LoginParameterChunkReqType:
 		var pkt BBHeader
-		util.StructFromBytes(c.Data(), &pkt)
-		c.SendParameterChunk(paramChunkData[int(pkt.Flags)], pkt.Flags)
+		if err = util.StructFromBytes(c.Data(), &pkt); err != nil {
+			break
+		}
+		chunk, ok := paramChunkData[int(pkt.Flags)]
+		if !ok {
+			err = fmt.Errorf("Invalid parameter chunk %d", pkt.Flags)
+			break
+		}
+		c.SendParameterChunk(chunk, pkt.Flags)
 	case LoginSetFlagType:
 		var pkt SetFlagPacket
-		util.StructFromBytes(c.Data(), &pkt)
-		c.flag = pkt.Flag
+		if err = util.StructFromBytes(c.Data(), &pkt); err == nil {
+			c.flag = pkt.Flag
+		}
 	case LoginCharPreviewType:
 		err = handleCharacterUpdate(c)
 	case MenuSelectType:
 		err = handleShipSelection(c)
 	default:
-		log.Infof("Received unknown packet %x from %s", hdr.Type, c.IPAddr())
+		c.Logf("Received unknown packet %x", hdr.Type)
 	}
 	return err
 }
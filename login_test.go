@@ -0,0 +1,1181 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"github.com/dcrodman/archon/util"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveCharacter(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fc := NewTestCharacter(t, WithClass(Ramar), WithLevel(9), WithItems())
+	fake.Expect("UPDATE characters SET").WillAffect(1)
+	if err := SaveCharacter(db, fc.Guildcard, 0, fc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveCharacterRejectsInvalid(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fc := NewTestCharacter(t)
+	// The class in the character data no longer matches the header.
+	fc.Character.Class = byte(Fonewm)
+	if err := SaveCharacter(db, fc.Guildcard, 0, fc); err == nil {
+		t.Error("Saved a character that failed validation")
+	}
+	if log := fake.Log(); len(log) > 0 {
+		t.Errorf("Ran %v for a character that failed validation", log)
+	}
+}
+
+func TestSaveClientCharacterQueues(t *testing.T) {
+	var saved []uint32
+	queue := NewSaveQueue(time.Hour, func(gc, slot uint32, fc *FullCharacter) error {
+		saved = append(saved, slot)
+		return nil
+	})
+	prev := characterSaves
+	characterSaves = queue
+	defer func() { characterSaves = prev }()
+
+	client := &Client{guildcard: 42000001, character: NewTestCharacter(t)}
+	client.config.SlotNum = 2
+	if err := saveClientCharacter(client); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Error("Character was saved immediately instead of being queued")
+	}
+	if err := queue.FlushCharacter(client.guildcard, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0] != 2 {
+		t.Errorf("Flushing the queue saved slots %v; expected [2]", saved)
+	}
+}
+
+var characterColumns = []string{"experience", "level", "guildcard_str",
+	"name_color", "name_color_chksm", "model", "section_id", "char_class",
+	"v2_flags", "version", "v1_flags", "costume", "skin", "face", "head",
+	"hair", "hair_red", "hair_green", "hair_blue", "proportion_x",
+	"proportion_y", "name", "playtime", "atp", "mst", "evp", "hp", "dfp",
+	"ata", "lck", "meseta", "bank_meseta"}
+
+// Returns the characters table columns for fc as they would be stored.
+func characterRow(fc *FullCharacter) []driver.Value {
+	c := &fc.Character
+	name := util.ExpandUtf16(c.Name[:])
+	return []driver.Value{int64(c.Experience), int64(c.Level),
+		c.GuildcardStr[:], int64(c.NameColor), int64(c.NameColorChksm),
+		int64(c.Model), int64(c.SectionId), int64(c.Class), int64(c.V2flags),
+		int64(c.Version), int64(c.V1Flags), int64(c.Costume), int64(c.Skin),
+		int64(c.Face), int64(c.Head), int64(c.Hair), int64(c.HairRed),
+		int64(c.HairGreen), int64(c.HairBlue), float64(c.PropX),
+		float64(c.PropY), name, int64(c.Playtime), int64(c.Stats.ATP),
+		int64(c.Stats.MST), int64(c.Stats.EVP), int64(c.Stats.HP),
+		int64(c.Stats.DFP), int64(c.Stats.ATA), int64(c.Stats.LCK),
+		int64(c.Meseta), int64(fc.Bank.Meseta)}
+}
+
+func expectCharacterLoad(fake *fakeDB, fc *FullCharacter, data []byte, checksum uint32) {
+	fake.Expect("SELECT char_data, char_checksum FROM characters").
+		WillReturnRows([]string{"char_data", "char_checksum"},
+			[]driver.Value{data, int64(checksum)})
+	fake.Expect("SELECT experience, level").
+		WillReturnRows(characterColumns, characterRow(fc))
+}
+
+func TestLoadFullCharacterVerifiesChecksum(t *testing.T) {
+	saved := NewTestCharacter(t, WithClass(Hunewearl), WithItems(), WithBank())
+	data, _ := util.BytesFromStruct(saved)
+
+	db, fake := newFakeDB(t)
+	expectCharacterLoad(fake, saved, data, saved.Checksum())
+	fc, err := LoadFullCharacter(db, saved.Guildcard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Inventory != saved.Inventory || fc.Bank != saved.Bank {
+		t.Error("Loaded character's items don't match the saved data")
+	}
+
+	db, fake = newFakeDB(t)
+	fake.Expect("SELECT char_data, char_checksum FROM characters").
+		WillReturnRows([]string{"char_data", "char_checksum"},
+			[]driver.Value{data, int64(saved.Checksum() + 1)})
+	if _, err := LoadFullCharacter(db, saved.Guildcard, 0); err != ErrCorruptCharacter {
+		t.Errorf("Loading a character with a bad checksum returned %v", err)
+	}
+}
+
+func TestLoadFullCharacterWithoutData(t *testing.T) {
+	saved := NewTestCharacter(t, WithClass(Racast), WithLevel(19))
+	db, fake := newFakeDB(t)
+	expectCharacterLoad(fake, saved, nil, 0)
+	fc, err := LoadFullCharacter(db, saved.Guildcard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Character.Level != 19 || fc.Class != uint8(Racast) {
+		t.Error("Column fields weren't loaded")
+	}
+	if err := fc.Validate(); err != nil {
+		t.Errorf("Character loaded from columns failed validation: %s", err.Error())
+	}
+}
+
+func TestLoadFullCharacterRepairsBank(t *testing.T) {
+	saved := NewTestCharacter(t, WithBank())
+	saved.Bank.NumItems = 150
+	data, _ := util.BytesFromStruct(saved)
+
+	db, fake := newFakeDB(t)
+	expectCharacterLoad(fake, saved, data, saved.Checksum())
+	fc, err := LoadFullCharacter(db, saved.Guildcard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Bank.NumItems != 2 {
+		t.Errorf("Loaded bank has %d items; expected 2", fc.Bank.NumItems)
+	}
+	if err := fc.Validate(); err != nil {
+		t.Errorf("Loaded character failed validation: %v", err)
+	}
+}
+
+func TestLoadSharedBankRepairs(t *testing.T) {
+	shared := Bank{Meseta: MaxMeseta + 1, NumItems: 150}
+	shared.Items[3] = BankItem{Item: Item{Data: [12]uint8{ItemTypeTool, 0x02}, ItemId: 0x10000}, Amount: 3}
+	data, _ := util.BytesFromStruct(&shared)
+
+	db, fake := newFakeDB(t)
+	fake.Expect("SELECT bank FROM shared_banks").
+		WillReturnRows([]string{"bank"}, []driver.Value{data})
+	bank, ok, err := LoadSharedBank(db, 42000001)
+	if err != nil || !ok {
+		t.Fatalf("Loading the shared bank returned %v, %v", ok, err)
+	}
+	if bank.NumItems != 1 || bank.Items[0].Amount != 3 || bank.Meseta != MaxMeseta {
+		t.Errorf("Shared bank wasn't repaired: %d items, %d meseta", bank.NumItems, bank.Meseta)
+	}
+}
+
+// Returns the arguments SaveCharacter updates the character in slot with.
+func characterSaveArgs(fc *FullCharacter, slot uint32) []driver.Value {
+	data, _ := util.BytesFromStruct(fc)
+	c := &fc.Character
+	return []driver.Value{int64(c.Experience), int64(c.Level),
+		int64(c.Playtime), int64(c.Stats.ATP), int64(c.Stats.MST),
+		int64(c.Stats.EVP), int64(c.Stats.HP), int64(c.Stats.DFP),
+		int64(c.Stats.ATA), int64(c.Stats.LCK), int64(c.Meseta),
+		int64(fc.Bank.Meseta), data, int64(fc.Checksum()),
+		int64(fc.Guildcard), int64(slot)}
+}
+
+func TestSaveCharacterWritesChecksum(t *testing.T) {
+	fc := NewTestCharacter(t, WithItems())
+	db, fake := newFakeDB(t)
+	fake.Expect("char_data=?, char_checksum=?").
+		WithArgs(characterSaveArgs(fc, 3)...).WillAffect(1)
+	if err := SaveCharacter(db, fc.Guildcard, 3, fc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedBank(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+
+	fc := NewTestCharacter(t, WithBank())
+	own := fc.Bank
+	shared := Bank{Meseta: 5000}
+	shared.Items[0] = BankItem{Item: Item{Data: [12]uint8{ItemTypeTool, 0x02}, ItemId: 0x10000}, Amount: 3}
+	shared.NumItems = 1
+	sharedData, _ := util.BytesFromStruct(&shared)
+
+	client := &Client{guildcard: fc.Guildcard, character: fc}
+	fake.Expect("SELECT bank FROM shared_banks").
+		WillReturnRows([]string{"bank"}, []driver.Value{sharedData})
+	if err := useSharedBank(client, db); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Bank != shared {
+		t.Fatal("Character wasn't given the shared bank")
+	}
+
+	// Saving writes the shared bank to its own table and the character with
+	// its own bank.
+	fc.Bank.Meseta = 6000
+	shared.Meseta = 6000
+	sharedData, _ = util.BytesFromStruct(&shared)
+	saved := *fc
+	saved.Bank = own
+	fake.Expect("INSERT INTO shared_banks").
+		WithArgs(int64(fc.Guildcard), sharedData).WillAffect(1)
+	fake.Expect("UPDATE characters SET").
+		WithArgs(characterSaveArgs(&saved, 0)...).WillAffect(1)
+	if err := saveClientCharacter(client); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Bank != shared {
+		t.Error("Saving changed the shared bank the character is using")
+	}
+}
+
+func TestFirstFreeSlot(t *testing.T) {
+	tests := []struct {
+		slots CharacterSlots
+		slot  int
+		ok    bool
+	}{
+		{CharacterSlots{}, 0, true},
+		{CharacterSlots{true, false, true, false}, 1, true},
+		{CharacterSlots{true, true, true, false}, 3, true},
+		{CharacterSlots{true, true, true, true}, -1, false},
+	}
+	for _, test := range tests {
+		if slot, ok := test.slots.FirstFreeSlot(); slot != test.slot || ok != test.ok {
+			t.Errorf("First free slot of %v is %d, %v; expected %d, %v",
+				test.slots, slot, ok, test.slot, test.ok)
+		}
+	}
+}
+
+// Returns a character creation request for a level 1 HUmar in slot.
+func newCharacterRequest(slot uint32) *CharPreviewPacket {
+	prev := &CharacterPreview{NameColor: 0xFFFFFFFF, PropX: 0.5, PropY: 0.5}
+	copy(prev.Name[:], util.ConvertToUtf16("\tENewbie"))
+	return &CharPreviewPacket{
+		Header:    BBHeader{Type: LoginCharPreviewType},
+		Slot:      slot,
+		Character: prev,
+	}
+}
+
+func TestCreateCharacterInFirstFreeSlot(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	fake.Expect("SELECT slot_num FROM characters").
+		WillReturnRows([]string{"slot_num"}, []driver.Value{int64(0)}, []driver.Value{int64(2)})
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"})
+	fake.Expect("DELETE FROM characters").WithArgs(int64(client.guildcard), int64(1)).WillAffect(0)
+	fake.Expect("SELECT COUNT(*) FROM characters").
+		WillReturnRows([]string{"count"}, []driver.Value{int64(2)})
+	insert := fake.Expect("INSERT INTO characters").WillAffect(1)
+
+	deliverPacket(t, client, peer, newCharacterRequest(AnyCharacterSlot))
+	if err := handleCharacterUpdate(client); err != nil {
+		t.Fatal(err)
+	}
+	if args := insert.Args(); len(args) < 2 || args[1] != int64(1) {
+		t.Errorf("Character was inserted with %v; expected slot 1", args)
+	}
+	var ack CharAckPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, LoginCharAckType), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Slot != 1 {
+		t.Errorf("Acknowledged slot %d; expected 1", ack.Slot)
+	}
+}
+
+func TestCreateCharacterWithNoFreeSlot(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	full := make([][]driver.Value, MaxCharacterSlots)
+	for i := range full {
+		full[i] = []driver.Value{int64(i)}
+	}
+	fake.Expect("SELECT slot_num FROM characters").WillReturnRows([]string{"slot_num"}, full...)
+
+	deliverPacket(t, client, peer, newCharacterRequest(AnyCharacterSlot))
+	if err := handleCharacterUpdate(client); err == nil {
+		t.Error("Created a character on an account with no free slots")
+	}
+	if msg := expectClientMessage(t, peer); !strings.Contains(msg, "can't create any more") {
+		t.Errorf("Client was told %q", msg)
+	}
+}
+
+func TestCountCharacters(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.Expect("SELECT COUNT(*) FROM characters WHERE guildcard = ?").WithArgs(int64(42000001)).
+		WillReturnRows([]string{"count"}, []driver.Value{int64(3)})
+	if count, err := CountCharacters(db, 42000001); err != nil || count != 3 {
+		t.Errorf("Counted %d characters (err %v); expected 3", count, err)
+	}
+}
+
+func TestCreateCharacterAtStoredLimit(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	// The account already has a full set of characters stored besides the
+	// one in slot 1.
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"})
+	fake.Expect("SELECT COUNT(*) FROM characters").WithArgs(int64(client.guildcard), int64(1)).
+		WillReturnRows([]string{"count"}, []driver.Value{int64(MaxCharacterSlots)})
+
+	deliverPacket(t, client, peer, newCharacterRequest(1))
+	if err := handleCharacterUpdate(client); err == nil {
+		t.Error("Created a character on an account at the stored character limit")
+	}
+	if msg := expectClientMessage(t, peer); !strings.Contains(msg, "can't create any more") {
+		t.Errorf("Client was told %q", msg)
+	}
+	for _, query := range fake.Log() {
+		if strings.Contains(query, "DELETE") {
+			t.Error("Deleted the character in the slot before rejecting the request")
+		}
+	}
+}
+
+func TestReplaceCharacterOnFullAccount(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	// Every slot is in use, but the character being replaced doesn't count.
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"})
+	fake.Expect("SELECT COUNT(*) FROM characters").WithArgs(int64(client.guildcard), int64(1)).
+		WillReturnRows([]string{"count"}, []driver.Value{int64(MaxCharacterSlots - 1)})
+	fake.Expect("DELETE FROM characters").WithArgs(int64(client.guildcard), int64(1)).WillAffect(1)
+	fake.Expect("INSERT INTO characters").WillAffect(1)
+
+	deliverPacket(t, client, peer, newCharacterRequest(1))
+	if err := handleCharacterUpdate(client); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, peer, LoginCharAckType)
+}
+
+func TestCharacterQueriesTimeOut(t *testing.T) {
+	useConfig(t, func(c *Config) { c.DBQueryTimeoutSeconds = 1 })
+	fc := NewTestCharacter(t)
+	queries := []struct {
+		name      string
+		statement string
+		run       func(db *sql.DB) error
+	}{
+		{"AccountHasCharacterNamed", "SELECT name FROM characters", func(db *sql.DB) error {
+			_, err := AccountHasCharacterNamed(db, fc.Guildcard, "Tester", 0)
+			return err
+		}},
+		{"LoadCharacterSlots", "SELECT slot_num FROM characters", func(db *sql.DB) error {
+			_, err := LoadCharacterSlots(db, fc.Guildcard)
+			return err
+		}},
+		{"CountCharacters", "SELECT COUNT(*) FROM characters", func(db *sql.DB) error {
+			_, err := CountCharacters(db, fc.Guildcard)
+			return err
+		}},
+		{"LoadFullCharacter", "SELECT char_data", func(db *sql.DB) error {
+			_, err := LoadFullCharacter(db, fc.Guildcard, 0)
+			return err
+		}},
+		{"SaveCharacter", "UPDATE characters", func(db *sql.DB) error {
+			return SaveCharacter(db, fc.Guildcard, 0, fc)
+		}},
+		{"LoadSharedBank", "SELECT bank FROM shared_banks", func(db *sql.DB) error {
+			_, _, err := LoadSharedBank(db, fc.Guildcard)
+			return err
+		}},
+		{"SaveSharedBank", "INSERT INTO shared_banks", func(db *sql.DB) error {
+			return SaveSharedBank(db, fc.Guildcard, &fc.Bank)
+		}},
+	}
+	for _, query := range queries {
+		query := query
+		t.Run(query.name, func(t *testing.T) {
+			t.Parallel()
+			db, fake := newFakeDB(t)
+			fake.Expect(query.statement).WillDelay(time.Minute)
+			if err := query.run(db); err == nil || !strings.Contains(err.Error(), "deadline") {
+				t.Errorf("Expected the query to time out, got %v", err)
+			}
+		})
+	}
+}
+
+// Expect VerifyAccount's queries for an account named tester whose password
+// hashes to hash.
+func expectAccount(fake *fakeDB, hash string) {
+	fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+		[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"},
+		[]driver.Value{"tester", hash, int64(42000001), false, false, true, int64(0)})
+	fake.Expect("UPDATE account_data SET lastip").WillAffect(1)
+}
+
+func newLoginPacket(security []byte) *LoginPkt {
+	pkt := &LoginPkt{Header: BBHeader{Type: LoginType}}
+	copy(pkt.Username[:], "tester")
+	copy(pkt.Password[:], "secret")
+	copy(pkt.Security[:], security)
+	return pkt
+}
+
+func TestSessionHandoff(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) {
+		c.database = db
+		c.KickExistingSession = false
+	})
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login, loginPeer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	deliverPacket(t, login, loginPeer, newLoginPacket([]byte(ClientVersionString)))
+	if err := handleLogin(login, 5001); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := sessions.Find(42000001); !ok || c != login {
+		t.Fatal("Login server didn't register the session")
+	}
+	security := expectPacket(t, loginPeer, LoginSecurityType)[24:64]
+
+	// The login connection is still open when the client reaches the
+	// character server, which must take over the session without the
+	// login connection counting as another player.
+	char, charPeer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	deliverPacket(t, char, charPeer, newLoginPacket(security))
+	if err := handleCharLogin(char); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := sessions.Find(42000001); !ok || c != char {
+		t.Fatal("Session wasn't handed off to the character server")
+	}
+	sessions.Remove(login)
+	if c, ok := sessions.Find(42000001); !ok || c != char {
+		t.Error("Closing the login connection removed the handed off session")
+	}
+
+	// A second login to the account is still refused.
+	other, otherPeer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	deliverPacket(t, other, otherPeer, newLoginPacket([]byte(ClientVersionString)))
+	if err := handleLogin(other, 5001); err == nil {
+		t.Error("Second login to the account was allowed")
+	}
+}
+
+func TestCharLoginRequiresSecurityData(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	char, charPeer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	deliverPacket(t, char, charPeer, newLoginPacket(nil))
+	if err := handleCharLogin(char); err == nil {
+		t.Error("Character server accepted a client that skipped the login server")
+	}
+	if _, ok := sessions.Find(42000001); ok {
+		t.Error("Session was registered before the security data was checked")
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compared []string
+	compare := compareHashAndPassword
+	compareHashAndPassword = func(hash, password []byte) error {
+		compared = append(compared, string(hash))
+		return compare(hash, password)
+	}
+	t.Cleanup(func() { compareHashAndPassword = compare })
+
+	login := func(t *testing.T, password string, setup func(*fakeDB)) (int, *Client) {
+		db, fake := newFakeDB(t)
+		useConfig(t, func(c *Config) { c.database = db })
+		setup(fake)
+		client, peer := newTestClientPair(t)
+		pkt := newLoginPacket(nil)
+		copy(pkt.Password[:], password+"\x00")
+		data, _ := util.BytesFromStruct(pkt)
+		compared = nil
+		return HandleLogin(client, data), peer
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		result, _ := login(t, "secret", func(fake *fakeDB) { expectAccount(fake, hash) })
+		if result != LoginOk {
+			t.Errorf("Valid login returned %d", result)
+		}
+	})
+	t.Run("WrongPassword", func(t *testing.T) {
+		result, peer := login(t, "wrong", func(fake *fakeDB) {
+			fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+				[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"},
+				[]driver.Value{"tester", hash, int64(42000001), false, false, true, int64(0)})
+		})
+		if result <= 0 {
+			t.Errorf("Login with the wrong password returned %d", result)
+		}
+		checkLoginError(t, peer, BBLoginErrorPassword)
+	})
+	t.Run("MissingAccount", func(t *testing.T) {
+		result, peer := login(t, "secret", func(fake *fakeDB) {
+			fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+				[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"})
+		})
+		if result <= 0 {
+			t.Errorf("Login to a missing account returned %d", result)
+		}
+		if len(compared) != 1 || compared[0] != dummyPasswordHash {
+			t.Errorf("Password for a missing account was checked against %q", compared)
+		}
+		checkLoginError(t, peer, BBLoginErrorPassword)
+	})
+	t.Run("DatabaseError", func(t *testing.T) {
+		result, _ := login(t, "secret", func(fake *fakeDB) {
+			fake.Expect("SELECT username, password, guildcard").WillFail(errors.New("Connection lost"))
+		})
+		if result >= 0 {
+			t.Errorf("Login with a database error returned %d", result)
+		}
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		client, peer := newTestClientPair(t)
+		if result := HandleLogin(client, make([]byte, 16)); result <= 0 {
+			t.Errorf("Truncated login packet returned %d", result)
+		}
+		checkLoginError(t, peer, BBLoginErrorUnknown)
+	})
+}
+
+// Read the security packet sent to peer and check its error code.
+func checkLoginError(t *testing.T, peer *Client, code BBLoginError) {
+	t.Helper()
+	pkt := expectPacket(t, peer, LoginSecurityType)
+	if got := binary.LittleEndian.Uint32(pkt[8:]); got != uint32(code) {
+		t.Errorf("Login error %d; expected %d", got, code)
+	}
+}
+
+func TestHandlersRejectShortPackets(t *testing.T) {
+	handlers := []struct {
+		name   string
+		handle func(*Client) error
+	}{
+		{"VerifyAccount", func(c *Client) error { _, err := VerifyAccount(c); return err }},
+		{"handleCharacterSelect", handleCharacterSelect},
+		{"handleChecksum", handleChecksum},
+		{"handleGuildcardChunk", handleGuildcardChunk},
+		{"handleCharacterUpdate", handleCharacterUpdate},
+		{"LoginServer", LoginServer{}.Handle},
+		{"CharacterServer", CharacterServer{}.Handle},
+		{"ShipServer", ShipServer{}.Handle},
+		{"BlockServer", BlockServer{}.Handle},
+		{"PatchServer", PatchServer{}.Handle},
+		{"DataServer", DataServer{}.Handle},
+		{"handleFileStatus", handleFileStatus},
+	}
+	for _, h := range handlers {
+		client, _ := newTestClientPair(t)
+		// A header claiming to be longer than the data that came with it.
+		client.buffer = []byte{0x20, 0x00, 0x93}
+		if err := h.handle(client); err == nil {
+			t.Errorf("%s accepted a truncated packet", h.name)
+		}
+	}
+}
+
+func TestHandleGuildcardChunkRejectsOutOfRange(t *testing.T) {
+	client, _ := newTestClientPair(t)
+	client.gcData = make([]byte, 100)
+	client.gcDataSize = 100
+	pkt := &GuildcardChunkReqPacket{Header: BBHeader{Type: LoginGuildcardChunkReqType},
+		ChunkRequested: 1, Continue: 1}
+	client.buffer, _ = util.BytesFromStruct(pkt)
+	if err := handleGuildcardChunk(client); err == nil {
+		t.Error("Sent a guildcard chunk past the end of the data")
+	}
+}
+
+func TestTransferChecksum(t *testing.T) {
+	// Reference values for the IEEE CRC32, which is what the client checks
+	// transfers against.
+	tests := []struct {
+		data     string
+		checksum uint32
+	}{
+		{"", 0},
+		{"123456789", 0xCBF43926},
+		{"The quick brown fox jumps over the lazy dog", 0x414FA339},
+	}
+	for _, test := range tests {
+		if got := TransferChecksum([]byte(test.data)); got != test.checksum {
+			t.Errorf("Checksum of %q is %08x; expected %08x", test.data, got, test.checksum)
+		}
+	}
+}
+
+func TestKeyConfigSendsMOTD(t *testing.T) {
+	tests := []struct {
+		lang Language
+		motd string
+	}{
+		{LanguageEnglish, "Welcome"},
+		{LanguageJapanese, "Youkoso"},
+	}
+	for _, test := range tests {
+		db, fake := newFakeDB(t)
+		useConfig(t, func(c *Config) {
+			c.database = db
+			c.MOTD = "Welcome"
+			c.LocalizedMOTD = map[string]string{"Japanese": "Youkoso"}
+		})
+		client, peer := newTestClientPair(t)
+		client.SetLanguage(test.lang)
+		fake.Expect("SELECT key_config").WillReturnRows([]string{"key_config"},
+			[]driver.Value{make([]byte, 420)})
+		if err := handleKeyConfig(client); err != nil {
+			t.Fatal(err)
+		}
+		expectPacket(t, peer, LoginOptionsType)
+		if msg := expectClientMessage(t, peer); !strings.Contains(msg, test.motd) {
+			t.Errorf("%s client was sent %q; expected %q", test.lang, msg, test.motd)
+		}
+	}
+}
+
+func TestHandleChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum uint32
+		reject   bool
+		ack      uint32
+	}{
+		{"Matching", 0x12345678, true, 1},
+		{"Mismatch", 0xDEADBEEF, true, 0},
+		{"MismatchAllowed", 0xDEADBEEF, false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useConfig(t, func(c *Config) {
+				c.ClientChecksum = 0x12345678
+				c.RejectModifiedClients = test.reject
+			})
+			pkt := &ChecksumPacket{Checksum: test.checksum}
+			if valid := ValidateLoginChecksum(pkt); valid != (test.checksum == 0x12345678) {
+				t.Errorf("ValidateLoginChecksum returned %v", valid)
+			}
+
+			client, peer := newTestClientPair(t)
+			pkt.Header.Type = LoginChecksumType
+			deliverPacket(t, client, peer, pkt)
+			err := handleChecksum(client)
+			if (err != nil) != (test.ack == 0) {
+				t.Errorf("handleChecksum returned %v", err)
+			}
+			ack := expectPacket(t, peer, LoginChecksumAckType)
+			if got := binary.LittleEndian.Uint32(ack[8:]); got != test.ack {
+				t.Errorf("Client was sent ack %d; expected %d", got, test.ack)
+			}
+		})
+	}
+}
+
+// Returns a stored character name column holding name.
+func storedName(name string) []byte {
+	stored := make([]byte, 24)
+	copy(stored, util.ConvertToUtf16(name))
+	return stored
+}
+
+func TestAccountHasCharacterNamed(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	rows := [][]driver.Value{{storedName("\tEAlice")}, {storedName("\tJNewbie")}}
+
+	// The language marker isn't part of the name.
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"}, rows...)
+	if exists, err := AccountHasCharacterNamed(db, 42000001, "Newbie", 0); err != nil || !exists {
+		t.Errorf("Duplicate name wasn't found (err %v)", err)
+	}
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"}, rows...)
+	if exists, err := AccountHasCharacterNamed(db, 42000001, "Bob", 0); err != nil || exists {
+		t.Errorf("Unique name was reported as a duplicate (err %v)", err)
+	}
+}
+
+func TestCreateCharacterWithDuplicateName(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	fake.Expect("SELECT name FROM characters").WithArgs(int64(client.guildcard), int64(1)).
+		WillReturnRows([]string{"name"}, []driver.Value{storedName("\tENewbie")})
+
+	deliverPacket(t, client, peer, newCharacterRequest(1))
+	if err := handleCharacterUpdate(client); err == nil {
+		t.Error("Created a character with a duplicate name")
+	}
+	if msg := expectClientMessage(t, peer); !strings.Contains(msg, "already have a character") {
+		t.Errorf("Client was told %q", msg)
+	}
+}
+
+func TestCharacterAge(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	fake.Expect("SELECT TIMESTAMPDIFF(SECOND, creation_time, NOW())").
+		WithArgs(int64(42000001), int64(2)).
+		WillReturnRows([]string{"age"}, []driver.Value{int64(90061)})
+
+	age, err := CharacterAge(db, 42000001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 25*time.Hour + time.Minute + time.Second; age != expected {
+		t.Errorf("Character age is %v; expected %v", age, expected)
+	}
+
+	fake.Expect("SELECT TIMESTAMPDIFF").WillReturnRows([]string{"age"})
+	if _, err := CharacterAge(db, 42000001, 3); err != sql.ErrNoRows {
+		t.Errorf("Age of a missing character returned %v", err)
+	}
+}
+
+// Expect the preview query handleCharacterSelect runs for fc.
+func expectCharacterPreview(fake *fakeDB, fc *FullCharacter) {
+	fake.Expect("SELECT experience, level").
+		WillReturnRows(characterColumns[:23], characterRow(fc)[:23])
+}
+
+func TestCharacterSelectPreview(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+	fonewearl := NewTestCharacter(t, WithClass(Fonewearl), WithLevel(40))
+	racast := NewTestCharacter(t, WithClass(Racast), WithLevel(19))
+	fake.Expect("SELECT experience, level").WithArgs(int64(client.guildcard)).
+		WillReturnRows(append(characterColumns[:23:23], "slot_num"),
+			append(characterRow(fonewearl)[:23:23], int64(1)),
+			append(characterRow(racast)[:23:23], int64(3)),
+			// A slot that was blanked out instead of deleted.
+			append(characterRow(&FullCharacter{})[:23:23], int64(0)))
+
+	deliverPacket(t, client, peer, &CharSelectionPacket{
+		Header: BBHeader{Type: LoginCharPreviewReqType}, Slot: 0})
+	if err := handleCharacterSelect(client); err != nil {
+		t.Fatal(err)
+	}
+	var menu CharSelectMenuPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, LoginCharPreviewType), &menu); err != nil {
+		t.Fatal(err)
+	}
+	if menu.Header.Flags != MaxCharacterSlots {
+		t.Errorf("Menu has %d entries", menu.Header.Flags)
+	}
+	for i, entry := range menu.Entries {
+		data, _ := util.BytesFromStruct(&entry.Character)
+		switch i {
+		case 1, 3:
+			expected := map[int]*FullCharacter{1: fonewearl, 3: racast}[i]
+			if entry.Character.Level != expected.Character.Level || entry.Character.Class != expected.Class {
+				t.Errorf("Slot %d shows a level %d character with class %d", i,
+					entry.Character.Level, entry.Character.Class)
+			}
+		default:
+			if !IsEmptyCharacter(data) {
+				t.Errorf("Slot %d isn't empty", i)
+			}
+		}
+	}
+	if client.character != nil {
+		t.Error("Previewing a character selected it")
+	}
+}
+
+func TestCharacterSelectConfirm(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) {
+		c.database = db
+		c.Features = map[string]bool{FeatureSharedBank: false}
+	})
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+	fc := NewTestCharacter(t, WithClass(Fonewearl), WithLevel(40), WithItems())
+	data, _ := util.BytesFromStruct(fc)
+	expectCharacterPreview(fake, fc)
+	expectCharacterLoad(fake, fc, data, fc.Checksum())
+
+	deliverPacket(t, client, peer, &CharSelectionPacket{
+		Header: BBHeader{Type: LoginCharPreviewReqType}, Slot: 1, Selecting: 1})
+	if err := handleCharacterSelect(client); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, peer, LoginSecurityType)
+	var ack CharAckPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, LoginCharAckType), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Slot != 1 || ack.Flag != 1 {
+		t.Errorf("Selection was acked with slot %d, flag %d", ack.Slot, ack.Flag)
+	}
+	if client.character == nil || client.character.Inventory != fc.Inventory {
+		t.Error("Selected character wasn't loaded")
+	}
+	if client.config.SlotNum != 1 {
+		t.Errorf("Selected slot recorded as %d", client.config.SlotNum)
+	}
+}
+
+func TestCharacterSelectEmptySlot(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	fake.Expect("SELECT experience, level").WillReturnRows(characterColumns[:23])
+
+	deliverPacket(t, client, peer, &CharSelectionPacket{
+		Header: BBHeader{Type: LoginCharPreviewReqType}, Slot: 3, Selecting: 1})
+	if err := handleCharacterSelect(client); err != nil {
+		t.Fatal(err)
+	}
+	var ack CharAckPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, LoginCharAckType), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Slot != 3 || ack.Flag != 2 {
+		t.Errorf("Empty slot was acked with slot %d, flag %d", ack.Slot, ack.Flag)
+	}
+}
+
+func TestLoginRecordsHardwareID(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+		[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"},
+		[]driver.Value{"tester", hash, int64(42000001), false, false, true, int64(0)})
+	update := fake.Expect("UPDATE account_data SET lastip").WillAffect(1)
+
+	client, _ := newTestClientPair(t)
+	pkt := newLoginPacket(nil)
+	copy(pkt.HardwareInfo[:], []byte{0x00, 0x1F, 0xC6, 0x9A, 0x20, 0x00, 0xFE, 0x81})
+	if pkt.HardwareID() != "001fc69a2000fe81" {
+		t.Errorf("Hardware ID is %q", pkt.HardwareID())
+	}
+	data, _ := util.BytesFromStruct(pkt)
+	if result := HandleLogin(client, data); result != LoginOk {
+		t.Fatalf("Login returned %d", result)
+	}
+	args := update.Args()
+	if len(args) < 2 || !bytes.Equal(args[1].([]byte), pkt.HardwareInfo[:]) {
+		t.Errorf("Account was updated with %v; expected hardware info %x", args, pkt.HardwareInfo)
+	}
+}
+
+func TestLoginSetsLanguage(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	expectAccount(fake, hash)
+
+	client, _ := newTestClientPair(t)
+	pkt := newLoginPacket(nil)
+	pkt.Language = uint8(LanguageJapanese)
+	data, _ := util.BytesFromStruct(pkt)
+	if result := HandleLogin(client, data); result != LoginOk {
+		t.Fatalf("Login returned %d", result)
+	}
+	if lang := client.Language(); lang != LanguageJapanese {
+		t.Errorf("Client's language is %s; expected Japanese", lang)
+	}
+}
+
+func TestLoginRecordsFirstIP(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+		[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"},
+		[]driver.Value{"tester", hash, int64(42000001), false, false, true, int64(0)})
+	// The first address is only set if there isn't one already.
+	update := fake.Expect("first_ip = COALESCE(first_ip, ?)").WillAffect(1)
+
+	client, _ := newTestClientPair(t)
+	data, _ := util.BytesFromStruct(newLoginPacket(nil))
+	if result := HandleLogin(client, data); result != LoginOk {
+		t.Fatalf("Login returned %d", result)
+	}
+	if args := update.Args(); len(args) < 3 || args[2] != "127.0.0.1" {
+		t.Errorf("Account was updated with %v; expected first IP 127.0.0.1", args)
+	}
+}
+
+func TestParseMenuSelection(t *testing.T) {
+	tests := []struct {
+		menuId uint16
+		itemId uint32
+	}{
+		{ShipSelectionMenuId, 2},
+		{0x12, 0x10},
+	}
+	for _, test := range tests {
+		data, _ := util.BytesFromStruct(&MenuSelectionPacket{
+			Header: BBHeader{Type: MenuSelectType}, MenuId: test.menuId, ItemId: test.itemId})
+		menuId, itemId, err := ParseMenuSelection(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if menuId != uint32(test.menuId) || itemId != test.itemId {
+			t.Errorf("Parsed menu %x item %x; expected menu %x item %x",
+				menuId, itemId, test.menuId, test.itemId)
+		}
+	}
+	if _, _, err := ParseMenuSelection(make([]byte, 10)); err == nil {
+		t.Error("Parsed a truncated menu selection")
+	}
+}
+
+func TestHandleShipSelection(t *testing.T) {
+	oldShips := shipList
+	shipList = []Ship{
+		{addr: ShipConfig{Name: "First", Host: "10.0.0.1", Port: "15000"}},
+		{addr: ShipConfig{Name: "Second", Host: "10.0.0.2", Port: "15001"}},
+	}
+	t.Cleanup(func() { shipList = oldShips })
+
+	client, peer := newTestClientPair(t)
+	deliverPacket(t, client, peer, &MenuSelectionPacket{
+		Header: BBHeader{Type: MenuSelectType}, MenuId: ShipSelectionMenuId, ItemId: 2})
+	if err := handleShipSelection(client); err != nil {
+		t.Fatal(err)
+	}
+	var pkt RedirectPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, RedirectType), &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.IPAddr != [4]uint8{10, 0, 0, 2} || pkt.Port != 15001 {
+		t.Errorf("Redirected to %v:%d; expected the second ship", pkt.IPAddr, pkt.Port)
+	}
+
+	deliverPacket(t, client, peer, &MenuSelectionPacket{
+		Header: BBHeader{Type: MenuSelectType}, MenuId: ShipSelectionMenuId, ItemId: 3})
+	if err := handleShipSelection(client); err == nil {
+		t.Error("Selected a ship that doesn't exist")
+	}
+}
+
+func TestValidateClassSection(t *testing.T) {
+	all := ConfigView{}
+	if err := ValidateClassSection(Racaseal, Whitill, all); err != nil {
+		t.Errorf("Class was rejected with no restrictions: %s", err.Error())
+	}
+	if err := ValidateClassSection(NumCharClasses, Viridia, all); err == nil {
+		t.Error("Invalid class was allowed")
+	}
+	if err := ValidateClassSection(Humar, Whitill+1, all); err == nil {
+		t.Error("Invalid section ID was allowed")
+	}
+
+	// Listed classes are matched ignoring case.
+	restricted := ConfigView{AllowedClasses: []string{"hucast", "FOnewm"}}
+	if err := ValidateClassSection(Hucast, Oran, restricted); err != nil {
+		t.Errorf("Allowed class was rejected: %s", err.Error())
+	}
+	if err := ValidateClassSection(Fonewm, Skyly, restricted); err != nil {
+		t.Errorf("Allowed class was rejected: %s", err.Error())
+	}
+	if err := ValidateClassSection(Humar, Oran, restricted); err == nil {
+		t.Error("Class that isn't allowed was accepted")
+	}
+}
+
+func TestCreateCharacterWithDisallowedClass(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) {
+		c.database = db
+		c.AllowedClasses = []string{"RAcast"}
+	})
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+	fake.Expect("SELECT name FROM characters").WillReturnRows([]string{"name"})
+
+	deliverPacket(t, client, peer, newCharacterRequest(1))
+	if err := handleCharacterUpdate(client); err == nil {
+		t.Error("Created a character with a class that isn't allowed")
+	}
+	if msg := expectClientMessage(t, peer); !strings.Contains(msg, "can't be created") {
+		t.Errorf("Client was told %q", msg)
+	}
+}
+
+func TestGuildcardDataSkipsCorruptEntries(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	client, peer := newTestClientPair(t)
+	client.guildcard = 42000001
+
+	entry := func(guildcard, class int64) []driver.Value {
+		return []driver.Value{guildcard, []byte{}, []byte{}, []byte{}, int64(1), int64(0), class, []byte{}}
+	}
+	fake.Expect("FROM guildcard_entries").WithArgs(int64(client.guildcard)).
+		WillReturnRows([]string{"friend_gc", "name", "team_name", "description",
+			"language", "section_id", "char_class", "comment"},
+			entry(42000002, 0), entry(42000003, 0xFF), entry(42000004, 1))
+	if err := handleGuildcardDataStart(client); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, peer, LoginGuildcardHeaderType)
+
+	// Each entry starts with its guildcard.
+	var data GuildcardData
+	entries := len(data.Unknown) + len(data.Blocked) + len(data.Unknown2)
+	entrySize := binary.Size(GuildcardEntry{})
+	for i, expected := range []uint32{42000002, 42000004, 0} {
+		if gc := binary.LittleEndian.Uint32(client.gcData[entries+i*entrySize:]); gc != expected {
+			t.Errorf("Entry %d is for guildcard %d; expected %d", i, gc, expected)
+		}
+	}
+}
+
+// Start RunLoginSequence on a new client and read the welcome packet it
+// sends, which is the only one that isn't encrypted. The sequence's result
+// is sent on the returned channel.
+func startLoginSequence(t *testing.T) (peer *Client, result chan error) {
+	t.Helper()
+	c, peer := newTestClientPair(t)
+	result = make(chan error, 1)
+	go func() { result <- RunLoginSequence(c, 5001) }()
+
+	welcome := make([]byte, 0xC8)
+	if _, err := io.ReadFull(peer.conn, welcome); err != nil {
+		t.Fatal(err)
+	}
+	if pktType := binary.LittleEndian.Uint16(welcome[2:]); pktType != LoginWelcomeType {
+		t.Fatalf("Received packet %02x; expected the welcome packet", pktType)
+	}
+	return peer, result
+}
+
+func TestRunLoginSequence(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAccount(fake, hash)
+
+	peer, result := startLoginSequence(t)
+	data, size := util.BytesFromStruct(newLoginPacket([]byte(ClientVersionString)))
+	if sendEncrypted(peer, data, uint16(size)) != 0 {
+		t.Fatal("Failed to send login packet")
+	}
+	security := expectPacket(t, peer, LoginSecurityType)
+	if code := binary.LittleEndian.Uint32(security[8:]); code != uint32(BBLoginErrorNone) {
+		t.Errorf("Login failed with error %d", code)
+	}
+	var redirect RedirectPacket
+	if err := util.StructFromBytes(expectPacket(t, peer, RedirectType), &redirect); err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Port != 5001 {
+		t.Errorf("Redirected to port %d; expected 5001", redirect.Port)
+	}
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunLoginSequenceBadPassword(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	hash, err := HashPassword("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Expect("SELECT username, password, guildcard").WillReturnRows(
+		[]string{"username", "password", "guildcard", "is_gm", "is_banned", "is_active", "team_id"},
+		[]driver.Value{"tester", hash, int64(42000001), false, false, true, int64(0)})
+
+	peer, result := startLoginSequence(t)
+	data, size := util.BytesFromStruct(newLoginPacket([]byte(ClientVersionString)))
+	if sendEncrypted(peer, data, uint16(size)) != 0 {
+		t.Fatal("Failed to send login packet")
+	}
+	security := expectPacket(t, peer, LoginSecurityType)
+	if code := binary.LittleEndian.Uint32(security[8:]); code != uint32(BBLoginErrorPassword) {
+		t.Errorf("Login failed with error %d; expected a bad password", code)
+	}
+	if err := <-result; err == nil {
+		t.Error("Login sequence succeeded with the wrong password")
+	}
+}
+
+func TestRunLoginSequenceUnexpectedPacket(t *testing.T) {
+	peer, result := startLoginSequence(t)
+	data, size := util.BytesFromStruct(&BBHeader{Type: LoginCharPreviewReqType})
+	if sendEncrypted(peer, data, uint16(size)) != 0 {
+		t.Fatal("Failed to send packet")
+	}
+	if err := <-result; err == nil {
+		t.Error("Login sequence accepted a packet other than a login")
+	}
+}
@@ -0,0 +1,96 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Log formatter that collapses runs of identical messages so that a
+* failure logging the same error on every packet doesn't flood the log.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Wraps another Formatter, suppressing messages identical (same level and
+// text) to the one before them that arrive within window of its first
+// occurrence. The number of suppressed copies is logged as a single
+// "...repeated N times" line once a different message is logged, the
+// window runs out, or the logger is flushed.
+type repeatFormatter struct {
+	logrus.Formatter
+	window time.Duration
+
+	level   logrus.Level
+	message string
+	since   time.Time
+	repeats int
+	sync.Mutex
+}
+
+func newRepeatFormatter(f logrus.Formatter, window time.Duration) *repeatFormatter {
+	return &repeatFormatter{Formatter: f, window: window}
+}
+
+func (f *repeatFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	if entry.Level == f.level && entry.Message == f.message &&
+		entry.Time.Sub(f.since) < f.window {
+		f.repeats++
+		return nil, nil
+	}
+
+	summary, err := f.summary(entry.Logger, entry.Time)
+	if err != nil {
+		return nil, err
+	}
+	f.level, f.message, f.since = entry.Level, entry.Message, entry.Time
+	line, err := f.Formatter.Format(entry)
+	return append(summary, line...), err
+}
+
+// Returns the formatted repeat count for the last message, if any of its
+// copies were suppressed, and resets the count.
+func (f *repeatFormatter) summary(logger *logrus.Logger, t time.Time) ([]byte, error) {
+	if f.repeats == 0 {
+		return nil, nil
+	}
+	entry := &logrus.Entry{
+		Logger:  logger,
+		Data:    make(logrus.Fields),
+		Time:    t,
+		Level:   f.level,
+		Message: fmt.Sprintf("...repeated %d times", f.repeats),
+	}
+	f.repeats = 0
+	return f.Formatter.Format(entry)
+}
+
+// Write out the repeat count for the last message to logger so that it
+// isn't lost when the server exits.
+func (f *repeatFormatter) Flush(logger *logrus.Logger) error {
+	f.Lock()
+	defer f.Unlock()
+	summary, err := f.summary(logger, time.Now())
+	if err != nil || len(summary) == 0 {
+		return err
+	}
+	_, err = logger.Out.Write(summary)
+	return err
+}
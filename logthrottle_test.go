@@ -0,0 +1,68 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	f := newRepeatFormatter(new(logrus.TextFormatter), time.Minute)
+	start := time.Unix(1500000000, 0)
+	log := func(offset time.Duration, level logrus.Level, msg string) {
+		line, err := f.Format(&logrus.Entry{Logger: logger, Data: make(logrus.Fields),
+			Time: start.Add(offset), Level: level, Message: msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(line)
+	}
+
+	for i := 0; i < 4214; i++ {
+		log(time.Duration(i)*time.Millisecond, logrus.ErrorLevel, "Database is down")
+	}
+	// Same text at a different level isn't a repeat.
+	log(5*time.Second, logrus.WarnLevel, "Database is down")
+	log(10*time.Second, logrus.WarnLevel, "Database is down")
+	// Nor is the same message once the window has passed. The copy after
+	// it is only summarized by Flush.
+	log(2*time.Minute, logrus.WarnLevel, "Database is down")
+	log(2*time.Minute, logrus.WarnLevel, "Database is down")
+	if err := f.Flush(logger); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{"Database is down", "...repeated 4213 times", "Database is down",
+		"...repeated 1 times", "Database is down", "...repeated 1 times"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Logged %d lines; expected %d:\n%s", len(lines), len(expected), buf.String())
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Errorf("Line %d is %q; expected %q", i, line, expected[i])
+		}
+	}
+}
@@ -19,6 +19,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/dcrodman/archon/util"
@@ -27,10 +29,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"runtime/pprof"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -42,6 +47,8 @@ const (
 
 var (
 	log *logrus.Logger
+	// Every open connection, across all of the servers.
+	connections = NewClientList()
 )
 
 // Server defines the methods implemented by all sub-servers that can be
@@ -61,6 +68,13 @@ type Server interface {
 	Handle(c *Client) error
 }
 
+// Implemented by servers that take each new client through a fixed sequence
+// of steps, such as the login handshake, before handling its packets.
+type ClientStarter interface {
+	// Run the sequence with c. The client is disconnected if it fails.
+	StartClient(c *Client) error
+}
+
 type Dispatcher struct {
 	host    string
 	servers []Server
@@ -95,16 +109,17 @@ func (d *Dispatcher) start(wg *sync.WaitGroup) {
 			wg.Add(1)
 			// Poll until we can accept more clients.
 			for d.conns.Count() < config.MaxConnections {
-				conn, err := socket.AcceptTCP()
+				conn, err := d.accept(socket)
 				if err != nil {
-					d.log.Warnf("Failed to accept connection: %v", err.Error())
-					continue
+					d.log.Errorf("Stopped accepting %s connections: %v", serv.Name(), err.Error())
+					break
 				}
 				c, err := serv.NewClient(conn)
 				if err != nil {
 					d.log.Warn(err.Error())
 				} else {
-					d.log.Infof("Accepted %s connection from %s", serv.Name(), c.IPAddr())
+					c.logger = loggerFor(serv.Name())
+					c.logger.Infof("Accepted %s connection from %s", serv.Name(), c.IPAddr())
 					d.dispatch(c, serv)
 				}
 			}
@@ -118,6 +133,39 @@ func (d *Dispatcher) start(wg *sync.WaitGroup) {
 	d.log.Infof("Dispatcher: Server Initialized")
 }
 
+// Anything connections can be accepted from; satisfied by *net.TCPListener.
+type tcpAcceptor interface {
+	AcceptTCP() (*net.TCPConn, error)
+}
+
+// Wait for the next connection on socket. Temporary errors (i.e. running out
+// of file descriptors) are retried after a delay so that we don't spin;
+// anything else is returned since it's fatal for the listener.
+func (d *Dispatcher) accept(socket tcpAcceptor) (*net.TCPConn, error) {
+	var delay time.Duration
+	for {
+		conn, err := socket.AcceptTCP()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			delay = acceptRetryDelay(delay)
+			d.log.Warnf("Failed to accept connection: %v; retrying in %v", err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		return conn, err
+	}
+}
+
+// Returns how long to wait before retrying a failed accept, doubling the
+// previous delay up to a maximum of one second.
+func acceptRetryDelay(prev time.Duration) time.Duration {
+	if prev == 0 {
+		return 5 * time.Millisecond
+	} else if prev *= 2; prev > time.Second {
+		return time.Second
+	}
+	return prev
+}
+
 // Spawn a dedicated Goroutine for Client and handle communications
 // until the connection is closed.
 func (d *Dispatcher) dispatch(c *Client, s Server) {
@@ -126,15 +174,34 @@ func (d *Dispatcher) dispatch(c *Client, s Server) {
 		// remove them from the list regardless of the connection state.
 		defer func() {
 			if err := recover(); err != nil {
-				d.log.Errorf("Error in client communication: %s: %s\n%s\n",
+				c.logger.Errorf("Error in client communication: %s: %s\n%s\n",
 					c.IPAddr(), err, debug.Stack())
 			}
 			c.Close()
 			d.conns.Remove(c)
-			d.log.Infof("Disconnected %s client %s", s.Name(), c.IPAddr())
+			sessions.Remove(c)
+			if c.character != nil {
+				// Queue the character's final state and write it out now
+				// rather than waiting for the next flush.
+				err := saveClientCharacter(c)
+				if err == nil && characterSaves != nil {
+					err = characterSaves.FlushCharacter(c.guildcard, uint32(c.config.SlotNum))
+				}
+				if err != nil {
+					c.logger.Errorf("Failed to save character for %d: %s", c.guildcard, err.Error())
+				}
+			}
+			c.logger.Infof("Disconnected %s client %s", s.Name(), c.IPAddr())
 		}()
 		d.conns.Add(c)
 
+		if starter, ok := s.(ClientStarter); ok {
+			if err := starter.StartClient(c); err != nil {
+				c.logger.Warn("Error in client communication: " + err.Error())
+				return
+			}
+		}
+
 		// Connection loop; process packets until the connection is closed.
 		var pktHeader PCHeader
 		for {
@@ -143,36 +210,54 @@ func (d *Dispatcher) dispatch(c *Client, s Server) {
 				break
 			} else if err != nil {
 				// Error communicating with the client.
-				d.log.Warn(err.Error())
+				c.logger.Warn(err.Error())
+				break
+			}
+			c.touch()
+			if limit := config.PacketRateLimit(); !c.allowPacket(limit) {
+				c.logger.Warnf("Disconnecting %s client %s for exceeding %d packets per second",
+					s.Name(), c.IPAddr(), limit)
 				break
 			}
 
 			// PC and BB header packets have the same structure for the first four
 			// bytes, so for basic inspection it's safe to treat them the same way.
-			util.StructFromBytes(c.Data()[:PCHeaderSize], &pktHeader)
+			if err = util.StructFromBytes(c.Data(), &pktHeader); err != nil {
+				c.logger.Warn(err.Error())
+				break
+			}
 			if config.DebugMode {
 				fmt.Printf("%s: Got %v bytes from client:\n", s.Name(), pktHeader.Size)
 				util.PrintPayload(c.Data(), int(pktHeader.Size))
 				fmt.Println()
 			}
 
+			// Ping responses are the same for every server.
+			if c.hdrSize == BBHeaderSize && pktHeader.Type == PingType {
+				c.handlePong()
+				continue
+			}
+
 			if err = s.Handle(c); err != nil {
-				d.log.Warn("Error in client communication: " + err.Error())
+				c.logger.Warn("Error in client communication: " + err.Error())
 				return
 			}
 		}
 	}()
 }
 
-func initLogger(filename string) {
+// Create a logger writing to filename, or stdout if filename is empty.
+func newLogger(filename string) *logrus.Logger {
 	var w io.Writer
 	var err error
 	if filename != "" {
-		w, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
-			fmt.Println("ERROR: Failed to open log file " + config.Logfile)
+			fmt.Println("ERROR: Failed to open log file " + filename)
 			os.Exit(1)
 		}
+		config.OnClose(f.Close)
+		w = f
 	} else {
 		w = os.Stdout
 	}
@@ -182,16 +267,50 @@ func initLogger(filename string) {
 		fmt.Println("ERROR: Failed to parse log level: " + err.Error())
 		os.Exit(1)
 	}
-	log = &logrus.Logger{
-		Out: w,
-		Formatter: &logrus.TextFormatter{
-			TimestampFormat: "2006-1-_2 15:04:05",
-			FullTimestamp:   true,
-			DisableSorting:  true,
-		},
+	var formatter logrus.Formatter = &logrus.TextFormatter{
+		TimestampFormat: "2006-1-_2 15:04:05",
+		FullTimestamp:   true,
+		DisableSorting:  true,
+	}
+	logger := &logrus.Logger{
+		Out:   w,
 		Hooks: make(logrus.LevelHooks),
 		Level: logLvl,
 	}
+	if config.LogRepeatWindow > 0 {
+		rf := newRepeatFormatter(formatter, time.Duration(config.LogRepeatWindow)*time.Second)
+		config.OnClose(func() error { return rf.Flush(logger) })
+		formatter = rf
+	}
+	logger.Formatter = formatter
+	return logger
+}
+
+// Loggers for the servers configured to log to their own files.
+var componentLoggers = make(map[string]*logrus.Logger)
+
+func initLogger(filename string) {
+	log = newLogger(filename)
+	for component, file := range config.ComponentLogfiles {
+		componentLoggers[component] = newLogger(file)
+	}
+}
+
+// Returns the logger for the server named component, falling back to the
+// main log if it doesn't have its own file.
+func loggerFor(component string) *logrus.Logger {
+	if l, ok := componentLoggers[component]; ok {
+		return l
+	}
+	return log
+}
+
+// Returns a short identifier for the account with guildcard that stays the
+// same across log lines, for logs where accounts need to be correlated but
+// shouldn't be identifiable. Derived from a SHA-256 salted with LogIDSalt.
+func AccountLogID(guildcard uint32) string {
+	hash := sha256.Sum256([]byte(config.LogIDSalt + strconv.FormatUint(uint64(guildcard), 10)))
+	return hex.EncodeToString(hash[:4])
 }
 
 func main() {
@@ -213,9 +332,20 @@ func main() {
 		if err != nil {
 			fmt.Println("Failed.\nPlease check that one of these files exists and restart the server.")
 			fmt.Printf("Error: %s\n", err)
+			if os.IsNotExist(err) {
+				example := ServerConfigFile + ".example"
+				if config.GenerateExample(example) == nil {
+					fmt.Printf("An example config has been written to %s.\n", example)
+				}
+			}
 			os.Exit(1)
 		}
 	}
+	if err = config.Validate(); err != nil {
+		fmt.Println("Failed.\nPlease correct the configuration and restart the server.")
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
 	fmt.Printf("Done.\n\n--Configuration Parameters--\n%v\n\n", config.String())
 
 	// Initialize the database.
@@ -227,24 +357,76 @@ func main() {
 		os.Exit(1)
 	}
 	fmt.Println("Done.\n")
-	defer config.CloseDB()
+	defer config.Close()
+
+	// Apply any pending schema changes before the servers start using the database.
+	fmt.Printf("Updating database schema...")
+	if err = RunMigrations(config.DB()); err != nil {
+		fmt.Println("Failed.")
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Print("Done.\n\n")
 
 	// If we're in debug mode, spawn off an HTTP server that, when hit, dumps
 	// pprof output containing the stack traces of all running goroutines.
+	// The online players and their latency are listed at /players.
 	if config.DebugMode {
 		http.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
 			pprof.Lookup("goroutine").WriteTo(resp, 1)
 		})
+		http.HandleFunc("/players", func(resp http.ResponseWriter, req *http.Request) {
+			WriteOnlinePlayers(resp, OnlinePlayers())
+		})
 		go http.ListenAndServe(":"+config.WebPort, nil)
 	}
 
 	initLogger(config.Logfile)
 
+	// Queue character saves if configured to, making sure anything still
+	// pending gets written before the server exits.
+	if config.SaveInterval > 0 {
+		characterSaves = NewSaveQueue(time.Duration(config.SaveInterval)*time.Second, func(gc, slot uint32, fc *FullCharacter) error {
+			return SaveCharacter(config.DB(), gc, slot, fc)
+		})
+		characterSaves.Start()
+		config.OnClose(characterSaves.Stop)
+	}
+	if config.SessionTimeout > 0 {
+		config.OnClose(sessions.StartSweeper(time.Duration(config.SessionTimeout) * time.Second))
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			// SIGHUP reloads the settings that can change while running;
+			// anything else shuts down.
+			if sig == syscall.SIGHUP {
+				reloaded := defaultConfig()
+				if err := reloaded.InitFromFile(ServerConfigFile); err != nil {
+					log.Errorf("Failed to reload config: %s", err.Error())
+					continue
+				}
+				for _, name := range config.DiffRequiringRestart(reloaded) {
+					log.Warnf("%s was changed but won't take effect until the server is restarted", name)
+				}
+				config.Reload(reloaded)
+				log.Infof("Reloaded config; features: %s", config.featureString())
+				continue
+			}
+			fmt.Println("Shutting down...")
+			if err := config.Close(); err != nil {
+				fmt.Printf("Error: %s\n", err)
+			}
+			os.Exit(0)
+		}
+	}()
+
 	// Register all of the server handlers and their corresponding ports.
 	dispatcher := Dispatcher{
 		host:    config.Hostname,
 		servers: make([]Server, 0),
-		conns:   NewClientList(),
+		conns:   connections,
 		log:     log,
 	}
 
@@ -0,0 +1,148 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Code under test logs through the global logger, which main normally
+	// sets up from the config.
+	log = logrus.New()
+	log.Out = ioutil.Discard
+	os.Exit(m.Run())
+}
+
+// Replace the global config with a default one, modified by update, for
+// the rest of the test.
+func useConfig(t *testing.T, update func(c *Config)) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = defaultConfig()
+	update(config)
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "Too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// Returns each of its results in turn from AcceptTCP.
+type fakeAcceptor struct {
+	conns []*net.TCPConn
+	errs  []error
+}
+
+func (f *fakeAcceptor) AcceptTCP() (*net.TCPConn, error) {
+	conn, err := f.conns[0], f.errs[0]
+	f.conns, f.errs = f.conns[1:], f.errs[1:]
+	return conn, err
+}
+
+func TestDispatcherAcceptRetries(t *testing.T) {
+	d := &Dispatcher{log: log}
+	conn := new(net.TCPConn)
+	socket := &fakeAcceptor{
+		conns: []*net.TCPConn{nil, nil, conn},
+		errs:  []error{temporaryError{}, temporaryError{}, nil},
+	}
+	if accepted, err := d.accept(socket); err != nil || accepted != conn {
+		t.Errorf("Accepted %v (err %v) after temporary errors", accepted, err)
+	}
+
+	closed := errors.New("Listener closed")
+	socket = &fakeAcceptor{conns: []*net.TCPConn{nil}, errs: []error{closed}}
+	if _, err := d.accept(socket); err != closed {
+		t.Errorf("Permanent error was returned as %v", err)
+	}
+}
+
+func TestAcceptRetryDelay(t *testing.T) {
+	var delay time.Duration
+	for _, expected := range []time.Duration{5, 10, 20, 40} {
+		if delay = acceptRetryDelay(delay); delay != expected*time.Millisecond {
+			t.Errorf("Delay is %v; expected %v", delay, expected*time.Millisecond)
+		}
+	}
+	if delay = acceptRetryDelay(800 * time.Millisecond); delay != time.Second {
+		t.Errorf("Delay is %v; expected the maximum of 1s", delay)
+	}
+}
+
+func TestComponentLogfiles(t *testing.T) {
+	dir := t.TempDir()
+	mainLog, loginLog := dir+"/archon.log", dir+"/login.log"
+	useConfig(t, func(c *Config) {
+		c.LogLevel = "info"
+		c.ComponentLogfiles = map[string]string{"LOGIN": loginLog}
+	})
+	oldLog, oldLoggers := log, componentLoggers
+	componentLoggers = make(map[string]*logrus.Logger)
+	t.Cleanup(func() { log, componentLoggers = oldLog, oldLoggers })
+
+	initLogger(mainLog)
+	(&Client{guildcard: 42000001, logger: loggerFor("LOGIN")}).Logf("Login message")
+	(&Client{guildcard: 42000002, logger: loggerFor("CHARACTER")}).Logf("Character message")
+	if err := config.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file, contains, excludes string
+	}{
+		{loginLog, "[gc:42000001] Login message", "Character message"},
+		{mainLog, "[gc:42000002] Character message", "Login message"},
+	}
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := string(data); !strings.Contains(out, test.contains) || strings.Contains(out, test.excludes) {
+			t.Errorf("%s contains %q", test.file, out)
+		}
+	}
+}
+
+func TestAccountLogID(t *testing.T) {
+	useConfig(t, func(c *Config) { c.LogIDSalt = "pepper" })
+	id := AccountLogID(42000001)
+	if len(id) != 8 || strings.Contains(id, "42000001") {
+		t.Errorf("Log ID %q isn't a short hash", id)
+	}
+	if again := AccountLogID(42000001); again != id {
+		t.Errorf("Log ID changed from %q to %q", id, again)
+	}
+	if other := AccountLogID(42000002); other == id {
+		t.Errorf("Different accounts share log ID %q", id)
+	}
+
+	useConfig(t, func(c *Config) { c.LogIDSalt = "salt" })
+	if salted := AccountLogID(42000001); salted == id {
+		t.Error("Log ID doesn't depend on the salt")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+*
+* Database schema migrations. Each entry in migrations is applied once, in
+* order, and the highest applied version is recorded in schema_version so
+* that upgrading the server doesn't require running any SQL by hand.
+ */
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Ordered list of schema changes. Entries must never be modified or reordered
+// once released; add a new entry to the end of the list instead. Statements
+// within a migration are executed in order.
+var migrations = [][]string{
+	// 1: Initial schema. Uses IF NOT EXISTS so that databases created from
+	// archondb.sql before migrations existed are picked up without errors.
+	{
+		`CREATE TABLE IF NOT EXISTS account_data (
+			username varchar(17) NOT NULL,
+			password char(64) NOT NULL,
+			email varchar(255),
+			registration_date timestamp DEFAULT NOW(),
+			lastip varchar(16),
+			lasthwinfo tinyblob,
+			guildcard int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			is_gm boolean DEFAULT false,
+			is_banned boolean DEFAULT false,
+			is_active boolean DEFAULT false,
+			team_id int(11) NOT NULL DEFAULT '-1',
+			privlevel smallint(3) NOT NULL DEFAULT '0',
+			lastchar tinyblob,
+			INDEX login_index (username, password)
+		)`,
+		`CREATE TABLE IF NOT EXISTS player_options (
+			guildcard int(11) PRIMARY KEY,
+			key_config blob,
+			FOREIGN KEY (guildcard) REFERENCES account_data(guildcard)
+		)`,
+		`CREATE TABLE IF NOT EXISTS characters (
+			guildcard int(11),
+			slot_num tinyint(2),
+			experience int DEFAULT 0,
+			level smallint DEFAULT 0,
+			guildcard_str binary(16),
+			name_color int unsigned DEFAULT X'FFFFFFFF',
+			model smallint,
+			name_color_chksm int,
+			section_id tinyint,
+			char_class tinyint,
+			v2_flags tinyint,
+			version tinyint,
+			v1_flags int,
+			costume smallint,
+			skin smallint,
+			face smallint,
+			head smallint,
+			hair smallint,
+			hair_red smallint,
+			hair_green smallint,
+			hair_blue smallint,
+			proportion_x float,
+			proportion_y float,
+			name binary(24),
+			playtime int DEFAULT 0,
+			atp smallint,
+			mst smallint,
+			evp smallint,
+			hp smallint,
+			dfp smallint,
+			ata smallint,
+			lck smallint,
+			meseta int,
+			bank_use int DEFAULT 0,
+			bank_meseta int DEFAULT 0,
+			INDEX character_index (guildcard, slot_num),
+			FOREIGN KEY (guildcard) REFERENCES account_data(guildcard)
+		)`,
+		`CREATE TABLE IF NOT EXISTS guildcard_entries (
+			guildcard int(11) PRIMARY KEY,
+			friend_gc int(11) NOT NULL,
+			name binary(48),
+			team_name binary(32),
+			description binary(176),
+			language tinyint,
+			section_id tinyint,
+			char_class tinyint,
+			comment binary(176),
+			FOREIGN KEY (guildcard) REFERENCES account_data(guildcard),
+			FOREIGN KEY (friend_gc) REFERENCES account_data(guildcard)
+		)`,
+	},
+	// 2: Track when each character was created.
+	{
+		`ALTER TABLE characters ADD COLUMN creation_time timestamp DEFAULT CURRENT_TIMESTAMP`,
+	},
+	// 3: Remember the address each account first logged in from.
+	{
+		`ALTER TABLE account_data ADD COLUMN first_ip varchar(16)`,
+	},
+	// 4: Record when each account last logged in.
+	{
+		`ALTER TABLE account_data ADD COLUMN last_login timestamp NULL DEFAULT NULL`,
+	},
+	// 5: Accounts are looked up by username alone now that passwords are
+	// checked with bcrypt rather than matched in the query.
+	{
+		`CREATE INDEX username_index ON account_data (username)`,
+	},
+	// 6: Store the full character along with its checksum so that corrupt
+	// saves are caught when the character is loaded.
+	{
+		`ALTER TABLE characters ADD COLUMN char_data blob`,
+		`ALTER TABLE characters ADD COLUMN char_checksum int unsigned`,
+	},
+	// 7: Bank shared by all of an account's characters, used when the
+	// shared_bank feature is enabled.
+	{
+		`CREATE TABLE IF NOT EXISTS shared_banks (
+			guildcard int(11) PRIMARY KEY,
+			bank blob,
+			FOREIGN KEY (guildcard) REFERENCES account_data(guildcard)
+		)`,
+	},
+}
+
+// MySQL error numbers for tables, columns and indexes that already exist.
+const (
+	mysqlTableExists     = 1050
+	mysqlDuplicateColumn = 1060
+	mysqlDuplicateKey    = 1061
+)
+
+// Returns true if err means that the statement's change has already been
+// made to the schema.
+func alreadyApplied(err error) bool {
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		switch mysqlErr.Number {
+		case mysqlTableExists, mysqlDuplicateColumn, mysqlDuplicateKey:
+			return true
+		}
+	}
+	return false
+}
+
+// Bring the database schema up to date by applying any migrations that
+// haven't been recorded in schema_version yet. Safe to call on every startup.
+//
+// Migrations aren't atomic: MySQL commits implicitly after every DDL
+// statement, so the transaction only covers the schema_version update and a
+// migration that fails partway leaves its earlier statements applied. To
+// let the migration be retried, statements that fail because their table,
+// column or index already exists are treated as having succeeded.
+func RunMigrations(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version int NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	row := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	if err = row.Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[i] {
+			if _, err = tx.Exec(stmt); err != nil && !alreadyApplied(err) {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %s", i+1, err.Error())
+			}
+		}
+		if _, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
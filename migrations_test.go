@@ -0,0 +1,103 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"testing"
+)
+
+// Expect the statements that run before any migrations are applied, with
+// version already recorded in schema_version.
+func expectSchemaVersion(fake *fakeDB, version int) {
+	fake.Expect("CREATE TABLE IF NOT EXISTS schema_version").WillAffect(0)
+	fake.Expect("SELECT COALESCE(MAX(version), 0)").
+		WillReturnRows([]string{"version"}, []driver.Value{int64(version)})
+}
+
+func TestRunMigrationsUpToDate(t *testing.T) {
+	db, fake := newFakeDB(t)
+	expectSchemaVersion(fake, len(migrations))
+	if err := RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMigrationsRetriesPartialMigration(t *testing.T) {
+	db, fake := newFakeDB(t)
+	// Migration 6 failed after adding char_data on an earlier startup.
+	expectSchemaVersion(fake, 5)
+	fake.Expect("ADD COLUMN char_data").
+		WillFail(&mysql.MySQLError{Number: mysqlDuplicateColumn, Message: "Duplicate column name"})
+	fake.Expect("ADD COLUMN char_checksum").WillAffect(0)
+	fake.Expect("INSERT INTO schema_version").WithArgs(int64(6)).WillAffect(1)
+	fake.Expect("CREATE TABLE IF NOT EXISTS shared_banks").WillAffect(0)
+	fake.Expect("INSERT INTO schema_version").WithArgs(int64(7)).WillAffect(1)
+	if err := RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMigrationsFails(t *testing.T) {
+	db, fake := newFakeDB(t)
+	expectSchemaVersion(fake, 5)
+	fake.Expect("ADD COLUMN char_data").WillFail(errors.New("Lost connection"))
+	if err := RunMigrations(db); err == nil {
+		t.Error("Migration error was ignored")
+	}
+	if log := fake.Log(); log[len(log)-1] != "ROLLBACK" {
+		t.Errorf("Failed migration wasn't rolled back: %v", log)
+	}
+}
+
+func TestRunMigrationsFromEmpty(t *testing.T) {
+	db, fake := newFakeDB(t)
+	expectSchemaVersion(fake, 0)
+	var recorded []*fakeQuery
+	for i, migration := range migrations {
+		for _, stmt := range migration {
+			fake.Expect(stmt).WillAffect(0)
+		}
+		recorded = append(recorded,
+			fake.Expect("INSERT INTO schema_version").WithArgs(int64(i+1)).WillAffect(1))
+	}
+	if err := RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	// Every statement matches its own expectation, so running a migration
+	// twice would have been reported as an unexpected statement.
+	var version int64
+	for i, q := range recorded {
+		if q.Args() == nil {
+			t.Fatalf("Version %d wasn't recorded", i+1)
+		}
+		version = q.Args()[0].(int64)
+	}
+
+	// Starting again from the recorded version applies nothing.
+	applied := len(fake.Log())
+	expectSchemaVersion(fake, int(version))
+	if err := RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	if log := fake.Log()[applied:]; len(log) != 2 {
+		t.Errorf("Second run executed %v", log)
+	}
+}
@@ -88,14 +88,19 @@ func sendFileList(client *Client, node *PatchDir) {
 // The client sent us a checksum for one of the patch files. Compare it
 // to what we have and add it to the list of files to update if there
 // is any discrepancy.
-func handleFileStatus(client *Client) {
+func handleFileStatus(client *Client) error {
 	var fileStatus FileStatusPacket
-	util.StructFromBytes(client.Data(), &fileStatus)
+	if err := util.StructFromBytes(client.Data(), &fileStatus); err != nil {
+		return err
+	} else if fileStatus.PatchId >= uint32(len(patchIndex)) {
+		return fmt.Errorf("Invalid patch file %d", fileStatus.PatchId)
+	}
 
 	patch := patchIndex[fileStatus.PatchId]
 	if fileStatus.Checksum != patch.checksum || fileStatus.FileSize != patch.fileSize {
 		client.updateList = append(client.updateList, patch)
 	}
+	return nil
 }
 
 // The client finished sending all of the file check packets. If they have
@@ -263,7 +268,9 @@ func (server PatchServer) NewClient(conn *net.TCPConn) (*Client, error) {
 
 func (server PatchServer) Handle(c *Client) error {
 	var hdr PCHeader
-	util.StructFromBytes(c.Data()[:PCHeaderSize], &hdr)
+	if err := util.StructFromBytes(c.Data(), &hdr); err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case PatchWelcomeType:
@@ -293,7 +300,9 @@ func (server DataServer) NewClient(conn *net.TCPConn) (*Client, error) {
 
 func (server DataServer) Handle(c *Client) error {
 	var hdr PCHeader
-	util.StructFromBytes(c.Data()[:PCHeaderSize], &hdr)
+	if err := util.StructFromBytes(c.Data(), &hdr); err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case PatchWelcomeType:
@@ -303,7 +312,9 @@ func (server DataServer) Handle(c *Client) error {
 		sendFileList(c, &patchTree)
 		c.SendFileListDone()
 	case PatchFileStatusType:
-		handleFileStatus(c)
+		if err := handleFileStatus(c); err != nil {
+			return err
+		}
 	case PatchClientListDoneType:
 		if err := updateClientFiles(c); err != nil {
 			return err
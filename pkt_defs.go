@@ -21,6 +21,11 @@
  */
 package main
 
+import (
+	"encoding/hex"
+	"github.com/dcrodman/archon/util"
+)
+
 const (
 	PCHeaderSize = 0x04
 	BBHeaderSize = 0x08
@@ -57,6 +62,7 @@ const (
 	LoginCharPreviewReqType     = 0xE3
 	LoginCharAckType            = 0xE4
 	LoginCharPreviewType        = 0xE5
+	LoginFullCharacterType      = 0xE7
 	LoginChecksumType           = 0x01E8
 	LoginChecksumAckType        = 0x02E8
 	LoginGuildcardReqType       = 0x03E8
@@ -75,13 +81,19 @@ const (
 
 // Packet types for packets sent to and from the ship and block servers.
 const (
-	BlockListType = 0x07
-	LobbyListType = 0x83
+	BlockListType            = 0x07
+	GuildcardSearchReplyType = 0x41
+	LobbyListType            = 0x83
+	CharDataRequestType      = 0x95
+	SimpleMailType           = 0x81
+	CreateGameType           = 0xC1
+	TeamStatusType           = 0x12EA
 )
 
 // Packet types common to multiple servers.
 const (
 	DisconnectType = 0x05
+	PingType       = 0x1D
 	RedirectType   = 0x19
 	MenuSelectType = 0x10
 )
@@ -105,6 +117,17 @@ const (
 	BBLoginErrorDisconnect   = 0xC
 )
 
+// Reasons that can be given to the client when disconnecting it.
+type DisconnectReason uint32
+
+const (
+	DisconnectNone        DisconnectReason = 0x0
+	DisconnectBanned                       = 0x1
+	DisconnectKicked                       = 0x2
+	DisconnectServerFull                   = 0x3
+	DisconnectMaintenance                  = 0x4
+)
+
 // Blueburst, PC, and Gamecube clients all use a 4 byte header to
 // communicate with the patch server instead of the 8 byte one used
 // by Blueburst for the other servers.
@@ -201,7 +224,8 @@ type LoginPkt struct {
 	Header        BBHeader
 	Unknown       [8]byte
 	ClientVersion uint16
-	Unknown2      [3]byte
+	Language      uint8
+	Unknown2      [2]byte
 	SlotNum       int8
 	Phase         uint16 // differentiate login packet?
 	TeamId        uint32
@@ -213,17 +237,28 @@ type LoginPkt struct {
 	Security      [40]byte
 }
 
+// Returns the hardware identifier the client sent as a hex string, which
+// stays the same across logins from the same machine.
+func (p *LoginPkt) HardwareID() string {
+	return hex.EncodeToString(p.HardwareInfo[:])
+}
+
 // Represent the client's progression through the login process.
 type ClientConfig struct {
-	Magic        uint32 // Must be set to 0x48615467
+	Magic        uint32 // Must be set to ClientConfigMagic
 	CharSelected uint8  // Has a character been selected?
 	SlotNum      uint8  // Slot number of selected Character
 	Flags        uint16
 	Ports        [4]uint16
-	Unused       [4]uint32
+	SessionToken uint32 // Issued by the login server; see SessionList.IssueToken
+	Unused       [3]uint32
 	Unused2      [2]uint32
 }
 
+// Value of ClientConfig.Magic once the client has made it through the
+// login server.
+const ClientConfigMagic = 0x48615467
+
 // Security packet (0xE6) sent to the client to indicate the state of client login.
 type SecurityPacket struct {
 	Header       BBHeader
@@ -259,6 +294,44 @@ type KeyTeamConfig struct {
 	TeamRewards        [2]uint32
 }
 
+// A player's team membership, laid out the same way as the team section of
+// KeyTeamConfig.
+type TeamStatusPacket struct {
+	Header             BBHeader
+	Guildcard          uint32
+	TeamId             uint32
+	TeamInfo           [2]uint32
+	TeamPrivilegeLevel uint16
+	Reserved           uint16
+	Teamname           [0x10]uint16
+	TeamFlag           [0x0800]uint8
+}
+
+// Mail sent from one player to another by guildcard.
+type SimpleMailPacket struct {
+	Header        BBHeader
+	Tag           uint32
+	FromGuildcard uint32
+	FromName      [0x10]uint16
+	ToGuildcard   uint32
+	Date          [0x14]uint16
+	Text          [0x200]uint16
+}
+
+// Request to create a game, sent from a block's lobby.
+type CreateGamePacket struct {
+	Header        BBHeader
+	Unused        [2]uint32
+	Name          [0x10]uint16
+	Password      [0x10]uint16
+	Difficulty    uint8
+	BattleMode    uint8
+	ChallengeMode uint8
+	Episode       uint8
+	SinglePlayer  uint8
+	Padding       [3]uint8
+}
+
 // Option packet containing keyboard and joystick config, team options, etc.
 type OptionsPacket struct {
 	Header          BBHeader
@@ -278,7 +351,14 @@ type CharAckPacket struct {
 	Flag   uint32
 }
 
-// Sent in response to 0x01E8 to acknowledge a checksum (really it's just ignored).
+// Checksum of the client's files sent to the character server (0x01E8).
+type ChecksumPacket struct {
+	Header   BBHeader
+	Checksum uint32
+	Padding  uint32
+}
+
+// Sent in response to 0x01E8 to acknowledge a checksum.
 type ChecksumAckPacket struct {
 	Header BBHeader
 	Ack    uint32
@@ -333,6 +413,18 @@ type CharPreviewPacket struct {
 	Character *CharacterPreview
 }
 
+// Previews for all of an account's slots at once. The number of entries is
+// carried in the header flags.
+type CharSelectMenuPacket struct {
+	Header  BBHeader
+	Entries [MaxCharacterSlots]CharSelectMenuEntry
+}
+
+type CharSelectMenuEntry struct {
+	Slot      uint32
+	Character CharacterPreview
+}
+
 // Message in a large text box, usually sent right before a disconnect.
 type LoginClientMessagePacket struct {
 	Header   BBHeader
@@ -340,6 +432,12 @@ type LoginClientMessagePacket struct {
 	Message  []byte
 }
 
+// Sent to the client before closing the connection. The reason is carried
+// in the header flags.
+type DisconnectPacket struct {
+	Header BBHeader
+}
+
 // Indicate the server's current time.
 type TimestampPacket struct {
 	Header    BBHeader
@@ -372,6 +470,16 @@ type MenuSelectionPacket struct {
 	ItemId  uint32
 }
 
+// Decode a menu selection packet, returning an error if data is too short
+// to be one.
+func ParseMenuSelection(data []byte) (menuId, itemId uint32, err error) {
+	var pkt MenuSelectionPacket
+	if err = util.StructFromBytes(data, &pkt); err != nil {
+		return 0, 0, err
+	}
+	return uint32(pkt.MenuId), pkt.ItemId, nil
+}
+
 // List containing the available blocks on a ship.
 type BlockListPacket struct {
 	Header   BBHeader
@@ -384,9 +492,27 @@ type BlockListPacket struct {
 // Available lobbies on a block.
 type LobbyListPacket struct {
 	Header  BBHeader
-	Lobbies []struct {
-		MenuId  uint32
-		LobbyId uint32
-		Padding uint32
-	}
+	Lobbies []LobbyListEntry
+}
+
+// The client doesn't use the last field of each entry, so we fill it in
+// with the number of players in the lobby.
+type LobbyListEntry struct {
+	MenuId  uint32
+	LobbyId uint32
+	Players uint32
+}
+
+// Reply to a guildcard search with the location of the player found.
+type GuildcardSearchReplyPacket struct {
+	Header     BBHeader
+	PlayerTag  uint32
+	SearcherGc uint32
+	TargetGc   uint32
+	Unknown    [20]byte
+	Location   [68]uint16
+	MenuId     uint32
+	LobbyId    uint32
+	Unknown2   [60]byte
+	Name       [32]uint16
 }
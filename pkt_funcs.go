@@ -20,10 +20,12 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/dcrodman/archon/util"
-	"syscall"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,13 +34,17 @@ const (
 	patchCopyright = "Patch Server. Copyright SonicTeam, LTD. 2001"
 	loginCopyright = "Phantasy Star Online Blue Burst Game Server. Copyright 1999-2004 SONICTEAM."
 	// Format for the timestamp sent to the client.
-	timeFmt = "2006:01:02: 15:05:05"
+	timeFmt = "2006:01:02: 15:04:05.000"
 )
 
 var (
 	patchCopyrightBytes []byte
 	loginCopyrightBytes []byte
 	serverName          = util.ConvertToUtf16("Archon")
+
+	// Source of the current time; replaceable so that time-dependent
+	// packets can be checked against a fixed clock.
+	timeNow = time.Now
 )
 
 // Send the packet serialized (or otherwise contained) in pkt to a client.
@@ -59,6 +65,24 @@ func sendEncrypted(c *Client, data []byte, length uint16) int {
 		util.PrintPayload(data, int(length))
 		fmt.Println()
 	}
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.capturePacket(CaptureSent, data[:length])
+	c.Encrypt(data, uint32(length))
+	return sendPacket(c, data, length)
+}
+
+// Encrypt and send data made up of one or more packets that have already
+// been padded with PadPacket, in a single write.
+func sendEncryptedBatch(c *Client, data []byte) int {
+	length := uint16(len(data))
+	if config.DebugMode {
+		util.PrintPayload(data, int(length))
+		fmt.Println()
+	}
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.capturePacket(CaptureSent, data)
 	c.Encrypt(data, uint32(length))
 	return sendPacket(c, data, length)
 }
@@ -75,6 +99,15 @@ func fixLength(data []byte, length uint16, hdrSize uint16) ([]byte, uint16) {
 	return data, length
 }
 
+// Pad a serialized BB packet with zeroes to a multiple of 8 bytes and set
+// the Size in its header to match, for packets that are built ahead of
+// time rather than sent straight away with sendEncrypted (which pads them
+// itself).
+func PadPacket(payload []byte) []byte {
+	data, _ := fixLength(payload, uint16(len(payload)), BBHeaderSize)
+	return data
+}
+
 // Send a simple 4-byte header packet.
 func (client *Client) sendPCHeader(pktType uint16) int {
 	pkt := &PCHeader{Type: pktType, Size: 0x04}
@@ -100,6 +133,7 @@ func (client *Client) SendPCWelcome() int {
 		util.PrintPayload(data, size)
 		fmt.Println()
 	}
+	client.capturePacket(CaptureSent, data[:size])
 	return sendPacket(client, data, uint16(size))
 }
 
@@ -274,6 +308,7 @@ func (client *Client) SendWelcome() int {
 		util.PrintPayload(data, size)
 		fmt.Println()
 	}
+	client.capturePacket(CaptureSent, data[:size])
 	return sendPacket(client, data, uint16(size))
 }
 
@@ -314,6 +349,28 @@ func (client *Client) SendRedirect(port uint16, ipAddr [4]byte) int {
 	return sendEncrypted(client, data, uint16(size))
 }
 
+// Send a ping, which the client echoes back. The time is recorded so that
+// the round trip time can be measured when the response arrives.
+func (client *Client) SendPing() int {
+	pkt := &BBHeader{Type: PingType}
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Ping Packet")
+	}
+	atomic.StoreInt64(&client.pingSent, timeNow().UnixNano())
+	return sendEncrypted(client, data, uint16(size))
+}
+
+// Send the client to the ship described by ship.
+func (client *Client) SendShipRedirect(ship ShipConfig) int {
+	port, err := strconv.ParseUint(ship.Port, 10, 16)
+	if err != nil {
+		log.Errorf("Invalid port %q for ship %s", ship.Port, ship.Name)
+		return 1
+	}
+	return client.SendRedirect(uint16(port), hostBytes(ship.Host))
+}
+
 // Send the client's configuration options. keyConfig should be 420 bytes long and either
 // point to the default keys array or loaded from the database.
 func (client *Client) SendOptions(keyConfig []byte) int {
@@ -338,6 +395,55 @@ func (client *Client) SendOptions(keyConfig []byte) int {
 	return sendEncrypted(client, data, uint16(size))
 }
 
+// Send the key, joystick, and team config stored with fc. Unlike SendOptions
+// this sends the whole KeyTeamConfig as the character has it, with the
+// guildcard filled in from the client.
+func (client *Client) SendKeyConfig(fc *FullCharacter) int {
+	pkt := &OptionsPacket{
+		Header:          BBHeader{Type: LoginOptionsType},
+		PlayerKeyConfig: fc.KeyConfig,
+	}
+	pkt.PlayerKeyConfig.Guildcard = client.guildcard
+	pkt.PlayerKeyConfig.TeamRewards[0] = 0xFFFFFFFF
+	pkt.PlayerKeyConfig.TeamRewards[1] = 0xFFFFFFFF
+
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Key Config Packet")
+	}
+	return sendEncrypted(client, data, uint16(size))
+}
+
+// Send the team membership stored with fc so that the client can show the
+// player's team, privilege level, and flag.
+func (client *Client) SendTeamStatus(fc *FullCharacter) int {
+	team := &fc.KeyConfig
+	pkt := &TeamStatusPacket{
+		Header:             BBHeader{Type: TeamStatusType},
+		Guildcard:          fc.Guildcard,
+		TeamId:             team.TeamId,
+		TeamInfo:           team.TeamInfo,
+		TeamPrivilegeLevel: team.TeamPrivilegeLevel,
+		Teamname:           team.Teamname,
+		TeamFlag:           team.TeamFlag,
+	}
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Team Status Packet")
+	}
+	return sendEncrypted(client, data, uint16(size))
+}
+
+// Deliver mail from another player.
+func (client *Client) SendSimpleMail(pkt *SimpleMailPacket) int {
+	pkt.Header.Type = SimpleMailType
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Simple Mail Packet")
+	}
+	return sendEncrypted(client, data, uint16(size))
+}
+
 // Send the character acknowledgement packet. 0 indicates a creation ack, 1 is
 // ack'ing a selected character, and 2 indicates that a character doesn't exist
 // in the slot requested via preview request.
@@ -354,23 +460,50 @@ func (client *Client) SendCharacterAck(slotNum uint32, flag uint32) int {
 	return sendEncrypted(client, data, uint16(size))
 }
 
-// Send the preview packet containing basic details about a character in
-// the selected slot.
-func (client *Client) SendCharacterPreview(charPreview *CharacterPreview) int {
-	pkt := &CharPreviewPacket{
-		Header:    BBHeader{Type: LoginCharPreviewType},
-		Slot:      0,
-		Character: charPreview,
-	}
-	data, size := util.BytesFromStruct(pkt)
+// Send the character select menu with the previews of the account's
+// characters; nil previews are shown as empty slots.
+func (client *Client) SendCharacterSelectMenu(previews [MaxCharacterSlots]*CharacterPreview) int {
+	data := BuildCharacterSelectMenu(previews)
 	if config.DebugMode {
-		fmt.Println("Sending Character Preview Packet")
+		fmt.Println("Sending Character Select Menu Packet")
 	}
-	return sendEncrypted(client, data, uint16(size))
+	return sendEncrypted(client, data, uint16(len(data)))
+}
+
+// Build the character select menu from the previews for each slot. Slots
+// without a character (nil previews) are sent as empty slots.
+func BuildCharacterSelectMenu(previews [MaxCharacterSlots]*CharacterPreview) []byte {
+	pkt := &CharSelectMenuPacket{
+		Header: BBHeader{Type: LoginCharPreviewType, Flags: MaxCharacterSlots},
+	}
+	for i, prev := range previews {
+		entry := &pkt.Entries[i]
+		entry.Slot = uint32(i)
+		// Empty slots are left zeroed, same as EmptyCharacterSlot.
+		if prev != nil {
+			entry.Character = *prev
+		}
+	}
+	data, _ := util.BytesFromStruct(pkt)
+	return PadPacket(data)
+}
+
+// Size of the FullCharacter payload of the E7 packet.
+const fullCharacterSize = 0x399C
+
+// Build the E7 packet containing all of fc's data. Returns an error if
+// FullCharacter no longer serializes to the size the client expects.
+func BuildE7Packet(fc *FullCharacter) ([]byte, error) {
+	if size := binary.Size(fc); size != fullCharacterSize {
+		return nil, fmt.Errorf("FullCharacter is %d bytes; expected %d", size, fullCharacterSize)
+	}
+	hdr, _ := util.BytesFromStruct(&BBHeader{Type: LoginFullCharacterType})
+	payload, _ := util.BytesFromStruct(fc)
+	return PadPacket(append(hdr, payload...)), nil
 }
 
-// Acknowledge the checksum the client sent us. We don't actually do
-// anything with it but the client won't proceed otherwise.
+// Acknowledge the checksum the client sent us. An ack of 0 tells the client
+// that the checksum was rejected; the client won't proceed otherwise.
 func (client *Client) SendChecksumAck(ack uint32) int {
 	pkt := new(ChecksumAckPacket)
 	pkt.Header.Type = LoginChecksumAckType
@@ -462,16 +595,38 @@ func (client *Client) SendClientMessage(message string) int {
 	return sendEncrypted(client, data, uint16(size))
 }
 
+// Messages displayed to the player for each of the disconnect reasons.
+var disconnectMessages = map[DisconnectReason]string{
+	DisconnectBanned:      "You have been banned from this server.",
+	DisconnectKicked:      "You have been disconnected by an administrator.",
+	DisconnectServerFull:  "The server is full.\n\nPlease try again later.",
+	DisconnectMaintenance: "The server is down for maintenance.\n\nPlease try again later.",
+}
+
+// Tell the client why it's about to be disconnected. The client only shows
+// something for the 0x1A message, so that's sent first if we have one.
+func (client *Client) SendDisconnectReason(reason DisconnectReason) int {
+	if msg, ok := disconnectMessages[reason]; ok {
+		if ret := client.SendClientMessage(msg); ret != 0 {
+			return ret
+		}
+	}
+	pkt := &DisconnectPacket{
+		Header: BBHeader{Type: DisconnectType, Flags: uint32(reason)},
+	}
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Disconnect Packet")
+	}
+	return sendEncrypted(client, data, uint16(size))
+}
+
 // Send a timestamp packet in order to indicate the server's current time.
 func (client *Client) SendTimestamp() int {
 	pkt := new(TimestampPacket)
 	pkt.Header.Type = LoginTimestampType
 
-	var tv syscall.Timeval
-	syscall.Gettimeofday(&tv)
-	t := time.Now().Format(timeFmt)
-	stamp := fmt.Sprintf("%s.%03d", t, uint64(tv.Usec/1000))
-	copy(pkt.Timestamp[:], stamp)
+	copy(pkt.Timestamp[:], timeNow().Format(timeFmt))
 
 	data, size := util.BytesFromStruct(pkt)
 	if config.DebugMode {
@@ -543,6 +698,37 @@ func (client *Client) SendLobbyList(pkt *LobbyListPacket) int {
 	return sendEncrypted(client, data, uint16(size))
 }
 
+// Build the lobby list packet for lobbies, which can be sent to any number
+// of clients with sendEncrypted.
+func BuildLobbyListMenu(lobbies []LobbyInfo) []byte {
+	pkt := &LobbyListPacket{
+		Header:  BBHeader{Type: LobbyListType, Flags: uint32(len(lobbies))},
+		Lobbies: make([]LobbyListEntry, len(lobbies)),
+	}
+	for i, lobby := range lobbies {
+		pkt.Lobbies[i] = LobbyListEntry{
+			MenuId:  LobbyMenuId,
+			LobbyId: lobby.Id,
+			Players: uint32(lobby.Players),
+		}
+	}
+	data, _ := util.BytesFromStruct(pkt)
+	return PadPacket(data)
+}
+
+// Ask the client for its character data once it's connected to a block,
+// which moves it past the loading screen it shows after being redirected
+// from the ship. Must follow the lobby list; the client replies with its
+// character data before it can be added to a lobby.
+func (client *Client) SendBlockTransition() int {
+	pkt := &BBHeader{Type: CharDataRequestType}
+	data, size := util.BytesFromStruct(pkt)
+	if config.DebugMode {
+		fmt.Println("Sending Character Data Request Packet")
+	}
+	return sendEncrypted(client, data, uint16(size))
+}
+
 func init() {
 	patchCopyrightBytes = []byte(patchCopyright)
 	loginCopyrightBytes = []byte(loginCopyright)
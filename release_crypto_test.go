@@ -0,0 +1,33 @@
+//go:build release
+// +build release
+
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import "testing"
+
+func TestReleaseIgnoresDebugDisableCrypto(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.DebugMode = true
+		c.DebugDisableCrypto = true
+	})
+	if cryptoDisabled() {
+		t.Error("Encryption was disabled in a release build")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Write-behind queue for character saves. Saves of the same character that
+* happen in quick succession are coalesced so that only the latest copy is
+* written to the database.
+ */
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type saveKey struct {
+	guildcard uint32
+	slot      uint32
+}
+
+// Function used by SaveQueue to write a character to the database.
+type SaveFunc func(guildcard, slot uint32, fc *FullCharacter) error
+
+type SaveQueue struct {
+	save     SaveFunc
+	interval time.Duration
+	pending  map[saveKey]*FullCharacter
+	started  bool
+	stopOnce sync.Once
+	done     chan struct{}
+	stopped  chan struct{}
+	// Held while writing saves so that an older copy of a character can't
+	// be written after a newer one by a concurrent flush.
+	saveMu sync.Mutex
+	sync.Mutex
+}
+
+// Returns a queue that writes pending saves with save every interval once
+// Start has been called.
+func NewSaveQueue(interval time.Duration, save SaveFunc) *SaveQueue {
+	return &SaveQueue{
+		save:     save,
+		interval: interval,
+		pending:  make(map[saveKey]*FullCharacter),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start flushing the queue in the background.
+func (q *SaveQueue) Start() {
+	q.Lock()
+	defer q.Unlock()
+	if q.started {
+		return
+	}
+	q.started = true
+	go func() {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		defer close(q.stopped)
+		for {
+			select {
+			case <-ticker.C:
+				q.Flush()
+			case <-q.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background flush, if it was started, and synchronously write
+// anything still pending. Must be called before the server exits.
+func (q *SaveQueue) Stop() error {
+	q.stopOnce.Do(func() {
+		q.Lock()
+		started := q.started
+		q.Unlock()
+		if started {
+			close(q.done)
+			<-q.stopped
+		}
+	})
+	return q.Flush()
+}
+
+// Queue a save of fc, replacing any save of the same character that
+// hasn't been written yet. The queue keeps its own copy of fc.
+func (q *SaveQueue) Queue(guildcard, slot uint32, fc *FullCharacter) {
+	saved := *fc
+	q.Lock()
+	q.pending[saveKey{guildcard, slot}] = &saved
+	q.Unlock()
+}
+
+// Write all pending saves. Saves that fail are logged and put back in the
+// queue to be retried, unless the character has been queued again since;
+// the last error is returned.
+func (q *SaveQueue) Flush() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.Lock()
+	pending := q.pending
+	q.pending = make(map[saveKey]*FullCharacter)
+	q.Unlock()
+
+	var lastErr error
+	for key, fc := range pending {
+		if err := q.write(key, fc); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Write the pending save for a single character, if there is one. Used
+// when a player logs out so their character isn't left in the queue.
+func (q *SaveQueue) FlushCharacter(guildcard, slot uint32) error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	key := saveKey{guildcard, slot}
+	q.Lock()
+	fc, ok := q.pending[key]
+	delete(q.pending, key)
+	q.Unlock()
+	if !ok {
+		return nil
+	}
+	return q.write(key, fc)
+}
+
+// Save fc, requeueing it if the save fails. Must be called with saveMu held.
+func (q *SaveQueue) write(key saveKey, fc *FullCharacter) error {
+	err := q.save(key.guildcard, key.slot, fc)
+	if err != nil {
+		log.Errorf("Failed to save character %d:%d: %s", key.guildcard, key.slot, err.Error())
+		q.Lock()
+		if _, queued := q.pending[key]; !queued {
+			q.pending[key] = fc
+		}
+		q.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Records every save made through a SaveQueue.
+type saveRecorder struct {
+	saves []*FullCharacter
+	fail  error
+	sync.Mutex
+}
+
+func (r *saveRecorder) save(guildcard, slot uint32, fc *FullCharacter) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.fail != nil {
+		return r.fail
+	}
+	r.saves = append(r.saves, fc)
+	return nil
+}
+
+func (r *saveRecorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.saves)
+}
+
+func TestSaveQueueCoalesces(t *testing.T) {
+	var rec saveRecorder
+	q := NewSaveQueue(time.Hour, rec.save)
+	fc := NewTestCharacter(t)
+	for meseta := uint32(1); meseta <= 5; meseta++ {
+		fc.Character.Meseta = meseta
+		q.Queue(fc.Guildcard, 0, fc)
+	}
+	// The queue keeps its own copy.
+	fc.Character.Meseta = 100
+
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.saves) != 1 {
+		t.Fatalf("Rapid saves were written %d times; expected once", len(rec.saves))
+	}
+	if meseta := rec.saves[0].Character.Meseta; meseta != 5 {
+		t.Errorf("Saved the snapshot with %d meseta; expected the last one", meseta)
+	}
+	if err := q.Flush(); err != nil || len(rec.saves) != 1 {
+		t.Errorf("Second flush saved again (err %v)", err)
+	}
+}
+
+func TestSaveQueueStopFlushes(t *testing.T) {
+	var rec saveRecorder
+	q := NewSaveQueue(time.Hour, rec.save)
+	q.Start()
+	q.Queue(42000001, 0, NewTestCharacter(t))
+	q.Queue(42000001, 1, NewTestCharacter(t))
+	if err := q.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.count(); n != 2 {
+		t.Errorf("Stop wrote %d saves; expected 2", n)
+	}
+	// Stopping twice is harmless.
+	if err := q.Stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveQueueStopWithoutStart(t *testing.T) {
+	var rec saveRecorder
+	q := NewSaveQueue(time.Hour, rec.save)
+	q.Queue(42000001, 0, NewTestCharacter(t))
+	stopped := make(chan error)
+	go func() { stopped <- q.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hung on a queue that was never started")
+	}
+	if n := rec.count(); n != 1 {
+		t.Errorf("Stop wrote %d saves; expected 1", n)
+	}
+}
+
+func TestSaveQueueRequeuesFailedSaves(t *testing.T) {
+	rec := saveRecorder{fail: errors.New("connection lost")}
+	q := NewSaveQueue(time.Hour, rec.save)
+	fc := NewTestCharacter(t)
+	q.Queue(fc.Guildcard, 0, fc)
+	q.Queue(fc.Guildcard, 1, fc)
+	if err := q.Flush(); err == nil {
+		t.Fatal("Flush didn't report the failed saves")
+	}
+	if err := q.FlushCharacter(fc.Guildcard, 1); err == nil {
+		t.Fatal("FlushCharacter didn't report the failed save")
+	}
+
+	// Saved later with the retry, and a newer snapshot isn't replaced by
+	// the failed one.
+	fc.Character.Meseta = 777
+	q.Queue(fc.Guildcard, 1, fc)
+	rec.fail = nil
+	if err := q.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.saves) != 2 {
+		t.Fatalf("Retried %d saves; expected 2", len(rec.saves))
+	}
+	for _, saved := range rec.saves {
+		if saved.Character.Meseta != 300 && saved.Character.Meseta != 777 {
+			t.Errorf("Saved a character with %d meseta", saved.Character.Meseta)
+		}
+	}
+}
+
+func TestSaveQueueSerializesSaves(t *testing.T) {
+	var active, overlapped int32
+	q := NewSaveQueue(time.Hour, func(gc, slot uint32, fc *FullCharacter) error {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil
+	})
+	fc := NewTestCharacter(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			q.Queue(fc.Guildcard, 0, fc)
+			q.Flush()
+		}()
+		go func() {
+			defer wg.Done()
+			q.Queue(fc.Guildcard, 0, fc)
+			q.FlushCharacter(fc.Guildcard, 0)
+		}()
+	}
+	wg.Wait()
+	if overlapped != 0 {
+		t.Error("Saves of the same character ran at the same time")
+	}
+}
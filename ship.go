@@ -40,18 +40,24 @@ type Block struct {
 }
 
 func handleShipLogin(sc *Client) error {
-	if _, err := VerifyAccount(sc); err != nil {
+	pkt, err := VerifyAccount(sc)
+	if err != nil {
 		return err
+	} else if !sc.ValidateSecurityData(pkt.Security[:]) {
+		sc.SendSecurity(BBLoginErrorUnknown, 0, 0)
+		return errors.New("Security data from " + sc.IPAddr() +
+			" doesn't match the session for guildcard " +
+			strconv.FormatUint(uint64(sc.guildcard), 10))
 	}
+	sessions.Handoff(sc)
 	sc.SendSecurity(BBLoginErrorNone, sc.guildcard, sc.teamId)
 	return nil
 }
 
 // The player selected a block to join from the menu.
-func handleBlockSelection(sc *Client, pkt MenuSelectionPacket) error {
+func handleBlockSelection(sc *Client, selectedBlock uint32) error {
 	// Grab the chosen block and redirect them to the selected block server.
 	port, _ := strconv.ParseInt(config.ShipPort, 10, 16)
-	selectedBlock := pkt.ItemId
 	if selectedBlock == BackMenuItem {
 		sc.SendShipList(shipList)
 	} else if int(selectedBlock) > config.NumBlocks {
@@ -62,6 +68,42 @@ func handleBlockSelection(sc *Client, pkt MenuSelectionPacket) error {
 	return nil
 }
 
+// Deliver simple mail to the recipient if they're online. The sender's
+// guildcard is filled in by the server so that mail can't be forged.
+func handleSimpleMail(c *Client) error {
+	if !config.Snapshot().FeatureEnabled(FeatureMail) {
+		c.SendClientMessage("Mail is disabled on this server.")
+		return nil
+	}
+	var pkt SimpleMailPacket
+	if err := util.StructFromBytes(c.Data()[:c.packetSize], &pkt); err != nil {
+		return err
+	}
+	pkt.FromGuildcard = c.guildcard
+	recipient, ok := sessions.Find(pkt.ToGuildcard)
+	if !ok {
+		c.SendClientMessage("That player isn't online.")
+		return nil
+	}
+	recipient.SendSimpleMail(&pkt)
+	return nil
+}
+
+// Games aren't hosted yet, so every request is turned away; challenge mode
+// games are refused outright when the feature is disabled.
+func handleCreateGame(c *Client) error {
+	var pkt CreateGamePacket
+	if err := util.StructFromBytes(c.Data()[:c.packetSize], &pkt); err != nil {
+		return err
+	}
+	if pkt.ChallengeMode != 0 && !config.Snapshot().FeatureEnabled(FeatureChallengeMode) {
+		c.SendClientMessage("Challenge mode is disabled on this server.")
+		return nil
+	}
+	c.SendClientMessage("Games can't be created on this server yet.")
+	return nil
+}
+
 func NewShipClient(conn *net.TCPConn) (*Client, error) {
 	cCrypt := crypto.NewBBCrypt()
 	sCrypt := crypto.NewBBCrypt()
@@ -117,26 +159,30 @@ func (server ShipServer) NewClient(conn *net.TCPConn) (*Client, error) {
 }
 
 func (server ShipServer) Handle(c *Client) error {
-	var err error = nil
 	var hdr BBHeader
-	util.StructFromBytes(c.Data()[:BBHeaderSize], &hdr)
+	err := util.StructFromBytes(c.Data(), &hdr)
+	if err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case LoginType:
 		err = handleShipLogin(c)
 		c.SendBlockList(server.blockPkt)
 	case MenuSelectType:
-		var pkt MenuSelectionPacket
-		util.StructFromBytes(c.Data(), &pkt)
+		var menuId, itemId uint32
+		if menuId, itemId, err = ParseMenuSelection(c.Data()[:c.packetSize]); err != nil {
+			break
+		}
 		// They can be at either the ship or block selection menu, so make sure we have the right one.
-		if pkt.MenuId == ShipSelectionMenuId {
+		if menuId == uint32(ShipSelectionMenuId) {
 			// TODO: Hack for now, but this coupling on the login server logic needs to go away.
 			err = handleShipSelection(c)
 		} else {
-			err = handleBlockSelection(c, pkt)
+			err = handleBlockSelection(c, itemId)
 		}
 	default:
-		log.Infof("Received unknown packet %02x from %s", hdr.Type, c.IPAddr())
+		c.Logf("Received unknown packet %02x", hdr.Type)
 	}
 	return err
 }
@@ -159,14 +205,9 @@ func (server *BlockServer) Init() {
 	server.lobbyPkt.Header.Type = LobbyListType
 	server.lobbyPkt.Header.Flags = uint32(config.NumLobbies)
 	for i := 0; i <= config.NumLobbies; i++ {
-		server.lobbyPkt.Lobbies = append(server.lobbyPkt.Lobbies, struct {
-			MenuId  uint32
-			LobbyId uint32
-			Padding uint32
-		}{
-			MenuId:  0x1A0001,
+		server.lobbyPkt.Lobbies = append(server.lobbyPkt.Lobbies, LobbyListEntry{
+			MenuId:  LobbyMenuId,
 			LobbyId: uint32(i),
-			Padding: 0,
 		})
 		server.lobbyPkt.Header.Size += 12
 	}
@@ -177,16 +218,24 @@ func (server BlockServer) NewClient(conn *net.TCPConn) (*Client, error) {
 }
 
 func (server BlockServer) Handle(c *Client) error {
-	var err error = nil
 	var hdr BBHeader
-	util.StructFromBytes(c.Data()[:BBHeaderSize], &hdr)
+	err := util.StructFromBytes(c.Data(), &hdr)
+	if err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	case LoginType:
-		err = handleShipLogin(c)
-		c.SendLobbyList(&server.lobbyPkt)
+		if err = handleShipLogin(c); err == nil {
+			c.SendLobbyList(&server.lobbyPkt)
+			c.SendBlockTransition()
+		}
+	case SimpleMailType:
+		err = handleSimpleMail(c)
+	case CreateGameType:
+		err = handleCreateGame(c)
 	default:
-		log.Infof("Received unknown packet %02x from %s", hdr.Type, c.IPAddr())
+		c.Logf("Received unknown packet %02x", hdr.Type)
 	}
 	return err
 }
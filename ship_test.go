@@ -0,0 +1,162 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"github.com/dcrodman/archon/util"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func newMail(to uint32, text string) *SimpleMailPacket {
+	pkt := &SimpleMailPacket{Header: BBHeader{Type: SimpleMailType}, ToGuildcard: to}
+	writeTextField(pkt.Text[:], utf16.Encode([]rune(text)))
+	// Forged; the server should replace it with the real sender.
+	pkt.FromGuildcard = 1
+	return pkt
+}
+
+func TestSimpleMail(t *testing.T) {
+	useConfig(t, func(c *Config) {})
+	sender, senderPeer := newTestClientPair(t)
+	sender.guildcard = 42000001
+	recipient, recipientPeer := newTestClientPair(t)
+	recipient.guildcard = 42000002
+	sessions.Add(recipient, true)
+	defer sessions.Remove(recipient)
+
+	deliverPacket(t, sender, senderPeer, newMail(recipient.guildcard, "Hello"))
+	if err := handleSimpleMail(sender); err != nil {
+		t.Fatal(err)
+	}
+	var mail SimpleMailPacket
+	if err := util.StructFromBytes(expectPacket(t, recipientPeer, SimpleMailType), &mail); err != nil {
+		t.Fatal(err)
+	}
+	if mail.FromGuildcard != sender.guildcard {
+		t.Errorf("Mail is from %d; expected %d", mail.FromGuildcard, sender.guildcard)
+	}
+	if text := util.ConvertFromUtf16(mail.Text[:]); text != "Hello" {
+		t.Errorf("Mail text is %q", text)
+	}
+
+	// Mail to a player who isn't online.
+	deliverPacket(t, sender, senderPeer, newMail(42000003, "Hello"))
+	if err := handleSimpleMail(sender); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectClientMessage(t, senderPeer); !strings.Contains(msg, "isn't online") {
+		t.Errorf("Sender was told %q", msg)
+	}
+}
+
+func TestSimpleMailDisabled(t *testing.T) {
+	useConfig(t, func(c *Config) { c.Features = map[string]bool{FeatureMail: false} })
+	sender, senderPeer := newTestClientPair(t)
+	sender.guildcard = 42000001
+	recipient, _ := newTestClientPair(t)
+	recipient.guildcard = 42000002
+	sessions.Add(recipient, true)
+	defer sessions.Remove(recipient)
+
+	deliverPacket(t, sender, senderPeer, newMail(recipient.guildcard, "Hello"))
+	if err := handleSimpleMail(sender); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectClientMessage(t, senderPeer); !strings.Contains(msg, "Mail is disabled") {
+		t.Errorf("Sender was told %q", msg)
+	}
+}
+
+func TestCreateGameChallengeMode(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		useConfig(t, func(c *Config) {
+			c.Features = map[string]bool{FeatureChallengeMode: enabled}
+		})
+		c, peer := newTestClientPair(t)
+		deliverPacket(t, c, peer, &CreateGamePacket{
+			Header:        BBHeader{Type: CreateGameType},
+			ChallengeMode: 1,
+			Episode:       1,
+		})
+		if err := handleCreateGame(c); err != nil {
+			t.Fatal(err)
+		}
+		msg := expectClientMessage(t, peer)
+		if disabled := strings.Contains(msg, "Challenge mode is disabled"); disabled == enabled {
+			t.Errorf("Challenge mode enabled=%v; client was told %q", enabled, msg)
+		}
+	}
+}
+
+func TestBlockLoginTransition(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	security, _ := util.BytesFromStruct(&ClientConfig{
+		Magic:        ClientConfigMagic,
+		SessionToken: sessions.IssueToken(42000001),
+	})
+
+	server := &BlockServer{}
+	server.Init()
+	c, peer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	deliverPacket(t, c, peer, newLoginPacket(security))
+	if err := server.Handle(c); err != nil {
+		t.Fatal(err)
+	}
+	// The character data request has to come after the lobby list.
+	for _, pktType := range []uint16{LoginSecurityType, LobbyListType, CharDataRequestType} {
+		expectPacket(t, peer, pktType)
+	}
+}
+
+func TestBlockLoginFailureSkipsTransition(t *testing.T) {
+	db, fake := newFakeDB(t)
+	useConfig(t, func(c *Config) { c.database = db })
+	oldSessions := sessions
+	sessions = NewSessionList()
+	t.Cleanup(func() { sessions = oldSessions })
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &BlockServer{}
+	server.Init()
+	c, peer := newTestClientPair(t)
+	expectAccount(fake, hash)
+	// No session was issued by the login server.
+	deliverPacket(t, c, peer, newLoginPacket(nil))
+	if err := server.Handle(c); err == nil {
+		t.Fatal("Block server accepted a client without a session")
+	}
+	expectPacket(t, peer, LoginSecurityType)
+	c.Close()
+	if pkt, err := ReceivePacket(peer); err == nil {
+		t.Errorf("Sent packet %02x after a failed login", pkt[2])
+	}
+}
@@ -34,15 +34,14 @@ import (
 	// 	"sync"
 	// 	"time"
 	"github.com/dcrodman/archon/util"
-	"strconv"
 )
 
 type Ship struct {
 	name [23]byte
 	id   uint32
 
-	ipAddr [4]byte
-	port   uint16
+	// Where players selecting the ship are redirected to.
+	addr ShipConfig
 
 	// conn   net.Conn
 	// recvSize   int
@@ -340,10 +339,15 @@ func (server *ShipgateServer) Init() {
 	// ships will be added to this list by the shipgate, if it's enabled.
 	s := &shipList[0]
 	s.id = 1
-	s.ipAddr = config.HostnameBytes()
-	port, _ := strconv.ParseUint(config.ShipPort, 10, 16)
-	s.port = uint16(port)
+	s.addr = ShipConfig{Name: config.ShipName, Host: config.Hostname, Port: config.ShipPort}
 	copy(s.name[:], config.ShipName)
+
+	// Followed by any other ships listed in the config.
+	for _, sc := range config.Ships {
+		ship := Ship{id: uint32(len(shipList) + 1), addr: sc}
+		copy(ship.name[:], sc.Name)
+		shipList = append(shipList, ship)
+	}
 }
 
 func (server ShipgateServer) NewClient(conn *net.TCPConn) (*Client, error) {
@@ -352,9 +356,11 @@ func (server ShipgateServer) NewClient(conn *net.TCPConn) (*Client, error) {
 
 // Basically a no-op at this point since we only have one ship.
 func (server ShipgateServer) Handle(c *Client) error {
-	var err error = nil
 	var hdr BBHeader
-	util.StructFromBytes(c.Data()[:BBHeaderSize], &hdr)
+	err := util.StructFromBytes(c.Data(), &hdr)
+	if err != nil {
+		return err
+	}
 
 	switch hdr.Type {
 	default:
@@ -0,0 +1,289 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Per-class stat tables. The base stats and per-level stat increases come
+* from PlyLevelTbl.prs by default but can be overridden by a JSON file so
+* that servers can customize class balance.
+ */
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/dcrodman/archon/prs"
+	"github.com/dcrodman/archon/util"
+	"io/ioutil"
+)
+
+const (
+	NumCharClasses = 12
+	// Levels are zero-indexed, so the highest level is MaxLevel - 1.
+	MaxLevel = 200
+)
+
+// Stat increase and experience required for a single level.
+type LevelStats struct {
+	Stats      CharacterStats
+	Experience uint32
+}
+
+// Per-class level tables. levelStats[class][level] is the increase gained
+// on reaching level; the entry for level 0 is unused.
+var levelStats [NumCharClasses][MaxLevel]LevelStats
+
+// Set once the level tables have been loaded, which the login server does
+// on startup; without them only the base stats are known.
+var levelStatsLoaded bool
+
+// Level table entry as it's stored in PlyLevelTbl; TP is unused on BB.
+type plyLevelEntry struct {
+	ATP        uint8
+	MST        uint8
+	EVP        uint8
+	HP         uint8
+	DFP        uint8
+	ATA        uint8
+	LCK        uint8
+	TP         uint8
+	Experience uint32
+}
+
+// Size of the trailer at the end of PlyLevelTbl, which holds the offset of
+// the root table.
+const plyLevelTrailerSize = 0x20
+
+// Parse the base stats and level tables out of a decompressed PlyLevelTbl.
+// The root table holds the offsets of two lists of per-class offsets, the
+// first to each class's base stats and the second to its level table.
+func ParseLevelTable(data []byte) ([NumCharClasses]CharacterStats, [NumCharClasses][MaxLevel]LevelStats, error) {
+	var base [NumCharClasses]CharacterStats
+	var levels [NumCharClasses][MaxLevel]LevelStats
+
+	// Returns the uint32 at offset, or false if it's out of range.
+	read := func(offset uint32) (uint32, bool) {
+		if uint64(offset)+4 > uint64(len(data)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data[offset:]), true
+	}
+	if len(data) < plyLevelTrailerSize {
+		return base, levels, fmt.Errorf("Level table is too short (%d bytes)", len(data))
+	}
+	root, ok := read(uint32(len(data) - plyLevelTrailerSize + 0x10))
+	baseOffsets, ok2 := read(root)
+	levelOffsets, ok3 := read(root + 4)
+	if !ok || !ok2 || !ok3 {
+		return base, levels, fmt.Errorf("Invalid level table root offset %#x", root)
+	}
+
+	entrySize := uint32(binary.Size(plyLevelEntry{}))
+	for class := uint32(0); class < NumCharClasses; class++ {
+		offset, ok := read(baseOffsets + class*4)
+		if !ok || offset > uint32(len(data)) {
+			return base, levels, fmt.Errorf("Invalid base stats offset for %s", CharClass(class))
+		} else if err := util.StructFromBytes(data[offset:], &base[class]); err != nil {
+			return base, levels, err
+		}
+
+		offset, ok = read(levelOffsets + class*4)
+		if !ok || uint64(offset)+uint64(entrySize*MaxLevel) > uint64(len(data)) {
+			return base, levels, fmt.Errorf("Invalid level table offset for %s", CharClass(class))
+		}
+		for level := uint32(0); level < MaxLevel; level++ {
+			var e plyLevelEntry
+			if err := util.StructFromBytes(data[offset+level*entrySize:], &e); err != nil {
+				return base, levels, err
+			}
+			levels[class][level] = LevelStats{
+				Stats: CharacterStats{
+					ATP: uint16(e.ATP), MST: uint16(e.MST), EVP: uint16(e.EVP),
+					HP: uint16(e.HP), DFP: uint16(e.DFP), ATA: uint16(e.ATA),
+					LCK: uint16(e.LCK),
+				},
+				Experience: e.Experience,
+			}
+		}
+	}
+	return base, levels, nil
+}
+
+// Install the base stats and level tables from the PRS-compressed
+// PlyLevelTbl file the client ships with. These are the defaults that
+// LoadStatTables overrides.
+func LoadLevelTable(path string) error {
+	compressed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	} else if len(compressed) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	data := make([]byte, prs.DecompressSize(compressed))
+	prs.Decompress(compressed, data)
+
+	base, levels, err := ParseLevelTable(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	BaseStats = base
+	levelStats = levels
+	levelStatsLoaded = true
+	return nil
+}
+
+// Format of the stat table file.
+type statTableFile struct {
+	Classes []statTableEntry
+}
+
+type statTableEntry struct {
+	Class     string
+	BaseStats CharacterStats
+	Levels    []LevelStats
+}
+
+// Replace the base stats and level tables with the ones in the JSON file at
+// path. The file must define every class and every level; if it doesn't, or
+// can't be read, the tables already loaded from PlyLevelTbl are left in place.
+func LoadStatTables(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tables statTableFile
+	if err = json.Unmarshal(data, &tables); err != nil {
+		return err
+	}
+
+	var base [NumCharClasses]CharacterStats
+	var levels [NumCharClasses][MaxLevel]LevelStats
+	var found [NumCharClasses]bool
+	for _, entry := range tables.Classes {
+		class := -1
+		for i := 0; i < NumCharClasses; i++ {
+			if CharClass(i).String() == entry.Class {
+				class = i
+				break
+			}
+		}
+		if class < 0 {
+			return fmt.Errorf("Unknown class %q in %s", entry.Class, path)
+		} else if found[class] {
+			return fmt.Errorf("Class %s defined more than once in %s", entry.Class, path)
+		} else if len(entry.Levels) != MaxLevel {
+			return fmt.Errorf("Class %s has %d levels in %s; expected %d",
+				entry.Class, len(entry.Levels), path, MaxLevel)
+		}
+		found[class] = true
+		base[class] = entry.BaseStats
+		copy(levels[class][:], entry.Levels)
+	}
+	for i, ok := range found {
+		if !ok {
+			return fmt.Errorf("Class %s missing from %s", CharClass(i), path)
+		}
+	}
+
+	BaseStats = base
+	levelStats = levels
+	levelStatsLoaded = true
+	return nil
+}
+
+// Returns the stats a character of class would have at level (zero-indexed)
+// without any materials or equipment.
+func StatsAtLevel(class CharClass, level uint32) CharacterStats {
+	stats := BaseStats[class]
+	for i := uint32(1); i <= level && i < MaxLevel; i++ {
+		inc := &levelStats[class][i].Stats
+		stats.ATP += inc.ATP
+		stats.MST += inc.MST
+		stats.EVP += inc.EVP
+		stats.HP += inc.HP
+		stats.DFP += inc.DFP
+		stats.ATA += inc.ATA
+		stats.LCK += inc.LCK
+	}
+	return stats
+}
+
+const (
+	// Most stat materials a character can use in total.
+	maxMaterials = 250
+	// Stat increase given by each material.
+	materialBonus = 2
+)
+
+// Checks that none of the character's stats are higher than its class
+// could have at its level after using every material it's allowed. Only
+// checked once the level tables have been loaded.
+func (fc *FullCharacter) ValidateStats() error {
+	c := &fc.Character
+	if !levelStatsLoaded || c.Class >= NumCharClasses {
+		return nil
+	}
+	max := StatsAtLevel(CharClass(c.Class), c.Level)
+	// Limits are computed as ints since a high stat plus the material bonus
+	// can be more than a uint16 holds.
+	bonus := maxMaterials * materialBonus
+	checks := []struct {
+		name       string
+		value, max int
+	}{
+		{"ATP", int(c.Stats.ATP), int(max.ATP) + bonus},
+		{"MST", int(c.Stats.MST), int(max.MST) + bonus},
+		{"EVP", int(c.Stats.EVP), int(max.EVP) + bonus},
+		{"HP", int(c.Stats.HP), int(max.HP) + bonus},
+		{"DFP", int(c.Stats.DFP), int(max.DFP) + bonus},
+		// There are no ATA materials.
+		{"ATA", int(c.Stats.ATA), int(max.ATA)},
+		{"LCK", int(c.Stats.LCK), int(max.LCK) + bonus},
+	}
+	for _, stat := range checks {
+		if stat.value > stat.max {
+			return fmt.Errorf("%s of %d is over the maximum of %d for a level %d %s",
+				stat.name, stat.value, stat.max, c.Level+1, CharClass(c.Class))
+		}
+	}
+	return nil
+}
+
+// Size of a marshaled CharacterStats; the seven stats followed by two
+// bytes of padding.
+const marshaledStatsSize = 16
+
+// Returns the stats as 16 little-endian bytes, in the same order as the
+// struct, for storing in a column on their own.
+func (s CharacterStats) Marshal() []byte {
+	data := make([]byte, marshaledStatsSize)
+	for i, stat := range []uint16{s.ATP, s.MST, s.EVP, s.HP, s.DFP, s.ATA, s.LCK} {
+		binary.LittleEndian.PutUint16(data[i*2:], stat)
+	}
+	return data
+}
+
+// Parse stats written by CharacterStats.Marshal.
+func UnmarshalCharacterStats(data []byte) (CharacterStats, error) {
+	var s CharacterStats
+	if len(data) != marshaledStatsSize {
+		return s, fmt.Errorf("Invalid stats length %d", len(data))
+	}
+	for i, stat := range []*uint16{&s.ATP, &s.MST, &s.EVP, &s.HP, &s.DFP, &s.ATA, &s.LCK} {
+		*stat = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return s, nil
+}
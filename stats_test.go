@@ -0,0 +1,204 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testLevelTable = "config/parameters/PlyLevelTbl.prs"
+
+// Install the level tables from the client's PlyLevelTbl for the rest of
+// the test, restoring whatever was loaded before afterwards.
+func useLevelTable(t *testing.T) {
+	t.Helper()
+	base, levels, loaded := BaseStats, levelStats, levelStatsLoaded
+	t.Cleanup(func() { BaseStats, levelStats, levelStatsLoaded = base, levels, loaded })
+	if err := LoadLevelTable(testLevelTable); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadLevelTable(t *testing.T) {
+	useLevelTable(t)
+	expected := CharacterStats{ATP: 35, MST: 29, EVP: 45, HP: 20, DFP: 17, ATA: 30, LCK: 10}
+	if BaseStats[Humar] != expected {
+		t.Errorf("HUmar base stats are %+v; expected %+v", BaseStats[Humar], expected)
+	}
+	if levelStats[Humar][0] != (LevelStats{}) {
+		t.Errorf("Level 0 entry is %+v; expected it to be empty", levelStats[Humar][0])
+	}
+	expectedLevel := LevelStats{
+		Stats:      CharacterStats{ATP: 7, MST: 5, EVP: 5, HP: 3, DFP: 1, ATA: 7},
+		Experience: 50,
+	}
+	if levelStats[Humar][1] != expectedLevel {
+		t.Errorf("HUmar level 1 entry is %+v; expected %+v", levelStats[Humar][1], expectedLevel)
+	}
+	for class := 0; class < NumCharClasses; class++ {
+		if exp := levelStats[class][MaxLevel-1].Experience; exp != 83227800 {
+			t.Errorf("%s needs %d experience for the last level", CharClass(class), exp)
+		}
+	}
+}
+
+func TestParseLevelTableRejectsTruncated(t *testing.T) {
+	if _, _, err := ParseLevelTable(make([]byte, 16)); err == nil {
+		t.Error("Parsed a truncated level table")
+	}
+	// A trailer pointing past the end of the data.
+	data := make([]byte, 64)
+	data[len(data)-plyLevelTrailerSize+0x10] = 0xF0
+	if _, _, err := ParseLevelTable(data); err == nil {
+		t.Error("Parsed a level table with an invalid root offset")
+	}
+}
+
+func TestValidateStats(t *testing.T) {
+	useLevelTable(t)
+	fc := NewTestCharacter(t, WithClass(Ramarl), WithLevel(99))
+	if err := fc.ValidateStats(); err != nil {
+		t.Errorf("Stats at level failed validation: %s", err.Error())
+	}
+
+	// Every material used on HP.
+	fc.Character.Stats.HP += maxMaterials * materialBonus
+	if err := fc.ValidateStats(); err != nil {
+		t.Errorf("Stats with every material used failed validation: %s", err.Error())
+	}
+	fc.Character.Stats.HP++
+	if err := fc.ValidateStats(); err == nil {
+		t.Error("HP over the material limit passed validation")
+	}
+
+	fc = NewTestCharacter(t, WithClass(Ramarl), WithLevel(99))
+	fc.Character.Stats.ATA++
+	if err := fc.ValidateStats(); err == nil {
+		t.Error("ATA raised by materials passed validation")
+	}
+}
+
+func TestValidateStatsNearLimit(t *testing.T) {
+	useLevelTable(t)
+	// A customized class whose ATP is close enough to the top of a uint16
+	// that adding the material bonus would wrap around.
+	BaseStats[Humar].ATP = 65400
+	fc := NewTestCharacter(t)
+	fc.Character.Stats.ATP = 65535
+	if err := fc.ValidateStats(); err != nil {
+		t.Errorf("Stats within the material limit failed validation: %s", err.Error())
+	}
+}
+
+// Write the currently loaded tables to a stat table file, leaving out skip.
+func writeStatTables(t *testing.T, skip CharClass) string {
+	t.Helper()
+	var file statTableFile
+	for class := CharClass(0); class < NumCharClasses; class++ {
+		if class == skip {
+			continue
+		}
+		entry := statTableEntry{Class: class.String(), BaseStats: BaseStats[class]}
+		entry.Levels = append(entry.Levels, levelStats[class][:]...)
+		file.Classes = append(file.Classes, entry)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadStatTables(t *testing.T) {
+	useLevelTable(t)
+	defaults := levelStats
+
+	BaseStats[Fomar].MST = 999
+	levelStats[Fomar][10].Stats.MST = 99
+	path := writeStatTables(t, NumCharClasses)
+	if err := LoadLevelTable(testLevelTable); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadStatTables(path); err != nil {
+		t.Fatal(err)
+	}
+	if BaseStats[Fomar].MST != 999 || levelStats[Fomar][10].Stats.MST != 99 {
+		t.Error("Customized stats weren't installed")
+	}
+	if levelStats[Humar] != defaults[Humar] {
+		t.Error("Unchanged class differs from the defaults")
+	}
+}
+
+func TestLoadStatTablesMissingClass(t *testing.T) {
+	useLevelTable(t)
+	BaseStats[Fomar].MST = 999
+	path := writeStatTables(t, Racaseal)
+	if err := LoadLevelTable(testLevelTable); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadStatTables(path); err == nil {
+		t.Error("Loaded a stat table file without every class")
+	}
+	if BaseStats[Fomar].MST == 999 {
+		t.Error("Incomplete stat table file replaced the defaults")
+	}
+}
+
+func TestLoadStatTablesFallback(t *testing.T) {
+	useLevelTable(t)
+	defaults := levelStats
+	err := LoadStatTables(filepath.Join(t.TempDir(), "missing.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Loading a missing file returned %v", err)
+	}
+	if !levelStatsLoaded || levelStats != defaults {
+		t.Error("Missing stat table file replaced the defaults")
+	}
+}
+
+func TestMarshalCharacterStats(t *testing.T) {
+	stats := CharacterStats{ATP: 1, MST: 0x0203, EVP: 3, HP: 0xFFFF, DFP: 5, ATA: 6, LCK: 7}
+	data := stats.Marshal()
+	if len(data) != 16 {
+		t.Fatalf("Marshaled stats are %d bytes; expected 16", len(data))
+	}
+	if data[2] != 0x03 || data[3] != 0x02 {
+		t.Errorf("MST marshaled as % x; expected little-endian", data[2:4])
+	}
+	unmarshaled, err := UnmarshalCharacterStats(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled != stats {
+		t.Errorf("Stats round tripped to %+v; expected %+v", unmarshaled, stats)
+	}
+	if _, err := UnmarshalCharacterStats(data[:14]); err == nil {
+		t.Error("Unmarshaled truncated stats")
+	}
+}
@@ -0,0 +1,99 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Runtime information about the server for status reporting.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Version of the server build, set with -ldflags "-X main.BuildVersion=1.2.3".
+var BuildVersion = "dev"
+
+// Time the server process started.
+var startTime = time.Now()
+
+type StatusInfo struct {
+	Uptime time.Duration
+	// Open connections to any of the servers.
+	Connections int
+	// Players logged in to an account.
+	Players int
+	Version string
+}
+
+// Returns a snapshot of the server's uptime, load, and version.
+func ServerStatus() StatusInfo {
+	return StatusInfo{
+		Uptime:      time.Since(startTime),
+		Connections: connections.Count(),
+		Players:     len(sessions.Clients()),
+		Version:     BuildVersion,
+	}
+}
+
+// A logged in player, as shown in the online players view.
+type OnlinePlayer struct {
+	Guildcard uint32
+	// Name of the selected character; empty if one hasn't been selected.
+	Character string
+	IPAddr    string
+	Idle      time.Duration
+	// Round trip time of the player's last ping; 0 until one is answered.
+	RTT time.Duration
+}
+
+// Returns the players that are currently logged in, ordered by guildcard.
+func OnlinePlayers() []OnlinePlayer {
+	now := timeNow()
+	var players []OnlinePlayer
+	for _, c := range sessions.Clients() {
+		p := OnlinePlayer{
+			Guildcard: c.guildcard,
+			IPAddr:    c.IPAddr(),
+			Idle:      now.Sub(c.LastActivity()),
+			RTT:       c.LastRTT(),
+		}
+		if c.character != nil {
+			p.Character = displayName(c.character.Character.Name[:])
+		}
+		players = append(players, p)
+	}
+	sort.Slice(players, func(i, j int) bool { return players[i].Guildcard < players[j].Guildcard })
+	return players
+}
+
+// Write the online players as a table, one player per line.
+func WriteOnlinePlayers(w io.Writer, players []OnlinePlayer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Guildcard\tCharacter\tAddress\tIdle\tRTT")
+	for _, p := range players {
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", p.Guildcard, p.Character, p.IPAddr,
+			p.Idle.Round(time.Second), rtt)
+	}
+	return tw.Flush()
+}
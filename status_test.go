@@ -0,0 +1,97 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnlinePlayers(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	oldNow, oldSessions := timeNow, sessions
+	timeNow = func() time.Time { return now }
+	sessions = NewSessionList()
+	t.Cleanup(func() { timeNow, sessions = oldNow, oldSessions })
+
+	pinged := &Client{guildcard: 42000002, ipAddr: "10.0.0.2",
+		character: NewTestCharacter(t)}
+	pinged.lastActivity = now.Add(-5 * time.Second).UnixNano()
+	pinged.lastRTT = int64(87 * time.Millisecond)
+	fresh := &Client{guildcard: 42000001, ipAddr: "10.0.0.1"}
+	fresh.lastActivity = now.UnixNano()
+	for _, c := range []*Client{pinged, fresh} {
+		if err := sessions.Add(c, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	players := OnlinePlayers()
+	if len(players) != 2 || players[0].Guildcard != 42000001 || players[1].Guildcard != 42000002 {
+		t.Fatalf("Online players are %+v", players)
+	}
+	if p := players[1]; p.RTT != 87*time.Millisecond || p.Idle != 5*time.Second || p.Character != "Tester" {
+		t.Errorf("Pinged player is %+v", p)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteOnlinePlayers(&buf, players); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "RTT") {
+		t.Fatalf("Unexpected players table:\n%s", buf.String())
+	}
+	if fields := strings.Fields(lines[1]); fields[len(fields)-1] != "-" {
+		t.Errorf("Player without a ping shows an RTT: %s", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); fields[len(fields)-1] != "87ms" {
+		t.Errorf("Pinged player's RTT isn't shown: %s", lines[2])
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	oldStart, oldConnections, oldSessions, oldVersion := startTime, connections, sessions, BuildVersion
+	startTime = time.Now().Add(-time.Hour)
+	connections, sessions, BuildVersion = NewClientList(), NewSessionList(), "1.2.3"
+	t.Cleanup(func() {
+		startTime, connections, sessions, BuildVersion = oldStart, oldConnections, oldSessions, oldVersion
+	})
+
+	// One client still at the login screen and one logged in.
+	player := &Client{guildcard: 42000001}
+	connections.Add(&Client{})
+	connections.Add(player)
+	if err := sessions.Add(player, false); err != nil {
+		t.Fatal(err)
+	}
+
+	status := ServerStatus()
+	if status.Uptime < time.Hour {
+		t.Errorf("Uptime is %v; expected at least an hour", status.Uptime)
+	}
+	if status.Connections != 2 || status.Players != 1 || status.Version != "1.2.3" {
+		t.Errorf("Server status is %+v", status)
+	}
+	time.Sleep(time.Millisecond)
+	if later := ServerStatus(); later.Uptime <= status.Uptime {
+		t.Errorf("Uptime went from %v to %v", status.Uptime, later.Uptime)
+	}
+}
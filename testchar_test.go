@@ -0,0 +1,123 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+* ---------------------------------------------------------------------
+* Builder for realistic characters to use as fixtures when testing the
+* character validation and serialization code.
+ */
+package main
+
+import (
+	"github.com/dcrodman/archon/util"
+	"testing"
+	"unicode/utf16"
+)
+
+type TestCharOption func(fc *FullCharacter) error
+
+// Set the character's class.
+func WithClass(class CharClass) TestCharOption {
+	return func(fc *FullCharacter) error {
+		fc.Character.Class = byte(class)
+		fc.Class = uint8(class)
+		return nil
+	}
+}
+
+// Set the character's (zero-indexed) level.
+func WithLevel(level uint32) TestCharOption {
+	return func(fc *FullCharacter) error {
+		fc.Character.Level = level
+		return nil
+	}
+}
+
+// Give the character a weapon, frame, barrier and mag, all equipped, and
+// a stack of monomates.
+func WithItems() TestCharOption {
+	return func(fc *FullCharacter) error {
+		items := []Item{
+			{Data: [12]uint8{uint8(ItemTypeWeapon), 0x01, 0x00}},
+			{Data: [12]uint8{ItemTypeArmor, ArmorTypeFrame, 0x00}},
+			{Data: [12]uint8{ItemTypeArmor, ArmorTypeBarrier, 0x00}},
+			{Data: [12]uint8{ItemTypeMag, 0x00, 0x05}},
+			{Data: [12]uint8{ItemTypeTool, 0x00, 0x00, 0x00, 0x00, 0x04}},
+		}
+		for _, it := range items {
+			if err := fc.GrantItem(it); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 4; i++ {
+			fc.Inventory.Items[i].Flags |= itemEquipped
+		}
+		return nil
+	}
+}
+
+// Put a few items and some meseta in the character's bank.
+func WithBank() TestCharOption {
+	return func(fc *FullCharacter) error {
+		id, err := fc.nextItemId()
+		if err != nil {
+			return err
+		}
+		fc.Bank.Items[0] = BankItem{Item: Item{Data: [12]uint8{uint8(ItemTypeWeapon), 0x02, 0x00}, ItemId: id}, Amount: 1}
+		fc.Bank.Items[1] = BankItem{Item: Item{Data: [12]uint8{ItemTypeTool, 0x01, 0x00}, ItemId: id + 1}, Amount: 5}
+		fc.Bank.NumItems = 2
+		fc.Bank.Meseta = 10000
+		return nil
+	}
+}
+
+// Returns a character that passes Validate, by default a level 1 HUmar
+// with nothing in its inventory or bank, modified by opts. Fails the test
+// if any of the options can't be applied.
+func NewTestCharacter(t testing.TB, opts ...TestCharOption) *FullCharacter {
+	t.Helper()
+	fc := new(FullCharacter)
+	fc.Guildcard = 42000001
+	name := utf16.Encode([]rune("\tETester"))
+	copy(fc.Character.Name[:], name)
+	copy(fc.Name[:], name)
+	fc.Character.NameColor = 0xFFFFFFFF
+	fc.Character.Meseta = 300
+	fc.Inventory.Language = uint8(LanguageEnglish)
+	fc.Character.clearTechniques()
+
+	for _, opt := range opts {
+		if err := opt(fc); err != nil {
+			t.Fatalf("Failed to build test character: %s", err.Error())
+		}
+	}
+	fc.Character.Stats = StatsAtLevel(CharClass(fc.Character.Class), fc.Character.Level)
+	return fc
+}
+
+func TestCharacterRoundTrip(t *testing.T) {
+	fc := NewTestCharacter(t, WithClass(Fomarl), WithLevel(49), WithItems(), WithBank())
+	if err := fc.Validate(); err != nil {
+		t.Fatalf("Test character failed validation: %s", err.Error())
+	}
+	data, _ := util.BytesFromStruct(fc)
+	var decoded FullCharacter
+	if err := util.StructFromBytes(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != *fc {
+		t.Error("Character changed after a round trip through its serialized form")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"unicode/utf16"
@@ -55,12 +56,63 @@ func ExpandUtf16(src []uint16) []uint8 {
 	return expanded
 }
 
+// Inverse of ExpandUtf16; combines pairs of little endian bytes into
+// UTF-16 elements. A trailing odd byte is ignored.
+func CompressUtf16(src []uint8) []uint16 {
+	compressed := make([]uint16, len(src)/2)
+	for i := range compressed {
+		compressed[i] = uint16(src[i*2]) | uint16(src[i*2+1])<<8
+	}
+	return compressed
+}
+
 // Convert a UTF-8 string to UTF-16 LE and return it as an array of bytes.
 func ConvertToUtf16(str string) []byte {
 	strRunes := bytes.Runes([]byte(str))
 	return ExpandUtf16(utf16.Encode(strRunes))
 }
 
+// Convert a UTF-16 string to UTF-8, stopping at the first null character.
+func ConvertFromUtf16(src []uint16) string {
+	for i, v := range src {
+		if v == 0 {
+			src = src[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(src))
+}
+
+// Remove control characters from player-authored text (info board, auto
+// reply, etc.) so that it can't break the rendering of other clients. Tabs
+// are only kept when they start a language marker at the beginning of the
+// string ("\tE" or "\tJ") or a color code ("\tC" followed by a digit).
+func SanitizeDisplayText(s string) string {
+	runes := []rune(s)
+	clean := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\t':
+			if i == 0 && len(runes) > 1 && (runes[1] == 'E' || runes[1] == 'J') {
+				clean = append(clean, r, runes[1])
+				i++
+			} else if i+2 < len(runes) && runes[i+1] == 'C' &&
+				runes[i+2] >= '0' && runes[i+2] <= '9' {
+				clean = append(clean, r, runes[i+1], runes[i+2])
+				i += 2
+			}
+		case r == '\n':
+			clean = append(clean, r)
+		case r < 0x20, r >= 0x7F && r < 0xA0:
+			// Drop C0 and C1 control characters.
+		default:
+			clean = append(clean, r)
+		}
+	}
+	return string(clean)
+}
+
 // Returns a slice of b without the trailing 0s.
 func StripPadding(b []byte) []byte {
 	for i := len(b) - 1; i >= 0; i-- {
@@ -119,15 +171,22 @@ func BytesFromStruct(data interface{}) ([]byte, int) {
 }
 
 // Populates the struct pointed to by targetStruct by reading in a stream of
-// bytes and filling the values in sequential order.
-func StructFromBytes(data []byte, targetStruct interface{}) {
+// bytes and filling the values in sequential order. Returns an error if data
+// is too short to fill the struct.
+func StructFromBytes(data []byte, targetStruct interface{}) error {
 	targetVal := reflect.ValueOf(targetStruct)
 	if valKind := targetVal.Kind(); valKind != reflect.Ptr {
 		panic("StructFromBytes(): targetStruct must be a " +
 			"ptr to struct, got: " + valKind.String())
 	}
-	reader := bytes.NewReader(data)
 	val := targetVal.Elem()
+	// Structs with pointer or slice fields don't have a fixed size, so for
+	// those a short read is only caught once we reach the end of data.
+	if size := binary.Size(targetStruct); size > 0 && len(data) < size {
+		return fmt.Errorf("StructFromBytes(): %s needs %d bytes, got %d",
+			val.Type(), size, len(data))
+	}
+	reader := bytes.NewReader(data)
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Field(i)
 
@@ -139,53 +198,64 @@ func StructFromBytes(data []byte, targetStruct interface{}) {
 			err = binary.Read(reader, binary.LittleEndian, field.Addr().Interface())
 		}
 		if err != nil {
-			panic(err.Error())
+			return fmt.Errorf("StructFromBytes(): reading %s.%s: %s",
+				val.Type(), val.Type().Field(i).Name, err.Error())
 		}
 	}
+	return nil
 }
 
-// Write one line of data to stdout.
-func printPacketLine(data []uint8, length int, offset int) {
-	fmt.Printf("(%04X) ", offset)
+// Write one line of data to w.
+func printPacketLine(w io.Writer, data []uint8, length int, offset int) {
+	fmt.Fprintf(w, "(%04X) ", offset)
 	// Print our bytes.
 	for i, j := 0, 0; i < length; i++ {
 		if j == 8 {
 			// Visual aid - spacing between groups of 8 bytes.
 			j = 0
-			fmt.Print("  ")
+			fmt.Fprint(w, "  ")
 		}
-		fmt.Printf("%02x ", data[i])
+		fmt.Fprintf(w, "%02x ", data[i])
 		j++
 	}
 	// Fill in the gap if we don't have enough bytes to fill the line.
 	for i := length; i < displayWidth; i++ {
 		if i == 8 {
-			fmt.Print("  ")
+			fmt.Fprint(w, "  ")
 		}
-		fmt.Print("   ")
+		fmt.Fprint(w, "   ")
 	}
-	fmt.Print("    ")
+	fmt.Fprint(w, "    ")
 	// Display the print characters as-is, others as periods.
 	for i := 0; i < length; i++ {
 		c := data[i]
 		if strconv.IsPrint(rune(c)) {
-			fmt.Printf("%c", data[i])
+			fmt.Fprintf(w, "%c", data[i])
 		} else {
-			fmt.Print(".")
+			fmt.Fprint(w, ".")
 		}
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
-// Print the contents of a packet to stdout in two columns, one for bytes and
-// the other for their ascii representation.
-func PrintPayload(data []uint8, pktLen int) {
+// Format data in two columns, one for bytes and the other for their ascii
+// representation, so that it can be logged or pasted into a bug report.
+func HexDump(data []uint8) string {
+	buf := new(bytes.Buffer)
+	pktLen := len(data)
 	for rem, offset := pktLen, 0; rem > 0; rem -= displayWidth {
 		if rem < displayWidth {
-			printPacketLine(data[(pktLen-rem):pktLen], rem, offset)
+			printPacketLine(buf, data[(pktLen-rem):pktLen], rem, offset)
 		} else {
-			printPacketLine(data[offset:offset+displayWidth], displayWidth, offset)
+			printPacketLine(buf, data[offset:offset+displayWidth], displayWidth, offset)
 		}
 		offset += displayWidth
 	}
+	return buf.String()
+}
+
+// Print the contents of a packet to stdout in two columns, one for bytes and
+// the other for their ascii representation.
+func PrintPayload(data []uint8, pktLen int) {
+	fmt.Print(HexDump(data[:pktLen]))
 }
@@ -0,0 +1,136 @@
+/*
+* Archon PSO Server
+* Copyright (C) 2014 Andrew Rodman
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package util
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestConvertFromUtf16(t *testing.T) {
+	name := make([]uint16, 12)
+	copy(name, utf16.Encode([]rune("\tEFoo")))
+	if s := ConvertFromUtf16(name); s != "\tEFoo" {
+		t.Errorf("Converted to %q", s)
+	}
+	if s := ConvertFromUtf16(utf16.Encode([]rune("ソニック"))); s != "ソニック" {
+		t.Errorf("Converted to %q", s)
+	}
+}
+
+func TestSanitizeDisplayText(t *testing.T) {
+	tests := []struct {
+		text, clean string
+	}{
+		{"\tEHello, world!", "\tEHello, world!"},
+		{"\tJこんにちは\n\tC4colored", "\tJこんにちは\n\tC4colored"},
+		{"\tEbad\x01\x1b[2Jtext", "\tEbad[2Jtext"},
+		{"mid\tEtab\x7F\u0085", "midEtab"},
+		{"\tCX", "CX"},
+	}
+	for _, test := range tests {
+		if clean := SanitizeDisplayText(test.text); clean != test.clean {
+			t.Errorf("Sanitized %q to %q; expected %q", test.text, clean, test.clean)
+		}
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	data := []byte("Hello, Archon!\x00\x01\x7f\x1bBB")
+	// Short lines are padded so that the ASCII column lines up.
+	expected := "(0000) 48 65 6c 6c 6f 2c 20 41   72 63 68 6f 6e 21 00 01     Hello, Archon!..\n" +
+		"(0010) 7f 1b 42 42 " + strings.Repeat(" ", 12*3+2+4) + "..BB\n"
+	if dump := HexDump(data); dump != expected {
+		t.Errorf("Dump is:\n%s\nexpected:\n%s", dump, expected)
+	}
+	if dump := HexDump(nil); dump != "" {
+		t.Errorf("Dump of nothing is %q", dump)
+	}
+}
+
+type testHeader struct {
+	Size  uint16
+	Type  uint16
+	Flags uint32
+}
+
+type testPacket struct {
+	Header testHeader
+	Name   [4]uint16
+	Value  uint32
+}
+
+func TestStructFromBytes(t *testing.T) {
+	data := []byte{
+		0x14, 0x00, 0x93, 0x00, 0x01, 0x00, 0x00, 0x00,
+		'a', 0x00, 'b', 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x78, 0x56, 0x34, 0x12,
+	}
+	var pkt testPacket
+	if err := StructFromBytes(data, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	expected := testPacket{
+		Header: testHeader{Size: 0x14, Type: 0x93, Flags: 1},
+		Name:   [4]uint16{'a', 'b'},
+		Value:  0x12345678,
+	}
+	if pkt != expected {
+		t.Errorf("Read %+v; expected %+v", pkt, expected)
+	}
+	if round, _ := BytesFromStruct(&pkt); string(round) != string(data) {
+		t.Errorf("Round tripped to % x", round)
+	}
+
+	// Anything past the end of the struct is ignored.
+	var hdr testHeader
+	if err := StructFromBytes(data, &hdr); err != nil || hdr != expected.Header {
+		t.Errorf("Read header %+v (err %v)", hdr, err)
+	}
+}
+
+func TestStructFromBytesShortData(t *testing.T) {
+	var pkt testPacket
+	err := StructFromBytes(make([]byte, 19), &pkt)
+	if err == nil {
+		t.Fatal("Read a struct from too little data")
+	}
+	if !strings.Contains(err.Error(), "needs 20 bytes, got 19") {
+		t.Errorf("Error %q doesn't give the sizes", err.Error())
+	}
+}
+
+func TestStructFromBytesPointerField(t *testing.T) {
+	type withPointer struct {
+		Header *testHeader
+		Value  uint32
+	}
+	data := []byte{0x0C, 0x00, 0xE6, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, 0x00, 0x00, 0x00}
+	pkt := withPointer{Header: new(testHeader)}
+	if err := StructFromBytes(data, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Header.Type != 0xE6 || pkt.Value != 42 {
+		t.Errorf("Read header %+v and value %d", *pkt.Header, pkt.Value)
+	}
+	// Without a fixed size, short data is only caught at the end of it.
+	if err := StructFromBytes(data[:10], &pkt); err == nil {
+		t.Error("Read a struct with a pointer field from too little data")
+	}
+}